@@ -1,12 +1,12 @@
 package api
 
 import (
+	"crypto/subtle"
 	"fmt"
 	"mitsuyu/common"
 	"mitsuyu/manager"
 	"net"
 	"net/http"
-	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -37,10 +37,17 @@ func NewApi(manager *manager.Manager, addr, token string) *Api {
 	}
 	handler.Handle(api.base+"/traffic", api.handleAuth(api.handleGetTraffic))
 	handler.Handle(api.base+"/connection", api.handleAuth(api.handleGetConnection))
+	handler.Handle(api.base+"/workers", api.handleAuth(api.handleGetWorkers))
+	// the link carries the credentials and reload changes the workers,
+	// neither is served without a token
+	if token != "" {
+		handler.Handle(api.base+"/reload", api.handleAuth(api.handleReload))
+		handler.Handle(api.base+"/link", api.handleAuth(api.handleGetLink))
+	}
 	return api
 }
 
-func (api *Api) Serve() {
+func (api *Api) Serve() error {
 	srv := &http.Server{
 		Handler:        api.handler,
 		ReadTimeout:    5 * time.Second,
@@ -49,16 +56,16 @@ func (api *Api) Serve() {
 	}
 	lis, err := net.Listen("tcp", api.addr)
 	if err != nil {
-		fmt.Printf("Api: Unable to listen %s, %v\n", api.addr, err)
-		os.Exit(0)
+		return fmt.Errorf("Api: Unable to listen %s, %v", api.addr, err)
 	}
 	go srv.Serve(lis)
+	return nil
 }
 
 func (api *Api) handleAuth(next func(http.ResponseWriter, *http.Request)) http.Handler {
 	return http.HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
-			if r.Header.Get("token") != api.token {
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get("token")), []byte(api.token)) != 1 {
 				w.WriteHeader(http.StatusForbidden)
 				return
 			}
@@ -67,15 +74,94 @@ func (api *Api) handleAuth(next func(http.ResponseWriter, *http.Request)) http.H
 	)
 }
 
+// statsOf returns the statistician of the worker in query, or the default one
+func (api *Api) statsOf(r *http.Request) *common.Statistician {
+	if name := r.URL.Query().Get("worker"); name != "" {
+		return api.manager.GetStatisticianByName(name)
+	}
+	return api.stats
+}
+
+func (api *Api) connsOf(r *http.Request) *common.Connector {
+	if name := r.URL.Query().Get("worker"); name != "" {
+		return api.manager.GetConnectorByName(name)
+	}
+	return api.conns
+}
+
 func (api *Api) handleGetTraffic(w http.ResponseWriter, r *http.Request) {
-	up, down := api.stats.GetTraffic()
+	stats := api.statsOf(r)
+	if stats == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	up, down := stats.GetTraffic()
 	upstr := strconv.FormatUint(up, 10)
 	downstr := strconv.FormatUint(down, 10)
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.Write([]byte(upstr + "," + downstr))
 }
 
+// handleGetWorkers returns name,state[,error] of each worker in lines
+func (api *Api) handleGetWorkers(w http.ResponseWriter, r *http.Request) {
+	var lines []string
+	for _, name := range api.manager.GetNames() {
+		state, err := api.manager.GetState(name)
+		line := name + "," + state
+		if err != nil {
+			line += "," + err.Error()
+		}
+		lines = append(lines, line)
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(strings.Join(lines, "\n")))
+}
+
+func (api *Api) handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err := api.manager.Reload(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
 func (api *Api) handleGetConnection(w http.ResponseWriter, r *http.Request) {
+	conns := api.connsOf(r)
+	if conns == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	w.Write([]byte(strings.Join(api.conns.GetReport(), "\n")))
+	w.Write([]byte(strings.Join(conns.GetReport(), "\n")))
+}
+
+// handleGetLink returns the share link of the running config,
+// name labels the link and qr=1 renders it as a qr code
+func (api *Api) handleGetLink(w http.ResponseWriter, r *http.Request) {
+	c := api.manager.GetClient()
+	if name := r.URL.Query().Get("worker"); name != "" {
+		c = api.manager.GetClientByName(name)
+	}
+	if c == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	link := c.ShareLink(r.URL.Query().Get("name"))
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if r.URL.Query().Get("qr") == "1" {
+		qr, err := common.LinkQR(link)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		link = qr
+	}
+	w.Write([]byte(link))
 }
@@ -3,18 +3,17 @@ package client
 import (
 	"context"
 	"crypto/tls"
-	"crypto/x509"
+	"errors"
 	"fmt"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/encoding/gzip"
 	"google.golang.org/grpc/metadata"
-	"io/ioutil"
+	"io"
 	"mitsuyu/common"
 	"mitsuyu/mitsuyu"
 	"mitsuyu/transport"
 	"net"
-	"os"
 	"strconv"
 	"strings"
 	"sync"
@@ -23,104 +22,181 @@ import (
 
 const BUFFERSIZE = 4096
 
+const UDPBUFFERSIZE = 65535
+
+const DRAINTIMEOUT = 5 * time.Second
+
 type Client struct {
 	local         string
+	dualStack     bool
+	tproxy        string
+	tun           string
+	tunMTU        int
 	remote        string
 	tls           *tls.Config
+	tlsPin        string
 	padding		  int
+	drain         time.Duration
+	statsFile     string
+	active        map[io.Closer]struct{}
+	activeLock    sync.Mutex
+	// guards the settings swapped by Reload
+	configLock sync.RWMutex
 	compress      string
+	sniffLimit    int
+	sniffTimeout  time.Duration
+	sniffSkip     string
+	deferReply    bool
 	serviceName   string
 	strategyGroup []*common.Strategy
+	users         []*common.User
+	forwards      []*common.Forward
+	inboundList   []*common.Inbound
+	reverses      []*common.Reverse
 	logger        *common.Logger
 	conns         *common.Connector
 	stats         *common.Statistician
-	done          chan struct{}
+	// subscribed servers replace remote if not empty
+	sub         *subscription
+	pool        []*endpoint
+	poolIndex   int
+	poolUpdated int64
+	resubscribe chan struct{}
+	// servers which do not send the status, by address
+	legacy sync.Map
 }
 
 func New(config *common.ClientConfig) (*Client, error) {
 	c := new(Client)
-	if config.Local == "" || config.Remote == "" {
-		return nil, fmt.Errorf("Common: Invalid address")
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("Common: %v", err)
 	}
 	strs := strings.Split(config.Remote, ":")
 	var remoteHost, remotePort string
 	strslen := len(strs)
-	if strslen < 2 {
-		return nil, fmt.Errorf("Common: Invalid remote address")
-	}
 	remotePort = strs[strslen-1]
 	remoteHost = strings.Join(strs[:strslen-1], ":")
 	c.local = config.Local
-	c.remote = remoteHost + ":" + remotePort
+	c.dualStack = bool(config.DualStack)
+	c.tproxy = config.TProxy
+	c.tun = config.Tun
+	c.tunMTU = int(config.TunMTU)
+	// remote may be absent if subscribed
+	if config.Remote != "" {
+		c.remote = remoteHost + ":" + remotePort
+	}
 
 	c.serviceName = config.ServiceName
 
-	c.compress = config.Compress
+	c.compress = strconv.FormatBool(bool(config.Compress))
+
+	c.sniffLimit = int(config.SniffLimit)
+	c.sniffTimeout = config.SniffTimeout.Or(time.Millisecond, 0)
+	c.sniffSkip = config.SniffSkipPorts
+	c.deferReply = common.BoolOr(config.DeferReply, true)
 
-	c.padding,_ = strconv.Atoi(config.Padding)
+	c.padding = int(config.Padding)
 	// load tls config
-	if config.TLS == "true" {
-		sni := config.TLSSNI
-		if sni == "" {
-			sni = remoteHost
-		}
-		var certpool *x509.CertPool
-		if config.TLSCA != "" {
-			if cafile, err := ioutil.ReadFile(config.TLSCA); err != nil {
-				return nil, fmt.Errorf("Common: Unable to load ca-file")
-			} else {
-				certpool = x509.NewCertPool()
-				if ok := certpool.AppendCertsFromPEM(cafile); !ok {
-					certpool = nil
-				}
-			}
+	if config.TLS {
+		var err error
+		c.tls, err = newTLS(remoteHost, config.TLSSNI, config.TLSCA, config.TLSPin, common.BoolOr(config.TLSVerify, true))
+		if err != nil {
+			return nil, err
 		}
-		c.tls = &tls.Config{
-			RootCAs:            certpool,
-			ServerName:         sni,
-			InsecureSkipVerify: config.TLSVerify == "false",
+		c.tlsPin = config.TLSPin
+		// shared links pin the ca
+		if c.tlsPin == "" && config.TLSCA != "" {
+			c.tlsPin, _ = common.PinFile(config.TLSCA)
 		}
 	}
 
 	// load strategy
 	c.strategyGroup = config.StrategyGroup
 
+	// load users, auth is required if not empty
+	c.users = config.Users
+
+	// load forwards, inbounds and reverse tunnels
+	c.forwards = config.Forwards
+	c.inboundList = config.Inbounds
+	c.reverses = config.Reverses
+
 	// load log level
 	c.logger = common.NewLogger(config.LogLevel)
 
 	// enable statistic
 	c.conns = common.NewConnector()
 	// enable network limit
-	uplimit, _ := strconv.Atoi(config.UpLimit)
-	downlimit, _ := strconv.Atoi(config.DownLimit)
-	c.stats = common.NewStatistician(uplimit*1024, downlimit*1024)
+	c.stats = common.NewStatistician(int(config.UpLimit)*1024, int(config.DownLimit)*1024)
+	// restore traffic of last run
+	c.statsFile = config.StatsFile
+	if c.statsFile != "" {
+		if up, down, err := common.LoadTraffic(c.statsFile); err == nil {
+			c.stats.Restore(up, down)
+		}
+		c.stats.StartRecord()
+	}
+
+	// in-flight sessions are closed after drain on shutdown
+	c.drain = config.Drain.Or(time.Second, DRAINTIMEOUT)
+	c.active = make(map[io.Closer]struct{})
+
+	// load subscription
+	if config.Subscribe != "" {
+		key, err := common.ParsePublicKey(config.SubscribeKey)
+		if err != nil {
+			return nil, fmt.Errorf("Subscribe: %v", err)
+		}
+		c.sub = &subscription{
+			url:      config.Subscribe,
+			key:      key,
+			interval: config.SubscribeInterval.Or(time.Second, SUBSCRIBEINTERVAL),
+			cache:    config.SubscribeCache,
+		}
+	}
+	c.resubscribe = make(chan struct{}, 1)
 	return c, nil
 }
 
 func (c *Client) Local() string {
+	c.configLock.RLock()
+	defer c.configLock.RUnlock()
 	return c.local
 }
 
 func (c *Client) Remote() string {
+	c.configLock.RLock()
+	defer c.configLock.RUnlock()
 	return c.remote
 }
 
 func (c *Client) SetLocal(local string) {
+	c.configLock.Lock()
+	defer c.configLock.Unlock()
 	c.local = local
 }
 
 func (c *Client) SetRemote(remote string) {
+	c.configLock.Lock()
+	defer c.configLock.Unlock()
 	c.remote = remote
 }
 
 func (c *Client) SetTLSSNI(sni string) {
-	c.tls = &tls.Config{
-		ServerName:         sni,
-		InsecureSkipVerify: false,
+	c.configLock.Lock()
+	defer c.configLock.Unlock()
+	if c.tls == nil {
+		c.tls = &tls.Config{}
+	} else {
+		// keep the ca and the pin
+		c.tls = c.tls.Clone()
 	}
+	c.tls.ServerName = sni
 }
 
 func (c *Client) SetCompress(b bool) {
+	c.configLock.Lock()
+	defer c.configLock.Unlock()
 	if b {
 		c.compress = "true"
 	} else {
@@ -129,10 +205,14 @@ func (c *Client) SetCompress(b bool) {
 }
 
 func (c *Client) GetServiceName() string {
+	c.configLock.RLock()
+	defer c.configLock.RUnlock()
 	return c.serviceName
 }
 
 func (c *Client) GetSummary() []string {
+	c.configLock.RLock()
+	defer c.configLock.RUnlock()
 	ss := make([]string, 0, 6)
 	ss = append(ss, fmt.Sprintf("service: %s", c.serviceName))
 	ss = append(ss, fmt.Sprintf("local_addr: %s", c.local))
@@ -140,6 +220,9 @@ func (c *Client) GetSummary() []string {
 	ss = append(ss, fmt.Sprintf("use_tls: %t", c.tls != nil))
 	ss = append(ss, fmt.Sprintf("tls_sni: %s", c.tls.ServerName))
 	ss = append(ss, fmt.Sprintf("compress: %s", c.compress))
+	if c.sub != nil {
+		ss = append(ss, fmt.Sprintf("subscribed: %d servers", len(c.pool)))
+	}
 	return ss
 }
 
@@ -155,50 +238,153 @@ func (c *Client) GetStatistician() *common.Statistician {
 	return c.stats
 }
 
-func (c *Client) Run() {
+// Run serves until stop is closed and returns nil then,
+// or the error which prevents it from serving
+func (c *Client) Run(stop <-chan struct{}) error {
 	// log info
 	c.logger.Infof("__boot__\n")
-	c.done = make(chan struct{}, 0)
-	lis, err := net.Listen("tcp", c.local)
-	if err != nil {
-		fmt.Printf("Client: Unable to bind %s, %v\n", c.local, err)
-		os.Exit(0)
+	var closers []io.Closer
+	for _, ib := range c.inbounds() {
+		cs, err := c.listen(ib, stop)
+		if err != nil {
+			for _, cl := range closers {
+				cl.Close()
+			}
+			return fmt.Errorf("Client: Unable to bind %s %s, %v", ib.Type, ib.Listen, err)
+		}
+		closers = append(closers, cs...)
+	}
+	for _, r := range c.getReverses() {
+		go c.serveReverse(r, stop)
+	}
+	go c.serveSubscription(stop)
+	<-stop
+	// log info
+	c.logger.Infof("request shutdown\n")
+	// release the addresses, so the client can be started again
+	for _, cl := range closers {
+		cl.Close()
 	}
+	c.drainSessions()
+	c.flushStats()
+	// log info
+	c.logger.Infof("__shutdown__\n")
+	return nil
+}
+
+func (c *Client) serveTProxy(lis net.Listener, ib *common.Inbound, done <-chan struct{}) {
 	defer lis.Close()
 	for {
 		select {
-		case <-c.done:
-			// log info
-			c.logger.Infof("__shutdown__\n")
+		case <-done:
 			return
 		default:
 			conn, err := lis.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			} else if err != nil {
+				// log err
+				c.logger.Errorf(fmt.Errorf("Client: Accept failed, %v\n", err))
+				continue
+			}
+			rawTCP, err := transport.NewRawTCPFromTProxy(conn)
 			if err != nil {
+				conn.Close()
+				continue
+			}
+			go func() {
+				defer conn.Close()
+				c.handle(rawTCP, ib)
+			}()
+		}
+	}
+}
+
+func (c *Client) serveTProxyUDP(udp *transport.TProxyUDP, ib *common.Inbound, done <-chan struct{}) {
+	defer udp.Close()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+			flow, err := udp.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			} else if err != nil {
 				// log err
 				c.logger.Errorf(fmt.Errorf("Client: Accept failed, %v\n", err))
 				continue
 			}
-			go c.deliver(conn)
+			go func() {
+				defer flow.Close()
+				c.handle(flow, ib)
+			}()
 		}
 	}
 }
 
-func (c *Client) Stop() {
-	defer func() {
-		recover()
-	}()
-	close(c.done)
-	// log info
-	c.logger.Infof("request shutdown\n")
+func (c *Client) serveTun(tun *transport.Tun, ib *common.Inbound, done <-chan struct{}) {
+	defer tun.Close()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+			in, err := tun.Accept()
+			if err != nil {
+				// log err
+				c.logger.Errorf(fmt.Errorf("Client: Accept failed, %v\n", err))
+				return
+			}
+			go func() {
+				defer in.Close()
+				c.handle(in, ib)
+			}()
+		}
+	}
+}
+
+func (c *Client) serve(lis net.Listener, ib *common.Inbound, done <-chan struct{}) {
+	defer lis.Close()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+			conn, err := lis.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			} else if err != nil {
+				// log err
+				c.logger.Errorf(fmt.Errorf("Client: Accept failed, %v\n", err))
+				continue
+			}
+			go c.deliver(conn, ib)
+		}
+	}
 }
 
 func (c *Client) CallMitsuyuProxy(md metadata.MD) (*transport.GRPCStreamClient, error) {
+	return c.callMitsuyuProxy("", md)
+}
+
+// an empty remote is the default one
+func (c *Client) callMitsuyuProxy(remote string, md metadata.MD) (*transport.GRPCStreamClient, error) {
+	return c.dial(remote, md, false)
+}
+
+func (c *Client) callMitsuyuReverse(remote string, md metadata.MD) (*transport.GRPCStreamClient, error) {
+	return c.dial(remote, md, true)
+}
+
+func (c *Client) callMitsuyu(ep *endpoint, md metadata.MD, reverse bool) (*transport.GRPCStreamClient, error) {
 	// log debug
 	c.logger.Debugf("Outbound: Dial gRPC\n")
 
+	remote, tlsConfig, serviceName, compress := ep.remote, ep.tls, ep.serviceName, ep.compress
 	var dialopts []grpc.DialOption
-	if c.tls != nil {
-		creds := credentials.NewTLS(c.tls)
+	if tlsConfig != nil {
+		creds := credentials.NewTLS(tlsConfig)
 		dialopts = append(dialopts, grpc.WithTransportCredentials(creds))
 	} else {
 		dialopts = append(dialopts, grpc.WithInsecure())
@@ -207,36 +393,67 @@ func (c *Client) CallMitsuyuProxy(md metadata.MD) (*transport.GRPCStreamClient,
 	// dial
 	ctxx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
-	grpcConn, err := grpc.DialContext(ctxx, c.remote, dialopts...)
+	grpcConn, err := grpc.DialContext(ctxx, remote, dialopts...)
 	if err != nil {
 		// log error
 		c.logger.Errorf(fmt.Errorf("Outbound: Dial gRPC timeout, %v\n", err))
 		return nil, err
 	}
-	cc := mitsuyu.NewMitsuyuClient(grpcConn, c.serviceName)
+	cc := mitsuyu.NewMitsuyuClient(grpcConn, serviceName)
 
+	if !reverse {
+		// ask for the status in the stream
+		md = md.Copy()
+		md.Set("status", "stream")
+	}
 	ctx := metadata.NewOutgoingContext(context.Background(), md)
 	// call grpc func
 	var callopts []grpc.CallOption
-	if c.compress == "true" {
+	if compress == "true" {
 		callopts = append(callopts, grpc.UseCompressor(gzip.Name))
 	}
 	// log debug
 	c.logger.Debugf("Outbound: Create stream\n")
-	stream, err := cc.Proxy(ctx, callopts...)
+	var stream mitsuyu.Mitsuyu_ProxyClient
+	if reverse {
+		stream, err = cc.Reverse(ctx, callopts...)
+	} else {
+		stream, err = cc.Proxy(ctx, callopts...)
+	}
 	if err != nil {
 		// log error
 		c.logger.Errorf(fmt.Errorf("Outbound: Failed to create stream, %v\n", err))
+		grpcConn.Close()
 		return nil, err
 	}
 	ccc := transport.NewGRPCStreamClient(grpcConn, stream)
+	if !reverse {
+		_, legacy := c.legacy.Load(remote)
+		ccc.AskStatus(legacy)
+	}
 	return ccc, nil
 }
 
-func (c *Client) deliver(conn net.Conn) {
+// deliver detects the protocol among those the inbound accepts
+func (c *Client) deliver(conn net.Conn, ib *common.Inbound) {
 	// log debug
 	c.logger.Debugf("Client: Select inbound protocol\n")
 	defer conn.Close()
+	// redirected connections may wait for the server to speak first,
+	// so check them before reading; transparent proxy is unable to auth
+	if (ib.Type == "mixed" || ib.Type == "redirect") && len(ib.Users) == 0 {
+		if rawTCP, err := transport.NewRawTCPFromRedirect(conn); err == nil &&
+			net.JoinHostPort(rawTCP.Addr().Host, rawTCP.Addr().Port) != conn.LocalAddr().String() {
+			c.handle(rawTCP, ib)
+			return
+		}
+	}
+	if ib.Type == "redirect" {
+		// log error
+		c.logger.Errorf(fmt.Errorf("Client: Not a redirected connection\n"))
+		return
+	}
+	mixed := ib.Type == "mixed" || ib.Type == "unix"
 	// log debug
 	c.logger.Debugf("Client: Read first package\n")
 	buf := make([]byte, 1024)
@@ -246,91 +463,143 @@ func (c *Client) deliver(conn net.Conn) {
 		c.logger.Errorf(fmt.Errorf("Client: Failed to read first package, %v\n", err))
 		return
 	}
-	if s5, err := transport.Socks5Handshake(buf[:n], conn); err == nil {
-		c.handle(s5)
-	} else if h, err := transport.HttpHandshake(buf[:n], conn); err == nil {
-		c.handle(h)
-	} else if rawTCP, err := transport.NewRawTCPFromRedirect(buf[:n], conn); err == nil &&
-		rawTCP.Addr().Host+":"+rawTCP.Addr().Port != c.local {
-		c.handle(rawTCP)
-	} else if rawTCP, err := transport.NewRawTCPWithSniff(buf[:n], conn); err == nil {
-		c.handle(rawTCP)
+	if (mixed || ib.Type == "socks5") && transport.IsSocks5(buf[:n]) {
+		if s5, err := transport.Socks5Handshake(buf[:n], conn, ib.Users); err == nil {
+			c.handle(s5, ib)
+		} else {
+			// log error
+			c.logger.Errorf(fmt.Errorf("Client: %v\n", err))
+		}
+	} else if mixed && transport.IsSocks4(buf[:n]) {
+		if s4, err := transport.Socks4Handshake(buf[:n], conn, ib.Users); err == nil {
+			c.handle(s4, ib)
+		} else {
+			// log error
+			c.logger.Errorf(fmt.Errorf("Client: %v\n", err))
+		}
+	} else if (mixed || ib.Type == "http") && transport.IsHttp(buf[:n]) {
+		if h, err := transport.HttpHandshake(buf[:n], conn, ib.Users); err == nil {
+			c.handleHttp(h, ib)
+		} else {
+			// log error
+			c.logger.Errorf(fmt.Errorf("Client: %v\n", err))
+		}
+	} else if ib.Type != "mixed" || len(ib.Users) != 0 {
+		// transparent proxy is unable to auth
+		// log error
+		c.logger.Errorf(fmt.Errorf("Client: Unknown protocol\n"))
+	} else if rawTCP, sniffed, err := transport.NewRawTCPWithSniff(buf[:n], conn, c.getSniffLimit()); err == nil {
+		c.logSniffed(sniffed)
+		c.handle(rawTCP, ib)
 	} else {
 		// log error
 		c.logger.Errorf(fmt.Errorf("Client: Unknown protocol\n"))
 	}
 }
 
-func (c *Client) handle(in transport.Inbound) {
-	if !in.Addr().Isdn {
-		transport.GetDomainName(in)
-	}
-	// statistic
-	c.conns.RecordOpen(in.Addr().Host)
-
-	md := metadata.New(map[string]string{
-		"xxhost": in.Addr().Host,
-		"port":   in.Addr().Port,
-		"isdn":   strconv.FormatBool(in.Addr().Isdn),
-		"dns":    "default",
-		"next":   "null",
-	})
+func (c *Client) logSniffed(sniffed *transport.Sniffed) {
 	// log debug
-	c.logger.Debugf("Inbound: Prepare metadata\n")
-	if allow := c.applyClientStrategy(in.Addr(), md); !allow {
-		c.logger.Infof(fmt.Sprintf("%-6s|%s:%s|blocked\n", in.Proto(), in.Addr().Host, in.Addr().Port))
-		return
-	}
+	c.logger.Debugf(fmt.Sprintf("Client: Sniffed %s %s, alpn=%s\n", sniffed.Proto, sniffed.Host, strings.Join(sniffed.ALPN, ",")))
+}
 
-	ccc, err := c.CallMitsuyuProxy(md)
+func (c *Client) handle(in transport.Inbound, ib *common.Inbound) {
+	deferred := awaitsReply(in) && c.getDeferReply()
+	if awaitsReply(in) && !deferred {
+		// nothing is sent to sniff until the reply
+		in.Reply(common.STATUS_OK, nil)
+	}
+	if !deferred && !in.Addr().Isdn && c.shouldSniff(in, ib) {
+		c.configLock.RLock()
+		limit, timeout := c.sniffLimit, c.sniffTimeout
+		c.configLock.RUnlock()
+		if sniffed := transport.GetDomainName(in, limit, timeout); sniffed != nil {
+			c.logSniffed(sniffed)
+		}
+	}
+	ccc, err := c.connect(in, ib)
 	if err != nil {
 		return
 	}
+	c.relay(in, ccc)
+}
+
+// relay pumps data between in and the stream, half-close is passed on
+// in both directions
+func (c *Client) relay(in transport.Inbound, ccc *transport.GRPCStreamClient) {
+	_, isUDP := in.(*transport.UDP)
+	defer c.track(in)()
+	padding := c.getPadding()
+	// statistic
+	c.conns.RecordOpen(in.Addr().Host)
+
 	stream := ccc.GetStream()
+	linger := transport.NewLinger(transport.HALFCLOSETIMEOUT, func() {
+		ccc.Close()
+		in.Close()
+	})
+	defer linger.Stop()
 	wg := new(sync.WaitGroup)
 	wg.Add(2)
 
-	c.logger.Infof(fmt.Sprintf("%-6s|%s:%s|dns=%s\n", in.Proto(), in.Addr().Host, in.Addr().Port, md.Get("dns")[0]))
 	// forward
 	go func() {
-		defer ccc.Close()
-		defer in.Close()
-		buf := make([]byte, BUFFERSIZE)
+		size := BUFFERSIZE
+		if isUDP {
+			size = UDPBUFFERSIZE
+		}
+		buf := make([]byte, size)
 		// log debug
 		c.logger.Debugf("Proxy: Start forward proxy\n")
 		for {
 			n, err := in.Read(buf)
+			if err == io.EOF {
+				// half-close, server will close the write side of outbound
+				stream.CloseSend()
+				linger.Start()
+				break
+			}
 			if err != nil {
+				ccc.Close()
+				in.Close()
 				break
 			}
-			padd := common.PaddingBytes(n,c.padding)
+			linger.Active()
+			padd := common.PaddingBytes(n, padding)
 			if err = stream.Send(&mitsuyu.Data{Data: buf[:n], Tail: padd}); err != nil {
+				ccc.Close()
+				in.Close()
 				break
 			}
 			// statistic uptraffic
 			c.stats.RecordUplink(n + len(padd))
 		}
-		if h, ok := in.(*transport.Http); ok && !h.IsTun() {
-			time.Sleep(4 * time.Second)
-		}
 		// log debug
 		c.logger.Debugf("Proxy: Finish forward proxy\n")
 		wg.Done()
 	}()
 	// reverse
 	go func() {
-		defer ccc.Close()
-		defer in.Close()
 		// statistic
 		var n = 0
 		// log debug
 		c.logger.Debugf("Proxy: Start reverse proxy\n")
 		for {
 			r, err := stream.Recv()
+			if err == io.EOF || (err == nil && transport.IsEOF(r)) {
+				// half-close, outbound has no more data
+				in.CloseWrite()
+				linger.Start()
+				break
+			}
 			if err != nil {
+				ccc.Close()
+				in.Close()
 				break
 			}
+			linger.Active()
 			if n, err = in.Write(r.GetData()); err != nil {
+				ccc.Close()
+				in.Close()
 				break
 			}
 			// statistic
@@ -341,13 +610,171 @@ func (c *Client) handle(in transport.Inbound) {
 		wg.Done()
 	}()
 	wg.Wait()
+	ccc.Close()
+	in.Close()
 	// statistic
 	c.conns.RecordClose(in.Addr().Host)
 	// log debug
 	c.logger.Debugf("Proxy: Done\n")
 }
 
-func (c *Client) applyClientStrategy(addr *common.Addr, md metadata.MD) (allow bool) {
+// handleHttp routes each request on a keep-alive connection independently
+func (c *Client) handleHttp(h *transport.Http, ib *common.Inbound) {
+	for {
+		if h.IsTun() {
+			c.handle(h, ib)
+			return
+		}
+		if keepAlive := c.relayHttp(h, ib); !keepAlive {
+			return
+		}
+		if err := h.Next(); err != nil {
+			if err != io.EOF {
+				// log debug
+				c.logger.Debugf(fmt.Sprintf("Proxy: Finish http session, %v\n", err))
+			}
+			return
+		}
+	}
+}
+
+func (c *Client) relayHttp(h *transport.Http, ib *common.Inbound) bool {
+	ccc, err := c.connect(h, ib)
+	if err != nil {
+		return false
+	}
+	defer ccc.Close()
+	defer c.track(h)()
+	// statistic
+	c.conns.RecordOpen(h.Addr().Host)
+	defer c.conns.RecordClose(h.Addr().Host)
+	t := &tunnel{GRPCStreamClient: ccc, padding: c.getPadding(), stats: c.stats}
+	keepAlive, err := h.RoundTrip(t)
+	if err != nil {
+		// log error
+		c.logger.Errorf(fmt.Errorf("Proxy: %v\n", err))
+		return false
+	}
+	return keepAlive
+}
+
+// connect applies strategy and opens a stream to the destination of in,
+// the outcome is replied to the application
+func (c *Client) connect(in transport.Inbound, ib *common.Inbound) (*transport.GRPCStreamClient, error) {
+	network := "tcp"
+	if _, ok := in.(*transport.UDP); ok {
+		network = "udp"
+	}
+	md := metadata.New(map[string]string{
+		"network": network,
+		"xxhost":  in.Addr().Host,
+		"port":    in.Addr().Port,
+		"isdn":    strconv.FormatBool(in.Addr().Isdn),
+		"dns":     "default",
+		"next":    "null",
+	})
+	// log debug
+	c.logger.Debugf("Inbound: Prepare metadata\n")
+	remote, strategyGroup := c.remoteOf(in, ib), c.strategyGroupOf(in, ib)
+	if allow := c.applyClientStrategy(strategyGroup, in.Addr(), md); !allow {
+		c.logger.Infof(fmt.Sprintf("%-6s|%s:%s|blocked\n", in.Proto(), in.Addr().Host, in.Addr().Port))
+		in.Reply(common.STATUS_NOT_ALLOWED, nil)
+		return nil, &common.StatusError{Status: common.STATUS_NOT_ALLOWED}
+	}
+
+	ccc, err := c.callMitsuyuProxy(remote, md)
+	if err != nil {
+		in.Reply(common.STATUS_FAILURE, nil)
+		return nil, err
+	}
+	status, bind := ccc.Status()
+	if ccc.Legacy() {
+		// not worth waiting for next time
+		c.legacy.Store(ccc.Target(), struct{}{})
+	}
+	if status != common.STATUS_OK {
+		c.logger.Infof(fmt.Sprintf("%-6s|%s:%s|%s\n", in.Proto(), in.Addr().Host, in.Addr().Port, status))
+		ccc.Close()
+		in.Reply(status, nil)
+		return nil, &common.StatusError{Status: status}
+	}
+	if err = in.Reply(status, bind); err != nil {
+		ccc.Close()
+		return nil, err
+	}
+	c.logger.Infof(fmt.Sprintf("%-6s|%s:%s|dns=%s\n", in.Proto(), in.Addr().Host, in.Addr().Port, md.Get("dns")[0]))
+	return ccc, nil
+}
+
+func userOf(in transport.Inbound) *common.User {
+	switch in := in.(type) {
+	case *transport.Socks5:
+		return in.User()
+	case *transport.Http:
+		return in.User()
+	}
+	return nil
+}
+
+// settings of the user override those of the inbound, which override
+// those of the client
+func (c *Client) remoteOf(in transport.Inbound, ib *common.Inbound) string {
+	if u := userOf(in); u != nil && u.Remote != "" {
+		return u.Remote
+	}
+	if ib.Remote != "" {
+		return ib.Remote
+	}
+	return ""
+}
+
+func (c *Client) strategyGroupOf(in transport.Inbound, ib *common.Inbound) []*common.Strategy {
+	if u := userOf(in); u != nil && u.StrategyGroup != nil {
+		return u.StrategyGroup
+	}
+	if ib.StrategyGroup != nil {
+		return ib.StrategyGroup
+	}
+	c.configLock.RLock()
+	defer c.configLock.RUnlock()
+	return c.strategyGroup
+}
+
+// shouldSniff is false for server-speaks-first protocols, which are
+// listed in sniff_skip_ports or matched by a rule with sniff=false
+func (c *Client) shouldSniff(in transport.Inbound, ib *common.Inbound) bool {
+	if ib.Type == "forward" {
+		// the destination is fixed
+		return false
+	}
+	addr := in.Addr()
+	c.configLock.RLock()
+	sniffSkip := c.sniffSkip
+	c.configLock.RUnlock()
+	if sniffSkip != "" && MatchPortRange(addr.Port, sniffSkip) {
+		return false
+	}
+	for _, rules := range c.strategyGroupOf(in, ib) {
+		if matchRules(addr, rules) {
+			return common.BoolOr(rules.Sniff, true)
+		}
+	}
+	return true
+}
+
+// awaitsReply reports whether the application sends nothing until the
+// reply, which tells the outcome of the dial unless defer_reply is false
+func awaitsReply(in transport.Inbound) bool {
+	switch in := in.(type) {
+	case *transport.Socks5, *transport.Socks4:
+		return true
+	case *transport.Http:
+		return in.IsTun()
+	}
+	return false
+}
+
+func (c *Client) applyClientStrategy(strategyGroup []*common.Strategy, addr *common.Addr, md metadata.MD) (allow bool) {
 	// log debug
 	c.logger.Debugf("Strategy: Match rules\n")
 
@@ -358,7 +785,7 @@ func (c *Client) applyClientStrategy(addr *common.Addr, md metadata.MD) (allow b
 	}
 	var matched = false
 	var index = 0
-	for i, rules := range c.strategyGroup {
+	for i, rules := range strategyGroup {
 		if matchRules(addr, rules) {
 			index = i
 			matched = true
@@ -368,15 +795,15 @@ func (c *Client) applyClientStrategy(addr *common.Addr, md metadata.MD) (allow b
 	if matched {
 		// log debug
 		c.logger.Debugf("Strategy: Apply rules\n")
-		if c.strategyGroup[index].Block == "true" {
+		if strategyGroup[index].Block {
 			return false
 		}
-		if dns := c.strategyGroup[index].DNS; dns != "" {
+		if dns := strategyGroup[index].DNS; dns != "" {
 			md.Set("dns", dns)
 		}
-		if next := c.strategyGroup[index].Next; next != "" {
+		if next := strategyGroup[index].Next; next != "" {
 			md.Set("next", next)
-			md.Set("next_service_name", c.serviceName)
+			md.Set("next_service_name", c.GetServiceName())
 		}
 	}
 	return true
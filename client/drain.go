@@ -0,0 +1,67 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"mitsuyu/common"
+	"time"
+)
+
+// track records an in-flight session until the returned func is called
+func (c *Client) track(in io.Closer) func() {
+	c.activeLock.Lock()
+	c.active[in] = struct{}{}
+	c.activeLock.Unlock()
+	return func() {
+		c.activeLock.Lock()
+		delete(c.active, in)
+		c.activeLock.Unlock()
+	}
+}
+
+func (c *Client) activeCount() int {
+	c.activeLock.Lock()
+	defer c.activeLock.Unlock()
+	return len(c.active)
+}
+
+// drainSessions waits for in-flight sessions to finish,
+// those still active after the drain period are closed
+func (c *Client) drainSessions() {
+	c.configLock.RLock()
+	deadline := time.Now().Add(c.drain)
+	c.configLock.RUnlock()
+	if n := c.activeCount(); n > 0 {
+		// log info
+		c.logger.Infof(fmt.Sprintf("Client: Drain %d sessions\n", n))
+	}
+	for c.activeCount() > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	c.activeLock.Lock()
+	defer c.activeLock.Unlock()
+	for in := range c.active {
+		in.Close()
+	}
+}
+
+// flushStats logs the traffic, and saves it if stats file is set;
+// nothing is counted while recording is off
+func (c *Client) flushStats() {
+	if !c.stats.Recording() {
+		return
+	}
+	up, down := c.stats.GetTraffic()
+	// log info
+	c.logger.Infof(fmt.Sprintf("Client: Traffic up %d down %d\n", up, down))
+	c.configLock.RLock()
+	statsFile := c.statsFile
+	c.configLock.RUnlock()
+	if statsFile == "" {
+		return
+	}
+	if err := common.SaveTraffic(statsFile, up, down); err != nil {
+		// log error
+		c.logger.Errorf(fmt.Errorf("Client: Unable to save traffic, %v\n", err))
+	}
+}
@@ -0,0 +1,104 @@
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"mitsuyu/common"
+	"mitsuyu/transport"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// endpoint is a server to dial with its settings
+type endpoint struct {
+	// label of a subscribed server
+	name        string
+	remote      string
+	tls         *tls.Config
+	serviceName string
+	compress    string
+	// from the subscription
+	pooled bool
+}
+
+// newTLS builds the tls config to reach host, the pin replaces
+// the verification against roots
+func newTLS(host, sni, ca, pin string, verify bool) (*tls.Config, error) {
+	if sni == "" {
+		sni = host
+	}
+	var certpool *x509.CertPool
+	if ca != "" {
+		if cafile, err := ioutil.ReadFile(ca); err != nil {
+			return nil, fmt.Errorf("Common: Unable to load ca-file")
+		} else {
+			certpool = x509.NewCertPool()
+			if ok := certpool.AppendCertsFromPEM(cafile); !ok {
+				certpool = nil
+			}
+		}
+	}
+	config := &tls.Config{
+		RootCAs:            certpool,
+		ServerName:         sni,
+		InsecureSkipVerify: !verify,
+	}
+	if pin != "" && verify {
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = common.VerifyPin(pin)
+	}
+	return config, nil
+}
+
+// endpointOf returns the settings to dial remote, which are those of the
+// client; an empty remote is the default, a subscribed server if any
+func (c *Client) endpointOf(remote string) *endpoint {
+	c.configLock.RLock()
+	defer c.configLock.RUnlock()
+	if remote == "" && len(c.pool) > 0 {
+		return c.pool[c.poolIndex%len(c.pool)]
+	}
+	if remote == "" {
+		remote = c.remote
+	}
+	return &endpoint{remote: remote, tls: c.tls, serviceName: c.serviceName, compress: c.compress}
+}
+
+// failover moves the default to the next subscribed server if ep failed,
+// and returns the next one
+func (c *Client) failover(ep *endpoint) *endpoint {
+	c.configLock.Lock()
+	defer c.configLock.Unlock()
+	if len(c.pool) < 2 {
+		return nil
+	}
+	// the pool may have been replaced meanwhile
+	if c.pool[c.poolIndex%len(c.pool)].remote == ep.remote {
+		c.poolIndex = (c.poolIndex + 1) % len(c.pool)
+	}
+	next := c.pool[c.poolIndex%len(c.pool)]
+	if next.remote == ep.remote {
+		return nil
+	}
+	return next
+}
+
+// dial calls the server at remote, a failed subscribed server
+// is retried once with the next one
+func (c *Client) dial(remote string, md metadata.MD, reverse bool) (*transport.GRPCStreamClient, error) {
+	ep := c.endpointOf(remote)
+	if ep.remote == "" {
+		return nil, fmt.Errorf("Outbound: No server, waiting for the subscription")
+	}
+	ccc, err := c.callMitsuyu(ep, md, reverse)
+	if err != nil && ep.pooled {
+		if next := c.failover(ep); next != nil {
+			// log info
+			c.logger.Infof(fmt.Sprintf("Outbound: %s failed, switch to %s\n", ep.name, next.name))
+			return c.callMitsuyu(next, md, reverse)
+		}
+	}
+	return ccc, err
+}
@@ -0,0 +1,119 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mitsuyu/common"
+	"mitsuyu/transport"
+	"net"
+	"os"
+)
+
+// inbounds returns the configured inbounds, together with those
+// from the local, tproxy, tun and forward settings
+func (c *Client) inbounds() []*common.Inbound {
+	c.configLock.RLock()
+	defer c.configLock.RUnlock()
+	var ibs []*common.Inbound
+	dualStack := common.Bool(c.dualStack)
+	if c.local != "" {
+		ibs = append(ibs, &common.Inbound{Type: "mixed", Listen: c.local, DualStack: dualStack, Users: c.users})
+	}
+	if c.tproxy != "" {
+		ibs = append(ibs, &common.Inbound{Type: "tproxy", Listen: c.tproxy})
+	}
+	if c.tun != "" {
+		ibs = append(ibs, &common.Inbound{Type: "tun", Listen: c.tun, MTU: common.Int(c.tunMTU)})
+	}
+	for _, f := range c.forwards {
+		ibs = append(ibs, &common.Inbound{
+			Type:          "forward",
+			Listen:        f.Local,
+			DualStack:     dualStack,
+			Dest:          f.Dest,
+			Remote:        f.Remote,
+			StrategyGroup: f.StrategyGroup,
+		})
+	}
+	return append(ibs, c.inboundList...)
+}
+
+// listen binds the inbound and serves it in background until done,
+// the returned closers stop serving
+func (c *Client) listen(ib *common.Inbound, done <-chan struct{}) ([]io.Closer, error) {
+	switch ib.Type {
+	case "tproxy":
+		lis, err := transport.ListenTProxy(ib.Listen)
+		if err != nil {
+			return nil, err
+		}
+		udp, err := transport.ListenTProxyUDP(ib.Listen)
+		if err != nil {
+			lis.Close()
+			return nil, err
+		}
+		go c.serveTProxy(lis, ib, done)
+		go c.serveTProxyUDP(udp, ib, done)
+		return []io.Closer{lis, udp}, nil
+	case "tun":
+		tun, err := transport.OpenTun(ib.Listen, int(ib.MTU))
+		if err != nil {
+			return nil, err
+		}
+		go c.serveTun(tun, ib, done)
+		return []io.Closer{tun}, nil
+	case "unix":
+		// remove the socket left by last run
+		if fi, err := os.Stat(ib.Listen); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(ib.Listen)
+		}
+		lis, err := net.Listen("unix", ib.Listen)
+		if err != nil {
+			return nil, err
+		}
+		go c.serve(lis, ib, done)
+		return []io.Closer{lis}, nil
+	default:
+		listeners, err := transport.ListenTCP(ib.Listen, bool(ib.DualStack))
+		if err != nil {
+			return nil, err
+		}
+		var closers []io.Closer
+		for _, lis := range listeners {
+			if ib.Type == "forward" {
+				go c.serveForward(lis, ib, done)
+			} else {
+				go c.serve(lis, ib, done)
+			}
+			closers = append(closers, lis)
+		}
+		return closers, nil
+	}
+}
+
+func (c *Client) serveForward(lis net.Listener, ib *common.Inbound, done <-chan struct{}) {
+	defer lis.Close()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+			conn, err := lis.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			} else if err != nil {
+				// log err
+				c.logger.Errorf(fmt.Errorf("Client: Accept failed, %v\n", err))
+				continue
+			}
+			// validated in New
+			addr, _ := common.ParseAddr(ib.Dest)
+			in := transport.NewRawTCPWithAddr("fwd", conn, addr)
+			go func() {
+				defer conn.Close()
+				c.handle(in, ib)
+			}()
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package client
+
+import (
+	"mitsuyu/common"
+	"net"
+)
+
+// ShareLink encodes the running settings as a share link, name labels it
+func (c *Client) ShareLink(name string) string {
+	c.configLock.RLock()
+	defer c.configLock.RUnlock()
+	conf := &common.ClientConfig{
+		Remote:      c.remote,
+		ServiceName: c.serviceName,
+		Compress:    common.Bool(c.compress == "true"),
+		Padding:     common.Int(c.padding),
+	}
+	if c.tls != nil {
+		conf.TLS = true
+		// the remote host is the default
+		if host, _, _ := net.SplitHostPort(c.remote); c.tls.ServerName != host {
+			conf.TLSSNI = c.tls.ServerName
+		}
+		conf.TLSPin = c.tlsPin
+		if c.tls.InsecureSkipVerify && c.tls.VerifyConnection == nil {
+			verify := common.Bool(false)
+			conf.TLSVerify = &verify
+		}
+	}
+	return common.EncodeLink(conf, name)
+}
@@ -0,0 +1,91 @@
+package client
+
+import (
+	"fmt"
+	"mitsuyu/common"
+	"reflect"
+)
+
+func (c *Client) getSniffLimit() int {
+	c.configLock.RLock()
+	defer c.configLock.RUnlock()
+	return c.sniffLimit
+}
+
+func (c *Client) getDeferReply() bool {
+	c.configLock.RLock()
+	defer c.configLock.RUnlock()
+	return c.deferReply
+}
+
+func (c *Client) getReverses() []*common.Reverse {
+	c.configLock.RLock()
+	defer c.configLock.RUnlock()
+	return c.reverses
+}
+
+func (c *Client) getPadding() int {
+	c.configLock.RLock()
+	defer c.configLock.RUnlock()
+	return c.padding
+}
+
+// Reload takes the settings of w, which is built from the new config;
+// sessions in flight keep going with the settings they started with.
+// It reports whether listeners changed, which requires a restart
+func (c *Client) Reload(w interface{}) (bool, error) {
+	n, ok := w.(*Client)
+	if !ok {
+		return false, fmt.Errorf("Client: Unable to reload from %T", w)
+	}
+	c.configLock.Lock()
+	defer c.configLock.Unlock()
+	c.remote = n.remote
+	c.tls = n.tls
+	c.tlsPin = n.tlsPin
+	c.compress = n.compress
+	c.padding = n.padding
+	c.serviceName = n.serviceName
+	c.strategyGroup = n.strategyGroup
+	c.sniffLimit = n.sniffLimit
+	c.sniffTimeout = n.sniffTimeout
+	c.sniffSkip = n.sniffSkip
+	c.deferReply = n.deferReply
+	c.drain = n.drain
+	c.statsFile = n.statsFile
+	// a new subscription starts over from its cache
+	if !reflect.DeepEqual(c.sub, n.sub) {
+		c.sub = n.sub
+		c.pool = nil
+		c.poolIndex = 0
+		c.poolUpdated = 0
+		select {
+		case c.resubscribe <- struct{}{}:
+		default:
+		}
+	}
+	c.logger.SetLevel(n.logger.GetLevel())
+	c.stats.SetLimit(n.stats.GetLimit())
+
+	restart := c.local != n.local ||
+		c.dualStack != n.dualStack ||
+		c.tproxy != n.tproxy ||
+		c.tun != n.tun ||
+		c.tunMTU != n.tunMTU ||
+		!reflect.DeepEqual(c.users, n.users) ||
+		!reflect.DeepEqual(c.forwards, n.forwards) ||
+		!reflect.DeepEqual(c.inboundList, n.inboundList) ||
+		!reflect.DeepEqual(c.reverses, n.reverses)
+	if restart {
+		c.local = n.local
+		c.dualStack = n.dualStack
+		c.tproxy = n.tproxy
+		c.tun = n.tun
+		c.tunMTU = n.tunMTU
+		c.users = n.users
+		c.forwards = n.forwards
+		c.inboundList = n.inboundList
+		c.reverses = n.reverses
+	}
+	return restart, nil
+}
@@ -0,0 +1,113 @@
+package client
+
+import (
+	"fmt"
+	"google.golang.org/grpc/metadata"
+	"mitsuyu/common"
+	"mitsuyu/transport"
+	"net"
+	"time"
+)
+
+// interval to register a reverse tunnel again after it is closed
+const REVERSERETRY = 5 * time.Second
+
+const DIALTIMEOUT = 10 * time.Second
+
+func (c *Client) serveReverse(r *common.Reverse, done <-chan struct{}) {
+	for {
+		err := c.listenReverse(r, done)
+		select {
+		case <-done:
+			return
+		default:
+		}
+		if err != nil {
+			// log err
+			c.logger.Errorf(fmt.Errorf("Reverse: Port %s, %v\n", r.Port, err))
+		}
+		select {
+		case <-done:
+			return
+		case <-time.After(REVERSERETRY):
+		}
+	}
+}
+
+// listenReverse asks the server to listen on the port, and handles
+// incoming connections until the control stream is closed, which
+// is done once done is closed so the server releases the port
+func (c *Client) listenReverse(r *common.Reverse, done <-chan struct{}) error {
+	ccc, err := c.callMitsuyuReverse(c.reverseRemote(r), metadata.Pairs("port", r.Port))
+	if err != nil {
+		return err
+	}
+	defer ccc.Close()
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-done:
+			ccc.Close()
+		case <-finished:
+		}
+	}()
+	status, bind := ccc.Status()
+	if status != common.STATUS_OK {
+		return &common.StatusError{Status: status}
+	}
+	if bind == nil {
+		return fmt.Errorf("no bind address from the server")
+	}
+	// log info
+	c.logger.Infof(fmt.Sprintf("%-6s|%s|listen\n", "rev", net.JoinHostPort(bind.Host, bind.Port)))
+	stream := ccc.GetStream()
+	for {
+		d, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		if id := transport.ConnID(d); id != "" {
+			go c.handleReverse(r, id)
+		}
+	}
+}
+
+// handleReverse dials the destination and claims the incoming connection
+// with a new stream, the server closes it if not claimed in time
+func (c *Client) handleReverse(r *common.Reverse, id string) {
+	conn, err := net.DialTimeout("tcp", r.Dest, DIALTIMEOUT)
+	if err != nil {
+		// log err
+		c.logger.Errorf(fmt.Errorf("Reverse: Unable to reach %s, %v\n", r.Dest, err))
+		return
+	}
+	defer conn.Close()
+	ccc, err := c.callMitsuyuReverse(c.reverseRemote(r), metadata.Pairs("conn", id))
+	if err != nil {
+		return
+	}
+	status, peer := ccc.Status()
+	if status != common.STATUS_OK {
+		ccc.Close()
+		return
+	}
+	if peer == nil {
+		ccc.Close()
+		// log err
+		c.logger.Errorf(fmt.Errorf("Reverse: No peer address from the server\n"))
+		return
+	}
+	// validated in New
+	addr, _ := common.ParseAddr(r.Dest)
+	// log info
+	c.logger.Infof(fmt.Sprintf("%-6s|%s:%s|peer=%s:%s\n", "rev", addr.Host, addr.Port, peer.Host, peer.Port))
+	c.relay(transport.NewRawTCPWithAddr("rev", conn, addr), ccc)
+}
+
+func (c *Client) reverseRemote(r *common.Reverse) string {
+	if r.Remote != "" {
+		return r.Remote
+	}
+	return ""
+}
@@ -52,7 +52,7 @@ func matchIPRange(ip, ipRange string) bool {
 	return false
 }
 
-func matchPortRange(port, portRange string) bool {
+func MatchPortRange(port, portRange string) bool {
 	portInt, _ := strconv.Atoi(port)
 	for _, ps := range splitRules(portRange, ",") {
 		if strings.Contains(ps, "-") {
@@ -100,7 +100,7 @@ func matchRules(addr *common.Addr, rules *common.Strategy) bool {
 	if !addr.Isdn && rules.IPRange != "" && matchIPRange(addr.Host, rules.IPRange) {
 		return true
 	}
-	if rules.PortRange != "" && matchPortRange(addr.Port, rules.PortRange) {
+	if rules.PortRange != "" && MatchPortRange(addr.Port, rules.PortRange) {
 		return true
 	}
 	if rules.DomainContain != "" && matchDomainContain(addr.Host, rules.DomainContain) {
@@ -0,0 +1,179 @@
+package client
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mitsuyu/common"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// default interval to fetch the list
+const SUBSCRIBEINTERVAL = time.Hour
+
+// interval to fetch again after a failure
+const SUBSCRIBERETRY = time.Minute
+
+const SUBSCRIBETIMEOUT = 30 * time.Second
+
+// lists larger than this are rejected
+const SUBSCRIBELIMIT = 1 << 20
+
+type subscription struct {
+	url      string
+	key      ed25519.PublicKey
+	interval time.Duration
+	// last good list, loaded on start
+	cache string
+}
+
+// serveSubscription keeps the pool up to date, from the cache first,
+// until done
+func (c *Client) serveSubscription(done <-chan struct{}) {
+	var loaded *subscription
+	for {
+		c.configLock.RLock()
+		sub := c.sub
+		c.configLock.RUnlock()
+		wait := SUBSCRIBERETRY
+		if sub != nil {
+			if loaded != sub && sub.cache != "" {
+				if err := c.loadCache(sub); err != nil && !os.IsNotExist(err) {
+					// log err
+					c.logger.Errorf(fmt.Errorf("Subscribe: Unable to load %s, %v\n", sub.cache, err))
+				}
+			}
+			loaded = sub
+			if err := c.subscribe(sub); err != nil {
+				// log err
+				c.logger.Errorf(fmt.Errorf("%v\n", err))
+			} else {
+				wait = sub.interval
+			}
+		} else {
+			wait = SUBSCRIBEINTERVAL
+		}
+		select {
+		case <-done:
+			return
+		case <-c.resubscribe:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// loadCache takes the last good list of sub
+func (c *Client) loadCache(sub *subscription) error {
+	content, err := ioutil.ReadFile(sub.cache)
+	if err != nil {
+		return err
+	}
+	list, err := common.VerifyList(content, sub.key)
+	if err != nil {
+		return err
+	}
+	_, err = c.applyList(sub, list)
+	return err
+}
+
+// subscribe fetches the list of sub and takes it if newer,
+// the cache is written once it is taken
+func (c *Client) subscribe(sub *subscription) error {
+	client := &http.Client{Timeout: SUBSCRIBETIMEOUT}
+	resp, err := client.Get(sub.url)
+	if err != nil {
+		return fmt.Errorf("Subscribe: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Subscribe: Unable to fetch %s, %s", sub.url, resp.Status)
+	}
+	content, err := ioutil.ReadAll(io.LimitReader(resp.Body, SUBSCRIBELIMIT+1))
+	if err != nil {
+		return fmt.Errorf("Subscribe: %v", err)
+	}
+	if len(content) > SUBSCRIBELIMIT {
+		return fmt.Errorf("Subscribe: List too large")
+	}
+	list, err := common.VerifyList(content, sub.key)
+	if err != nil {
+		return err
+	}
+	taken, err := c.applyList(sub, list)
+	if err != nil || !taken {
+		return err
+	}
+	if sub.cache != "" {
+		if err := writeCache(sub.cache, content); err != nil {
+			// log err
+			c.logger.Errorf(fmt.Errorf("Subscribe: Unable to write %s, %v\n", sub.cache, err))
+		}
+	}
+	return nil
+}
+
+// applyList replaces the pool by the servers of list, it reports false
+// if list is not newer than the pool or sub has been replaced by a reload
+func (c *Client) applyList(sub *subscription, list *common.ServerList) (bool, error) {
+	var pool []*endpoint
+	for _, link := range list.Servers {
+		conf, name, err := common.ParseLink(link)
+		if err != nil {
+			return false, err
+		}
+		ep := &endpoint{
+			name:        name,
+			remote:      conf.Remote,
+			serviceName: conf.ServiceName,
+			compress:    "false",
+			pooled:      true,
+		}
+		if name == "" {
+			ep.name = conf.Remote
+		}
+		if conf.Compress {
+			ep.compress = "true"
+		}
+		if conf.TLS {
+			host, _, _ := net.SplitHostPort(conf.Remote)
+			ep.tls, err = newTLS(host, conf.TLSSNI, "", conf.TLSPin, common.BoolOr(conf.TLSVerify, true))
+			if err != nil {
+				return false, err
+			}
+		}
+		pool = append(pool, ep)
+	}
+	c.configLock.Lock()
+	defer c.configLock.Unlock()
+	if c.sub != sub || list.Updated < c.poolUpdated || (list.Updated == c.poolUpdated && c.pool != nil) {
+		return false, nil
+	}
+	c.pool = pool
+	c.poolIndex = 0
+	c.poolUpdated = list.Updated
+	// log info
+	c.logger.Infof(fmt.Sprintf("Subscribe: %d servers, updated %s\n", len(pool), time.Unix(list.Updated, 0).Format(time.RFC3339)))
+	return true, nil
+}
+
+// writeCache replaces file with content, never leaving a partial list
+func writeCache(file string, content []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
@@ -0,0 +1,121 @@
+package client
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"io/ioutil"
+	"mitsuyu/common"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestApplyList(t *testing.T) {
+	sub := &subscription{}
+	list := func(updated int64, servers ...string) *common.ServerList {
+		return &common.ServerList{Updated: updated, Servers: servers}
+	}
+	tests := []struct {
+		name string
+		sub  *subscription
+		list *common.ServerList
+		// remotes of the pool after the list
+		taken bool
+		pool  string
+	}{
+		{"first", sub, list(100, "mitsuyu://a.example:443/#a"), true, "a.example:443"},
+		{"newer", sub, list(200, "mitsuyu://b.example:443/?tls=1", "mitsuyu://c.example:80/"), true, "b.example:443 c.example:80"},
+		{"rollback", sub, list(100, "mitsuyu://a.example:443/#a"), false, "b.example:443 c.example:80"},
+		{"same", sub, list(200, "mitsuyu://d.example:443/"), false, "b.example:443 c.example:80"},
+		{"replaced by a reload", &subscription{}, list(300, "mitsuyu://e.example:443/"), false, "b.example:443 c.example:80"},
+		{"invalid link", sub, list(400, "mitsuyu://f.example/"), false, "b.example:443 c.example:80"},
+	}
+	c := &Client{logger: common.NewLogger("none"), sub: sub}
+	for _, tt := range tests {
+		taken, err := c.applyList(tt.sub, tt.list)
+		if tt.name == "invalid link" {
+			if err == nil {
+				t.Errorf("%s: expect an error", tt.name)
+			}
+		} else if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		var remotes []string
+		for _, ep := range c.pool {
+			remotes = append(remotes, ep.remote)
+		}
+		if taken != tt.taken || strings.Join(remotes, " ") != tt.pool {
+			t.Errorf("%s: taken %v pool %v, expect %v %s", tt.name, taken, remotes, tt.taken, tt.pool)
+		}
+	}
+	if ep := c.pool[0]; !ep.pooled || ep.tls == nil || ep.name != "b.example:443" {
+		t.Errorf("endpoint %+v, expect a pooled tls endpoint named after the remote", ep)
+	}
+}
+
+// lists are taken and cached only if signed and newer
+func TestSubscribe(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherPriv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign := func(key ed25519.PrivateKey, updated int64, remote string) []byte {
+		b, err := common.SignList(&common.ServerList{Updated: updated, Servers: []string{"mitsuyu://" + remote + "/"}}, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	var lock sync.Mutex
+	var served []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		w.Write(served)
+	}))
+	defer srv.Close()
+	newer := sign(priv, 200, "b.example:443")
+	tests := []struct {
+		name   string
+		served []byte
+		err    bool
+		// remote of the pool and the cached list after the fetch
+		remote string
+		cached []byte
+	}{
+		{"first", sign(priv, 100, "a.example:443"), false, "a.example:443", sign(priv, 100, "a.example:443")},
+		{"newer", newer, false, "b.example:443", newer},
+		{"rollback", sign(priv, 100, "a.example:443"), false, "b.example:443", newer},
+		{"other key", sign(otherPriv, 300, "c.example:443"), true, "b.example:443", newer},
+		{"too large", bytes.Repeat([]byte(" "), SUBSCRIBELIMIT+1), true, "b.example:443", newer},
+	}
+	sub := &subscription{url: srv.URL, key: pub, cache: filepath.Join(t.TempDir(), "list.json")}
+	c := &Client{logger: common.NewLogger("none"), sub: sub}
+	for _, tt := range tests {
+		lock.Lock()
+		served = tt.served
+		lock.Unlock()
+		err := c.subscribe(sub)
+		if tt.err != (err != nil) {
+			t.Errorf("%s: error %v, expect an error %v", tt.name, err, tt.err)
+		}
+		if len(c.pool) != 1 || c.pool[0].remote != tt.remote {
+			t.Errorf("%s: pool %v, expect %s", tt.name, c.pool, tt.remote)
+		}
+		if cached, _ := ioutil.ReadFile(sub.cache); !bytes.Equal(cached, tt.cached) {
+			t.Errorf("%s: cached %s, expect %s", tt.name, cached, tt.cached)
+		}
+	}
+	// the cache is taken on start
+	c = &Client{logger: common.NewLogger("none"), sub: sub}
+	if err = c.loadCache(sub); err != nil || len(c.pool) != 1 || c.pool[0].remote != "b.example:443" {
+		t.Errorf("loadCache: pool %v %v, expect b.example:443", c.pool, err)
+	}
+}
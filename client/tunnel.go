@@ -0,0 +1,39 @@
+package client
+
+import (
+	"mitsuyu/common"
+	"mitsuyu/mitsuyu"
+	"mitsuyu/transport"
+)
+
+// tunnel pads and records the traffic of a grpc stream
+type tunnel struct {
+	*transport.GRPCStreamClient
+	padding int
+	stats   *common.Statistician
+}
+
+func (t *tunnel) Read(b []byte) (int, error) {
+	n, err := t.GRPCStreamClient.Read(b)
+	// statistic
+	t.stats.RecordDownlink(n)
+	return n, err
+}
+
+func (t *tunnel) Write(b []byte) (int, error) {
+	stream := t.GetStream()
+	for sent := 0; sent < len(b); {
+		n := len(b) - sent
+		if n > BUFFERSIZE {
+			n = BUFFERSIZE
+		}
+		padd := common.PaddingBytes(n, t.padding)
+		if err := stream.Send(&mitsuyu.Data{Data: b[sent : sent+n], Tail: padd}); err != nil {
+			return sent, err
+		}
+		// statistic
+		t.stats.RecordUplink(n + len(padd))
+		sent += n
+	}
+	return len(b), nil
+}
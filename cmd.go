@@ -0,0 +1,272 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"mitsuyu/common"
+	"mitsuyu/manager"
+	"os"
+	"sort"
+	"strings"
+)
+
+// the samples document the flags of fields
+var (
+	//go:embed client.json
+	clientSample []byte
+	//go:embed server.json
+	serverSample []byte
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) int
+}
+
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{"server", "run a server, or the workers of a combined config", func(args []string) int {
+			return runKind("server", args)
+		}},
+		{"client", "run a client, or the workers of a combined config", func(args []string) int {
+			return runKind("client", args)
+		}},
+		{"terminal", "run a client with the terminal", func(args []string) int {
+			return runKind("terminal", args)
+		}},
+		{"check", "validate the config and exit, check [server|client] [flags]", runCheck},
+		{"genconf", "generate a CA, a server certificate and matching configs", runGenconf},
+		{"link", "export a client config as a mitsuyu:// link or import one, link export|import", runLink},
+		{"subscribe", "sign server lists for subscribed clients, subscribe keygen|sign|verify", runSubscribe},
+		{"version", "show version", func(args []string) int {
+			fmt.Println(VERSION)
+			return 0
+		}},
+		{"help", "show flags of a command, help [command]", runHelp},
+	}
+}
+
+func findCommand(name string) *command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+func printUsage() {
+	fmt.Println("usage: mitsuyu <command> [flags]")
+	fmt.Println()
+	for _, cmd := range commands {
+		fmt.Printf("  %-10s %s\n", cmd.name, cmd.usage)
+	}
+	fmt.Println()
+	fmt.Println("values are read from the config file, then MITSUYU_* environment, then flags")
+}
+
+// options are the flags of server, client, terminal and check
+type options struct {
+	kind   string
+	config string
+	api    string
+	token  string
+	color  string
+	flags  *common.Flags
+}
+
+func newFlagSet(kind string) (*flag.FlagSet, *options) {
+	o := &options{kind: kind}
+	fs := flag.NewFlagSet(kind, flag.ExitOnError)
+	fs.StringVar(&o.config, "c", "", "config file, json/yaml/toml by extension")
+	if kind == "server" {
+		o.flags = common.NewFlags(fs, &common.ServerConfig{}, sampleUsage(serverSample))
+	} else {
+		fs.StringVar(&o.api, "api", "", "local api addr")
+		fs.StringVar(&o.token, "token", "", "local api token, reload and link are served only with a token")
+		if kind == "terminal" {
+			fs.StringVar(&o.color, "color", "black", "terminal background color")
+		}
+		o.flags = common.NewFlags(fs, &common.ClientConfig{}, sampleUsage(clientSample))
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: mitsuyu %s [flags]\n\n", kind)
+		fs.PrintDefaults()
+	}
+	return fs, o
+}
+
+// sampleUsage documents each field by its value in the sample config
+func sampleUsage(sample []byte) map[string]string {
+	var fields map[string]interface{}
+	json.Unmarshal(sample, &fields)
+	usage := make(map[string]string)
+	for k, v := range fields {
+		switch v := v.(type) {
+		case string:
+			usage[k] = v
+		case []interface{}:
+			var keys []string
+			if len(v) > 0 {
+				e, _ := v[0].(map[string]interface{})
+				for key := range e {
+					keys = append(keys, key)
+				}
+			}
+			sort.Strings(keys)
+			usage[k] = "repeatable, replaces the list of the config file, " +
+				"key=value pairs separated by comma or a json object of " + strings.Join(keys, "/")
+		}
+	}
+	return usage
+}
+
+func runKind(kind string, args []string) int {
+	fs, o := newFlagSet(kind)
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fmt.Printf("unexpected argument %s\n\n", fs.Arg(0))
+		fs.Usage()
+		return 2
+	}
+	return runWorkers(o)
+}
+
+// runCheck validates a combined config, or a single one of the kind
+// with the flags, the kind defaults to client
+func runCheck(args []string) int {
+	kind := "client"
+	if len(args) > 0 && (args[0] == "server" || args[0] == "client") {
+		kind, args = args[0], args[1:]
+	}
+	fs, o := newFlagSet(kind)
+	fs.Parse(args)
+	if err := loadConfig(manager.NewManager(), o); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	fmt.Println("config ok")
+	return 0
+}
+
+func runHelp(args []string) int {
+	if len(args) == 0 {
+		printUsage()
+		return 0
+	}
+	switch args[0] {
+	case "server", "client", "terminal":
+		fs, _ := newFlagSet(args[0])
+		fs.SetOutput(os.Stdout)
+		fs.Usage()
+	case "genconf":
+		fs, _ := newGenconfFlagSet()
+		fs.SetOutput(os.Stdout)
+		fs.Usage()
+	case "link":
+		printLinkUsage()
+	case "subscribe":
+		printSubscribeUsage()
+	case "check":
+		fmt.Println("usage: mitsuyu check [server|client] [flags]")
+		fmt.Println()
+		fmt.Println("flags are those of server or client, see mitsuyu help server")
+	default:
+		cmd := findCommand(args[0])
+		if cmd == nil {
+			fmt.Printf("unknown command %s\n", args[0])
+			return 2
+		}
+		fmt.Printf("usage: mitsuyu %s\n\n%s\n", cmd.name, cmd.usage)
+	}
+	return 0
+}
+
+// legacyArgs converts the flags of older versions,
+// e.g. -m client -c c.json, to a command, keeping their defaults
+func legacyArgs(args []string) []string {
+	if len(args) == 0 || !strings.HasPrefix(args[0], "-") {
+		return args
+	}
+	kind, check := "", false
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		name, value, hasValue := splitFlag(args[i])
+		switch name {
+		case "h", "help":
+			return []string{"help"}
+		case "v":
+			return []string{"version"}
+		case "check":
+			check = true
+		case "m":
+			if !hasValue && i+1 < len(args) {
+				i++
+				value = args[i]
+			}
+			kind = value
+		default:
+			rest = append(rest, args[i])
+		}
+	}
+	switch kind {
+	case "client_terminal":
+		kind = "terminal"
+	case "":
+		kind = "client"
+	}
+	renamed := map[string]string{"sname": "service-name", "l": "local", "r": "remote", "tls-verify-ca": "tls-ca"}
+	if kind == "server" {
+		renamed["l"] = "listen"
+	}
+	given := make(map[string]bool)
+	for i, a := range rest {
+		name, value, hasValue := splitFlag(a)
+		if to, ok := renamed[name]; ok {
+			name, rest[i] = to, "-"+to
+			if hasValue {
+				rest[i] += "=" + value
+			}
+		}
+		given[name] = true
+	}
+	// without a config file, the server took cert.pem and key.pem
+	// and the client did not verify unless asked
+	if !given["c"] {
+		defaults := [][2]string{{"tls-verify", "false"}}
+		if kind == "server" {
+			defaults = [][2]string{{"tls-cert", "cert.pem"}, {"tls-key", "key.pem"}}
+		}
+		var injected []string
+		for _, d := range defaults {
+			if !given[d[0]] {
+				injected = append(injected, "-"+d[0]+"="+d[1])
+			}
+		}
+		rest = append(injected, rest...)
+	}
+	if check {
+		if kind == "terminal" {
+			kind = "client"
+		}
+		return append([]string{"check", kind}, rest...)
+	}
+	return append([]string{kind}, rest...)
+}
+
+// splitFlag splits -name=value, name is empty if a is not a flag
+func splitFlag(a string) (string, string, bool) {
+	if !strings.HasPrefix(a, "-") {
+		return "", "", false
+	}
+	a = strings.TrimLeft(a, "-")
+	if i := strings.IndexByte(a, '='); i >= 0 {
+		return a[:i], a[i+1:], true
+	}
+	return a, "", false
+}
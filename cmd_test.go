@@ -0,0 +1,91 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLegacyArgs(t *testing.T) {
+	tests := []struct {
+		args string
+		want string
+	}{
+		// commands are left as they are
+		{"client -c c.json", "client -c c.json"},
+		{"server -listen :443", "server -listen :443"},
+		{"", ""},
+		{"-m server -l :1 -c s.json", "server -listen :1 -c s.json"},
+		{"-m=server -l=:1 -c=s.json", "server -listen=:1 -c=s.json"},
+		{"-m client -l :1080 -r example.com:443 -sname svc -c c.json", "client -local :1080 -remote example.com:443 -service-name svc -c c.json"},
+		// the client did not verify without a config file
+		{"-m client -l :1080 -r example.com:443 -tls", "client -tls-verify=false -local :1080 -remote example.com:443 -tls"},
+		{"-l :1080 -r example.com:443", "client -tls-verify=false -local :1080 -remote example.com:443"},
+		{"-m client -r example.com:443 -tls -tls-verify -tls-verify-ca ca.pem", "client -remote example.com:443 -tls -tls-verify -tls-ca ca.pem"},
+		// the server took cert.pem and key.pem without a config file
+		{"-m server -l :443 -tls", "server -tls-cert=cert.pem -tls-key=key.pem -listen :443 -tls"},
+		{"-m server -l :443 -tls -tls-cert c.pem", "server -tls-key=key.pem -listen :443 -tls -tls-cert c.pem"},
+		{"-m server -c s.json -tls", "server -c s.json -tls"},
+		{"-m client_terminal -c c.json -color white", "terminal -c c.json -color white"},
+		{"-m client -c c.json -api :8080 -token secret", "client -c c.json -api :8080 -token secret"},
+		{"-check -m server -c s.json", "check server -c s.json"},
+		{"-c c.json -check", "check client -c c.json"},
+		{"-m client_terminal -c c.json -check", "check client -c c.json"},
+		{"-v", "version"},
+		{"-m server -v", "version"},
+		{"-h", "help"},
+		{"--help", "help"},
+	}
+	for _, tt := range tests {
+		got := legacyArgs(strings.Fields(tt.args))
+		if want := strings.Fields(tt.want); !reflect.DeepEqual(got, want) && len(got)+len(want) > 0 {
+			t.Errorf("legacyArgs(%s) = %q, expect %q", tt.args, got, want)
+		}
+	}
+}
+
+// every flag of older versions is known to the command it maps to
+func TestLegacyArgsParse(t *testing.T) {
+	for _, args := range []string{
+		"-m server -l :443 -sname svc -tls -tls-cert c.pem -tls-key k.pem",
+		"-m server -c s.json",
+		"-m client -l :1080 -r example.com:443 -sname svc -tls -tls-sni example.com -tls-verify -tls-verify-ca ca.pem -compress -api :8080 -token secret",
+		"-m client_terminal -l :1080 -r example.com:443 -color white",
+		"-l :1080 -r example.com:443 -c c.json",
+		"-check -m server -l :443",
+	} {
+		converted := legacyArgs(strings.Fields(args))
+		kind, rest := converted[0], converted[1:]
+		if kind == "check" {
+			kind, rest = rest[0], rest[1:]
+		}
+		fs, _ := newFlagSet(kind)
+		fs.Init(kind, flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		if err := fs.Parse(rest); err != nil || fs.NArg() > 0 {
+			t.Errorf("%s: %q does not parse, %v %q", args, converted, err, fs.Args())
+		}
+	}
+}
+
+func TestSplitFlag(t *testing.T) {
+	tests := []struct {
+		a, name, value string
+		hasValue       bool
+	}{
+		{"-c", "c", "", false},
+		{"--tls", "tls", "", false},
+		{"-l=:1080", "l", ":1080", true},
+		{"-tls-verify=false", "tls-verify", "false", true},
+		{"-token=", "token", "", true},
+		{":1080", "", "", false},
+	}
+	for _, tt := range tests {
+		name, value, hasValue := splitFlag(tt.a)
+		if name != tt.name || value != tt.value || hasValue != tt.hasValue {
+			t.Errorf("splitFlag(%s) = %s, %s, %v, expect %s, %s, %v", tt.a, name, value, hasValue, tt.name, tt.value, tt.hasValue)
+		}
+	}
+}
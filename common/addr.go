@@ -0,0 +1,14 @@
+package common
+
+import (
+	"net"
+)
+
+func ParseAddr(hostport string) (*Addr, error) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+	isdn := net.ParseIP(host) == nil
+	return &Addr{Isdn: isdn, Host: host, Port: port}, nil
+}
@@ -1,22 +1,238 @@
 package common
 
 import (
+	"bytes"
 	"encoding/json"
-	"io/ioutil"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
 )
 
-func LoadServerConfig(file string, v *ServerConfig) error {
-	content, err := ioutil.ReadFile(file)
+// CONFIGVERSION is the latest config schema, configs without
+// a version are read as the first one
+const CONFIGVERSION = 1
+
+// FieldError is an invalid value at path, e.g. inbounds[0].listen
+type FieldError struct {
+	Path string
+	Err  error
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Path, e.Err)
+}
+
+func fieldErrorf(path, format string, a ...interface{}) error {
+	return &FieldError{Path: path, Err: fmt.Errorf(format, a...)}
+}
+
+// ConfigError locates an error in the config file
+type ConfigError struct {
+	File   string
+	Line   int
+	Column int
+	Err    error
+}
+
+func (e *ConfigError) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("%s: %v", e.File, e.Err)
+	}
+	return fmt.Sprintf("%s:%d:%d: %v", e.File, e.Line, e.Column, e.Err)
+}
+
+// LoadServerConfig loads the file, flags override it, either may be absent
+func LoadServerConfig(file string, v *ServerConfig, flags *Flags) error {
+	return loadConfig(file, v, v.Validate, flags)
+}
+
+func LoadClientConfig(file string, v *ClientConfig, flags *Flags) error {
+	return loadConfig(file, v, v.Validate, flags)
+}
+
+func LoadConfig(file string, v *Config) error {
+	return loadConfig(file, v, v.Validate, nil)
+}
+
+// IsCombinedConfig reports whether the file describes several workers
+func IsCombinedConfig(file string) (bool, error) {
+	if file == "" {
+		return false, nil
+	}
+	root, err := readSource(file, nil)
+	if err != nil {
+		return false, err
+	}
+	_, ok := root.fields["workers"]
+	return ok, nil
+}
+
+// loadConfig reads json, yaml or toml by the extension, merges includes and
+// applies environment and flag overrides, then rejects unknown fields and
+// invalid values, errors are located by file, line and column
+func loadConfig(file string, v interface{}, validate func() error, flags *Flags) error {
+	root := newObject(position{File: "flags"})
+	if file != "" {
+		var err error
+		if root, err = readSource(file, nil); err != nil {
+			return err
+		}
+	} else {
+		file = "flags"
+	}
+	err := applyEnv(root, reflect.TypeOf(v), os.Environ())
+	if err != nil {
+		return err
+	}
+	flags.apply(root)
+	positions := make(map[string]position)
+	root.positions("", positions)
+	content, err := json.Marshal(root.plain())
+	if err != nil {
+		return &ConfigError{File: file, Err: err}
+	}
+	s := &scanner{dec: json.NewDecoder(bytes.NewReader(content))}
+	if err = s.scan("", reflect.TypeOf(v)); err != nil {
+		return locate(file, positions, err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(content))
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(v); err != nil {
+		return locate(file, positions, err)
+	}
+	if err = validate(); err != nil {
+		return locate(file, positions, err)
+	}
+	return nil
+}
+
+// locate finds where the path of err is defined, which may be an included
+// file or the environment
+func locate(file string, positions map[string]position, err error) error {
+	if e, ok := err.(*FieldError); ok {
+		// fall back to the parent if the field is absent
+		for path := e.Path; path != ""; path = parentPath(path) {
+			if pos, ok := positions[path]; ok {
+				return &ConfigError{File: pos.File, Line: pos.Line, Column: pos.Column, Err: err}
+			}
+		}
+	}
+	return &ConfigError{File: file, Err: err}
+}
+
+func parentPath(path string) string {
+	i := strings.LastIndexAny(path, ".[")
+	if i < 0 {
+		return ""
+	}
+	return path[:i]
+}
+
+// scanner walks the tokens along with the type of config,
+// it reports unknown fields and invalid values by path
+type scanner struct {
+	dec *json.Decoder
+}
+
+var unmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+func (s *scanner) scan(path string, t reflect.Type) error {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if reflect.PtrTo(t).Implements(unmarshalerType) {
+		var raw json.RawMessage
+		if err := s.dec.Decode(&raw); err != nil {
+			return err
+		}
+		if err := reflect.New(t).Interface().(json.Unmarshaler).UnmarshalJSON(raw); err != nil {
+			return &FieldError{Path: path, Err: err}
+		}
+		return nil
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		return s.scanObject(path, t)
+	case reflect.Slice:
+		return s.scanArray(path, t)
+	}
+	var raw json.RawMessage
+	if err := s.dec.Decode(&raw); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(raw, reflect.New(t).Interface()); err != nil {
+		if e, ok := err.(*json.UnmarshalTypeError); ok {
+			return fieldErrorf(path, "expect %v, got %s", t, e.Value)
+		}
+		return &FieldError{Path: path, Err: err}
+	}
+	return nil
+}
+
+func (s *scanner) scanObject(path string, t reflect.Type) error {
+	tok, err := s.dec.Token()
 	if err != nil {
 		return err
 	}
-	return json.Unmarshal(content, v)
+	if tok == nil {
+		return nil
+	}
+	if tok != json.Delim('{') {
+		return fieldErrorf(path, "expect an object")
+	}
+	for s.dec.More() {
+		tok, err = s.dec.Token()
+		if err != nil {
+			return err
+		}
+		key, _ := tok.(string)
+		sub := key
+		if path != "" {
+			sub = path + "." + key
+		}
+		field, ok := fieldByTag(t, key)
+		if !ok {
+			return fieldErrorf(sub, "unknown field %s", strconv.Quote(key))
+		}
+		if err = s.scan(sub, field.Type); err != nil {
+			return err
+		}
+	}
+	// '}'
+	_, err = s.dec.Token()
+	return err
 }
 
-func LoadClientConfig(file string, v *ClientConfig) error {
-	content, err := ioutil.ReadFile(file)
+func (s *scanner) scanArray(path string, t reflect.Type) error {
+	tok, err := s.dec.Token()
 	if err != nil {
 		return err
 	}
-	return json.Unmarshal(content, v)
+	if tok == nil {
+		return nil
+	}
+	if tok != json.Delim('[') {
+		return fieldErrorf(path, "expect an array")
+	}
+	for i := 0; s.dec.More(); i++ {
+		sub := fmt.Sprintf("%s[%d]", path, i)
+		if err = s.scan(sub, t.Elem()); err != nil {
+			return err
+		}
+	}
+	// ']'
+	_, err = s.dec.Token()
+	return err
+}
+
+func fieldByTag(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if name := strings.Split(f.Tag.Get("json"), ",")[0]; name == key {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
 }
@@ -0,0 +1,248 @@
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeConfig writes content to name in dir and returns the path
+func writeConfig(t *testing.T, dir, name, content string) string {
+	file := filepath.Join(dir, name)
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// fieldPath returns the path of the FieldError in the ConfigError
+func fieldPath(err error) (*ConfigError, string) {
+	ce, ok := err.(*ConfigError)
+	if !ok {
+		return nil, ""
+	}
+	if fe, ok := ce.Err.(*FieldError); ok {
+		return ce, fe.Path
+	}
+	return ce, ""
+}
+
+// the string form of old configs reads as the typed one
+func TestLoadClientConfigLegacy(t *testing.T) {
+	dir := t.TempDir()
+	typed := writeConfig(t, dir, "typed.json", `{
+  "version": 1,
+  "local": "127.0.0.1:1080",
+  "remote": "example.com:443",
+  "tls": true,
+  "tls_verify": false,
+  "sniff_limit": 1000,
+  "sniff_timeout": "300ms",
+  "drain": 5,
+  "inbounds": [{"type": "http", "listen": ":8080", "dual_stack": true, "users": [{"user": "al"}]}]
+}`)
+	legacy := writeConfig(t, dir, "legacy.json", `{
+  "local": "127.0.0.1:1080",
+  "remote": "example.com:443",
+  "tls": "true",
+  "tls_verify": "false",
+  "sniff_limit": "1000",
+  "sniff_timeout": "300",
+  "drain": "5",
+  "inbounds": [{"type": "http", "listen": ":8080", "dual_stack": "true", "users": [{"user": "al"}]}]
+}`)
+	for _, file := range []string{typed, legacy} {
+		var c ClientConfig
+		if err := LoadClientConfig(file, &c, nil); err != nil {
+			t.Errorf("%s: %v", file, err)
+			continue
+		}
+		name := filepath.Base(file)
+		if !bool(c.TLS) || BoolOr(c.TLSVerify, true) || c.SniffLimit != 1000 {
+			t.Errorf("%s: tls %v, tls_verify %v, sniff_limit %d", name, c.TLS, BoolOr(c.TLSVerify, true), c.SniffLimit)
+		}
+		if d := c.SniffTimeout.Or(time.Millisecond, 0); d != 300*time.Millisecond {
+			t.Errorf("%s: sniff_timeout %v, expect 300ms", name, d)
+		}
+		if d := c.Drain.Or(time.Second, 0); d != 5*time.Second {
+			t.Errorf("%s: drain %v, expect 5s", name, d)
+		}
+		if len(c.Inbounds) != 1 || !bool(c.Inbounds[0].DualStack) || c.Inbounds[0].Users[0].Username != "al" {
+			t.Errorf("%s: inbounds %+v", name, c.Inbounds)
+		}
+	}
+}
+
+func TestLoadClientConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		// path of the FieldError, empty if not a FieldError
+		path   string
+		line   int
+		column int
+	}{
+		{
+			name:    "unknown field",
+			content: "{\n  \"local\": \":1080\",\n  \"remot\": \"example.com:443\"\n}",
+			path:    "remot",
+			line:    3, column: 3,
+		},
+		{
+			name:    "unknown nested field",
+			content: "{\n  \"remote\": \"example.com:443\",\n  \"inbounds\": [\n    {\"type\": \"http\", \"listn\": \":8080\"}\n  ]\n}",
+			path:    "inbounds[0].listn",
+			line:    4, column: 22,
+		},
+		{
+			name:    "unknown strategy field",
+			content: "{\"local\": \":1080\", \"remote\": \"example.com:443\",\n\"strategy\": [{\"dns\": \"8.8.8.8:53\"}, {\"blok\": true}]}",
+			path:    "strategy[1].blok",
+			line:    2, column: 38,
+		},
+		{
+			name:    "invalid integer",
+			content: "{\n  \"local\": \":1080\",\n  \"remote\": \"example.com:443\",\n  \"sniff_limit\": \"many\"\n}",
+			path:    "sniff_limit",
+			line:    4, column: 3,
+		},
+		{
+			name:    "invalid boolean",
+			content: "{\n  \"local\": \":1080\",\n  \"remote\": \"example.com:443\",\n  \"tls\": 1\n}",
+			path:    "tls",
+			line:    4, column: 3,
+		},
+		{
+			name:    "wrong type",
+			content: "{\n  \"local\": 1080,\n  \"remote\": \"example.com:443\"\n}",
+			path:    "local",
+			line:    2, column: 3,
+		},
+		{
+			name:    "not an array",
+			content: "{\n  \"local\": \":1080\",\n  \"remote\": \"example.com:443\",\n  \"inbounds\": {}\n}",
+			path:    "inbounds",
+			line:    4, column: 3,
+		},
+		{
+			name:    "invalid value",
+			content: "{\n  \"local\": \":1080\",\n  \"remote\": \"example.com:443\",\n  \"tun_mtu\": 100\n}",
+			path:    "tun_mtu",
+			line:    4, column: 3,
+		},
+		{
+			// located at the element
+			name:    "absent field",
+			content: "{\n  \"remote\": \"example.com:443\",\n  \"inbounds\": [\n    {\"type\": \"http\"}\n  ]\n}",
+			path:    "inbounds[0].listen",
+			line:    4, column: 5,
+		},
+		{
+			// not located
+			name:    "absent top field",
+			content: "{\n  \"local\": \":1080\"\n}",
+			path:    "remote",
+		},
+		{
+			name:    "unsupported version",
+			content: "{\n  \"version\": 2,\n  \"local\": \":1080\",\n  \"remote\": \"example.com:443\"\n}",
+			path:    "version",
+			line:    2, column: 3,
+		},
+		{
+			name:    "syntax error",
+			content: "{\n  \"local\": \":1080\",\n  \"remote\" \"example.com:443\"\n}",
+			line:    3, column: 12,
+		},
+		{
+			name:    "data after the config",
+			content: "{\"local\": \":1080\", \"remote\": \"example.com:443\"}\n{}",
+			line:    2, column: 1,
+		},
+		{
+			name:    "not an object",
+			content: "[]",
+			line:    1, column: 1,
+		},
+	}
+	dir := t.TempDir()
+	for _, tt := range tests {
+		file := writeConfig(t, dir, "client.json", tt.content)
+		err := LoadClientConfig(file, &ClientConfig{}, nil)
+		ce, path := fieldPath(err)
+		if ce == nil {
+			t.Errorf("%s: error %v, expect a ConfigError", tt.name, err)
+			continue
+		}
+		if ce.File != file || ce.Line != tt.line || ce.Column != tt.column {
+			t.Errorf("%s: %v, expect at %d:%d", tt.name, err, tt.line, tt.column)
+		}
+		if path != tt.path {
+			t.Errorf("%s: %v, expect a FieldError at %s", tt.name, err, tt.path)
+		}
+	}
+}
+
+func TestLoadServerConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		path    string
+	}{
+		{"valid", `{"listen": ":443", "tls": "true", "tls_cert": "cert.pem", "tls_key": "key.pem", "drain": "10s"}`, ""},
+		{"client field", `{"listen": ":443", "remote": "example.com:443"}`, "remote"},
+		{"tls without cert", `{"listen": ":443", "tls": true}`, "tls"},
+		{"invalid reverse ports", `{"listen": ":443", "reverse_ports": "9000-8000"}`, "reverse_ports"},
+		{"invalid drain", `{"listen": ":443", "drain": "soon"}`, "drain"},
+		{"no listen", `{"log": "info"}`, "listen"},
+		{"invalid log level", `{"listen": ":443", "log": "verbose"}`, "log"},
+	}
+	dir := t.TempDir()
+	for _, tt := range tests {
+		file := writeConfig(t, dir, "server.json", tt.content)
+		err := LoadServerConfig(file, &ServerConfig{}, nil)
+		if tt.path == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+		} else if _, path := fieldPath(err); path != tt.path {
+			t.Errorf("%s: error %v, expect a FieldError at %s", tt.name, err, tt.path)
+		}
+	}
+}
+
+func TestLoadConfigWorkers(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		path    string
+	}{
+		{
+			"valid",
+			`{"workers": [{"name": "a", "server": {"listen": ":443"}}, {"name": "b", "client": {"local": ":1080", "remote": "127.0.0.1:443"}}]}`,
+			"",
+		},
+		{"duplicate name", `{"workers": [{"name": "a", "server": {"listen": ":443"}}, {"name": "a", "server": {"listen": ":444"}}]}`, "workers[1].name"},
+		{"no name", `{"workers": [{"server": {"listen": ":443"}}]}`, "workers[0].name"},
+		{"both", `{"workers": [{"name": "a", "server": {"listen": ":443"}, "client": {"local": ":1080"}}]}`, "workers[0]"},
+		{"invalid worker", `{"workers": [{"name": "a", "client": {"local": ":1080"}}]}`, "workers[0].client.remote"},
+		{"unknown worker field", `{"workers": [{"name": "a", "server": {"listen": ":443", "locl": ":1"}}]}`, "workers[0].server.locl"},
+	}
+	dir := t.TempDir()
+	for _, tt := range tests {
+		file := writeConfig(t, dir, "config.json", tt.content)
+		err := LoadConfig(file, &Config{})
+		if tt.path == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+		} else if _, path := fieldPath(err); path != tt.path {
+			t.Errorf("%s: error %v, expect a FieldError at %s", tt.name, err, tt.path)
+		}
+	}
+	combined, err := IsCombinedConfig(writeConfig(t, dir, "workers.json", `{"workers": []}`))
+	if err != nil || !combined {
+		t.Errorf("IsCombinedConfig = %v %v, expect true", combined, err)
+	}
+}
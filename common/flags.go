@@ -0,0 +1,122 @@
+package common
+
+import (
+	"flag"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Flags registers a flag for each field of a config, named after the json
+// tag with '-' for '_', e.g. -sniff-timeout; fields which are set override
+// the config file and the environment, lists like -strategy are repeatable
+// and replace the list of the config file
+type Flags struct {
+	root *node
+}
+
+// NewFlags registers the fields of v, usage is looked up by the json tag
+func NewFlags(fs *flag.FlagSet, v interface{}, usage map[string]string) *Flags {
+	f := &Flags{root: newObject(position{File: "flags"})}
+	t := reflect.TypeOf(v)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		key := strings.Split(field.Tag.Get("json"), ",")[0]
+		// flags always follow the latest schema
+		if key == "" || key == "version" {
+			continue
+		}
+		name := strings.Replace(key, "_", "-", -1)
+		fs.Var(&flagValue{flags: f, key: key, name: name, t: field.Type}, name, usage[key])
+	}
+	return f
+}
+
+// IsSet reports whether any field is set by flags
+func (f *Flags) IsSet() bool {
+	return f != nil && len(f.root.keys) > 0
+}
+
+// apply sets the fields of root, which are set by flags
+func (f *Flags) apply(root *node) {
+	if f == nil {
+		return
+	}
+	for _, k := range f.root.keys {
+		root.set(k, f.root.fields[k].clone())
+	}
+}
+
+type flagValue struct {
+	flags *Flags
+	key   string
+	name  string
+	t     reflect.Type
+}
+
+func (v *flagValue) String() string {
+	return ""
+}
+
+func (v *flagValue) IsBoolFlag() bool {
+	t := v.t
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t == reflect.TypeOf(Bool(false))
+}
+
+func (v *flagValue) Set(s string) error {
+	pos := position{File: "-" + v.name}
+	if v.t.Kind() != reflect.Slice {
+		// scalars accept the string form
+		v.flags.root.set(v.key, &node{pos: pos, value: s})
+		return nil
+	}
+	e, err := parseElement(pos, s)
+	if err != nil {
+		return err
+	}
+	list, ok := v.flags.root.fields[v.key]
+	if !ok {
+		list = &node{pos: pos, isArray: true}
+		v.flags.root.set(v.key, list)
+	}
+	list.array = append(list.array, e)
+	return nil
+}
+
+// parseElement reads an element of a list, either a json object or
+// key=value pairs separated by comma, e.g. domain_suffix=.com,block=true
+func parseElement(pos position, s string) (*node, error) {
+	if strings.HasPrefix(strings.TrimSpace(s), "{") {
+		n, err := parseJSON(pos.File, []byte(s))
+		if err != nil {
+			return nil, err
+		}
+		if !n.object {
+			return nil, fmt.Errorf("expect an object")
+		}
+		return n, nil
+	}
+	n := newObject(pos)
+	last := ""
+	for _, kv := range strings.Split(s, ",") {
+		i := strings.IndexByte(kv, '=')
+		if i < 0 {
+			if last == "" {
+				return nil, fmt.Errorf("expect key=value, got %s", kv)
+			}
+			// a comma in the value, e.g. port_range=80,443
+			v := n.fields[last]
+			v.value = v.value.(string) + "," + kv
+			continue
+		}
+		last = strings.TrimSpace(kv[:i])
+		n.set(last, &node{pos: pos, value: kv[i+1:]})
+	}
+	return n, nil
+}
@@ -0,0 +1,181 @@
+package common
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/skip2/go-qrcode"
+)
+
+// LINKSCHEME starts share links, which carry the fields of a client config
+// to share, e.g.
+// mitsuyu://example.com:443/service?tls=1&sni=example.com&pin=<sha256>&compress=1&padding=1024#name
+const LINKSCHEME = "mitsuyu"
+
+// EncodeLink encodes remote, service_name, tls, tls_sni, tls_pin, tls_verify,
+// compress and padding of c, name labels the link
+func EncodeLink(c *ClientConfig, name string) string {
+	q := url.Values{}
+	if c.TLS {
+		q.Set("tls", "1")
+		if c.TLSSNI != "" {
+			q.Set("sni", c.TLSSNI)
+		}
+		if c.TLSPin != "" {
+			q.Set("pin", c.TLSPin)
+		}
+		if !BoolOr(c.TLSVerify, true) {
+			q.Set("verify", "0")
+		}
+	}
+	if c.Compress {
+		q.Set("compress", "1")
+	}
+	if c.Padding > 0 {
+		q.Set("padding", strconv.Itoa(int(c.Padding)))
+	}
+	u := url.URL{
+		Scheme:   LINKSCHEME,
+		Host:     c.Remote,
+		Path:     "/" + c.ServiceName,
+		RawQuery: q.Encode(),
+		Fragment: name,
+	}
+	return u.String()
+}
+
+// ParseLink decodes a share link into a config with the shared fields,
+// and returns the name of the link
+func ParseLink(link string) (*ClientConfig, string, error) {
+	u, err := url.Parse(strings.TrimSpace(link))
+	if err != nil {
+		return nil, "", fmt.Errorf("Link: %v", err)
+	}
+	if u.Scheme != LINKSCHEME {
+		return nil, "", fmt.Errorf("Link: Expect %s://, got %s", LINKSCHEME, u.Scheme)
+	}
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		return nil, "", fmt.Errorf("Link: Invalid remote %s", u.Host)
+	}
+	c := &ClientConfig{
+		Version:     CONFIGVERSION,
+		Remote:      u.Host,
+		ServiceName: strings.TrimPrefix(u.Path, "/"),
+	}
+	q := u.Query()
+	for key := range q {
+		switch key {
+		case "tls", "sni", "pin", "verify", "compress", "padding":
+		default:
+			return nil, "", fmt.Errorf("Link: Unknown parameter %s", key)
+		}
+	}
+	c.TLS = q.Get("tls") == "1"
+	c.TLSSNI = q.Get("sni")
+	c.TLSPin = q.Get("pin")
+	if q.Get("verify") == "0" {
+		verify := Bool(false)
+		c.TLSVerify = &verify
+	}
+	c.Compress = q.Get("compress") == "1"
+	if p := q.Get("padding"); p != "" {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return nil, "", fmt.Errorf("Link: Invalid padding %s", p)
+		}
+		c.Padding = Int(n)
+	}
+	if !c.TLS && (c.TLSSNI != "" || c.TLSPin != "") {
+		return nil, "", fmt.Errorf("Link: sni and pin require tls")
+	}
+	if c.TLSPin != "" && !validPin(c.TLSPin) {
+		return nil, "", fmt.Errorf("Link: Invalid pin %s", c.TLSPin)
+	}
+	return c, u.Fragment, nil
+}
+
+// ConfigLink encodes the config, the ca is pinned if tls_pin is not set
+func ConfigLink(c *ClientConfig, name string) (string, error) {
+	if c.TLS && c.TLSPin == "" && c.TLSCA != "" {
+		pin, err := PinFile(c.TLSCA)
+		if err != nil {
+			return "", err
+		}
+		shared := *c
+		shared.TLSPin = pin
+		c = &shared
+	}
+	return EncodeLink(c, name), nil
+}
+
+// LinkQR renders the link as a qr code of text, two modules per character
+func LinkQR(link string) (string, error) {
+	q, err := qrcode.New(link, qrcode.Low)
+	if err != nil {
+		return "", fmt.Errorf("Link: %v", err)
+	}
+	return q.ToSmallString(false), nil
+}
+
+// Pin is the sha256 of the certificate in hex
+func Pin(cert []byte) string {
+	sum := sha256.Sum256(cert)
+	return hex.EncodeToString(sum[:])
+}
+
+// PinFile pins the first certificate of the pem file
+func PinFile(file string) (string, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return "", fmt.Errorf("Link: No certificate in %s", file)
+	}
+	return Pin(block.Bytes), nil
+}
+
+func validPin(pin string) bool {
+	b, err := hex.DecodeString(pin)
+	return err == nil && len(b) == sha256.Size
+}
+
+// VerifyPin trusts the certificate of pin in the chain the server sends,
+// which is either the ca or the server certificate itself
+func VerifyPin(pin string) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return fmt.Errorf("no certificate")
+		}
+		roots := x509.NewCertPool()
+		intermediates := x509.NewCertPool()
+		pinned := false
+		for _, cert := range cs.PeerCertificates {
+			if Pin(cert.Raw) == pin {
+				roots.AddCert(cert)
+				pinned = true
+			} else {
+				intermediates.AddCert(cert)
+			}
+		}
+		if !pinned {
+			return fmt.Errorf("no certificate matches pin %s", pin)
+		}
+		_, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+			DNSName:       cs.ServerName,
+			Roots:         roots,
+			Intermediates: intermediates,
+		})
+		return err
+	}
+}
@@ -0,0 +1,175 @@
+package common
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLinkRoundTrip(t *testing.T) {
+	off := Bool(false)
+	pin := strings.Repeat("ab", 32)
+	tests := []struct {
+		name   string
+		config ClientConfig
+		link   string
+	}{
+		{
+			"plain",
+			ClientConfig{Remote: "example.com:80"},
+			"mitsuyu://example.com:80/#plain",
+		},
+		{
+			"tls",
+			ClientConfig{Remote: "example.com:443", ServiceName: "svc", TLS: true, TLSSNI: "cdn.example.com", Compress: true, Padding: 1024},
+			"mitsuyu://example.com:443/svc?compress=1&padding=1024&sni=cdn.example.com&tls=1#tls",
+		},
+		{
+			"pinned",
+			ClientConfig{Remote: "192.0.2.1:443", TLS: true, TLSPin: pin},
+			"mitsuyu://192.0.2.1:443/?pin=" + pin + "&tls=1#pinned",
+		},
+		{
+			"not verified",
+			ClientConfig{Remote: "[2001:db8::1]:443", TLS: true, TLSVerify: &off},
+			"mitsuyu://[2001:db8::1]:443/?tls=1&verify=0#not%20verified",
+		},
+	}
+	for _, tt := range tests {
+		link := EncodeLink(&tt.config, tt.name)
+		if link != tt.link {
+			t.Errorf("%s: link %s, expect %s", tt.name, link, tt.link)
+		}
+		c, name, err := ParseLink(link)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		want := tt.config
+		want.Version = CONFIGVERSION
+		if name != tt.name || !reflect.DeepEqual(*c, want) {
+			t.Errorf("%s: parsed %q %+v, expect %+v", tt.name, name, *c, want)
+		}
+	}
+}
+
+// only the shared fields are encoded
+func TestEncodeLinkShared(t *testing.T) {
+	c := &ClientConfig{Remote: "example.com:443", Local: ":1080", TLSCA: "ca.pem", TLSSNI: "example.com", UpLimit: 10}
+	if link := EncodeLink(c, ""); link != "mitsuyu://example.com:443/" {
+		t.Errorf("link %s, expect mitsuyu://example.com:443/", link)
+	}
+}
+
+func TestParseLinkErrors(t *testing.T) {
+	pin := strings.Repeat("ab", 32)
+	tests := []struct {
+		link string
+		err  string
+	}{
+		{"https://example.com:443/", "Expect mitsuyu://"},
+		{"mitsuyu://example.com/", "Invalid remote"},
+		{"mitsuyu://example.com:443/?tls=1&user=al", "Unknown parameter user"},
+		{"mitsuyu://example.com:443/?padding=-1", "Invalid padding"},
+		{"mitsuyu://example.com:443/?padding=many", "Invalid padding"},
+		{"mitsuyu://example.com:443/?sni=example.com", "require tls"},
+		{"mitsuyu://example.com:443/?pin=" + pin, "require tls"},
+		{"mitsuyu://example.com:443/?tls=1&pin=abcd", "Invalid pin"},
+		{"mitsuyu://example.com:443/%zz", "Link:"},
+	}
+	for _, tt := range tests {
+		if _, _, err := ParseLink(tt.link); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("ParseLink(%s): error %v, expect %s", tt.link, err, tt.err)
+		}
+	}
+	// pasted with spaces
+	if c, _, err := ParseLink("  mitsuyu://example.com:443/svc\n"); err != nil || c.ServiceName != "svc" {
+		t.Errorf("ParseLink with spaces = %+v %v", c, err)
+	}
+}
+
+func TestConfigLink(t *testing.T) {
+	ca, _, err := GenerateCA("test ca", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	file := filepath.Join(dir, "ca.pem")
+	if err = os.WriteFile(file, EncodeCert(ca), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := &ClientConfig{Remote: "example.com:443", TLS: true, TLSCA: file}
+	link, err := ConfigLink(c, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared, _, err := ParseLink(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shared.TLSPin != Pin(ca.Raw) {
+		t.Errorf("pin %s, expect the ca %s", shared.TLSPin, Pin(ca.Raw))
+	}
+	if c.TLSPin != "" {
+		t.Errorf("the config is modified")
+	}
+	// the pin of the config wins
+	c.TLSPin = strings.Repeat("ab", 32)
+	if link, _ = ConfigLink(c, ""); !strings.Contains(link, "pin="+c.TLSPin) {
+		t.Errorf("link %s, expect pin %s", link, c.TLSPin)
+	}
+	if _, err = PinFile(filepath.Join(dir, "missing.pem")); err == nil {
+		t.Errorf("PinFile of a missing file: expect an error")
+	}
+	if _, err = LinkQR(link); err != nil {
+		t.Errorf("LinkQR: %v", err)
+	}
+}
+
+func TestVerifyPin(t *testing.T) {
+	ca, caKey, err := GenerateCA("test ca", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _, err := IssueCert(ca, caKey, []string{"example.com"}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, otherKey, err := GenerateCA("other ca", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stranger, _, err := IssueCert(other, otherKey, []string{"example.com"}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		pin   string
+		chain []*x509.Certificate
+		sni   string
+		ok    bool
+	}{
+		{"ca", Pin(ca.Raw), []*x509.Certificate{leaf, ca}, "example.com", true},
+		{"server certificate", Pin(leaf.Raw), []*x509.Certificate{leaf, ca}, "example.com", true},
+		{"server certificate alone", Pin(leaf.Raw), []*x509.Certificate{leaf}, "example.com", true},
+		{"ca not sent", Pin(ca.Raw), []*x509.Certificate{leaf}, "example.com", false},
+		{"other pin", Pin(other.Raw), []*x509.Certificate{leaf, ca}, "example.com", false},
+		{"wrong name", Pin(ca.Raw), []*x509.Certificate{leaf, ca}, "example.org", false},
+		{"not signed by the ca", Pin(ca.Raw), []*x509.Certificate{stranger, ca}, "example.com", false},
+		{"no certificate", Pin(ca.Raw), nil, "example.com", false},
+	}
+	for _, tt := range tests {
+		err := VerifyPin(tt.pin)(tls.ConnectionState{PeerCertificates: tt.chain, ServerName: tt.sni})
+		if tt.ok && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("%s: expect an error", tt.name)
+		}
+	}
+}
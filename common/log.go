@@ -3,6 +3,7 @@ package common
 import (
 	"fmt"
 	"io"
+	"sync/atomic"
 )
 
 const (
@@ -13,11 +14,14 @@ const (
 )
 
 type Logger struct {
-	level int
+	// changed by reload while logging
+	level int32
 	err   chan error
 	info  chan string
 	debug chan string
 	done  chan struct{}
+	// closed when StartLog returns
+	exited chan struct{}
 }
 
 func NewLogger(levelStr string) *Logger {
@@ -38,15 +42,15 @@ func NewLogger(levelStr string) *Logger {
 	err = make(chan error, 5)
 	info = make(chan string, 10)
 	debug = make(chan string, 20)
-	return &Logger{level: level, err: err, info: info, debug: debug}
+	return &Logger{level: int32(level), err: err, info: info, debug: debug}
 }
 
 func (l *Logger) SetLevel(level int) {
-	l.level = level
+	atomic.StoreInt32(&l.level, int32(level))
 }
 
 func (l *Logger) GetLevel() int {
-	return l.level
+	return int(atomic.LoadInt32(&l.level))
 }
 
 func (l *Logger) GetErr() chan error {
@@ -62,28 +66,31 @@ func (l *Logger) GetDebug() chan string {
 }
 
 func (l *Logger) Errorf(err error) {
-	if l.level >= LOG_ERR {
+	if l.GetLevel() >= LOG_ERR {
 		l.err <- err
 	}
 }
 
 func (l *Logger) Infof(info string) {
-	if l.level >= LOG_INFO {
+	if l.GetLevel() >= LOG_INFO {
 		l.info <- info
 	}
 }
 
 func (l *Logger) Debugf(debug string) {
-	if l.level >= LOG_DEBUG {
+	if l.GetLevel() >= LOG_DEBUG {
 		l.debug <- debug
 	}
 }
 
 func (l *Logger) StartLog(dst io.Writer) {
 	l.done = make(chan struct{}, 0)
+	l.exited = make(chan struct{}, 0)
+	defer close(l.exited)
 	for {
 		select {
 		case <-l.done:
+			l.flush(dst)
 			return
 		case e := <-l.err:
 			fmt.Fprintf(dst, "%v", e)
@@ -95,9 +102,27 @@ func (l *Logger) StartLog(dst io.Writer) {
 	}
 }
 
+// flush writes the pending logs
+func (l *Logger) flush(dst io.Writer) {
+	for {
+		select {
+		case e := <-l.err:
+			fmt.Fprintf(dst, "%v", e)
+		case i := <-l.info:
+			fmt.Fprintf(dst, "%s", i)
+		case d := <-l.debug:
+			fmt.Fprintf(dst, "%s", d)
+		default:
+			return
+		}
+	}
+}
+
+// StopLog returns after the pending logs are written
 func (l *Logger) StopLog() {
 	defer func() {
 		recover()
 	}()
 	close(l.done)
+	<-l.exited
 }
@@ -0,0 +1,706 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// ENVPREFIX starts environment variables which override config fields,
+// e.g. MITSUYU_REMOTE for remote and MITSUYU_WORKERS__NAME__CLIENT__REMOTE
+// for remote of the worker called name, the index also selects an element
+const ENVPREFIX = "MITSUYU_"
+
+// INCLUDEKEY names files merged into the object it appears in, objects are
+// merged, arrays are appended and the including file wins on values
+const INCLUDEKEY = "include"
+
+// position is where a value is defined, line is 0 if unknown
+type position struct {
+	File   string
+	Line   int
+	Column int
+}
+
+// node is a value of the config source, an object, an array or a scalar
+type node struct {
+	pos    position
+	keys   []string
+	fields map[string]*node
+	array  []*node
+	value  interface{}
+	// either object or array if not a scalar
+	object  bool
+	isArray bool
+}
+
+func newObject(pos position) *node {
+	return &node{pos: pos, object: true, fields: make(map[string]*node)}
+}
+
+func (n *node) set(key string, v *node) {
+	if _, ok := n.fields[key]; !ok {
+		n.keys = append(n.keys, key)
+	}
+	n.fields[key] = v
+}
+
+func (n *node) remove(key string) {
+	delete(n.fields, key)
+	for i, k := range n.keys {
+		if k == key {
+			n.keys = append(n.keys[:i], n.keys[i+1:]...)
+			break
+		}
+	}
+}
+
+// plain converts the node to values json encodes
+func (n *node) plain() interface{} {
+	switch {
+	case n.object:
+		m := make(map[string]interface{}, len(n.keys))
+		for _, k := range n.keys {
+			m[k] = n.fields[k].plain()
+		}
+		return m
+	case n.isArray:
+		a := make([]interface{}, len(n.array))
+		for i, v := range n.array {
+			a[i] = v.plain()
+		}
+		return a
+	}
+	return n.value
+}
+
+func (n *node) clone() *node {
+	c := *n
+	if n.object {
+		c.keys = append([]string(nil), n.keys...)
+		c.fields = make(map[string]*node, len(n.fields))
+		for k, v := range n.fields {
+			c.fields[k] = v.clone()
+		}
+	}
+	if n.isArray {
+		c.array = make([]*node, len(n.array))
+		for i, v := range n.array {
+			c.array[i] = v.clone()
+		}
+	}
+	return &c
+}
+
+// positions maps paths like inbounds[0].listen to where they are defined
+func (n *node) positions(path string, m map[string]position) {
+	m[path] = n.pos
+	switch {
+	case n.object:
+		for _, k := range n.keys {
+			sub := k
+			if path != "" {
+				sub = path + "." + k
+			}
+			n.fields[k].positions(sub, m)
+		}
+	case n.isArray:
+		for i, v := range n.array {
+			v.positions(fmt.Sprintf("%s[%d]", path, i), m)
+		}
+	}
+}
+
+// overlay merges src into dst, src wins unless both are objects or arrays
+func overlay(dst, src *node) *node {
+	switch {
+	case dst == nil:
+		return src
+	case dst.object && src.object:
+		for _, k := range src.keys {
+			if v, ok := dst.fields[k]; ok {
+				dst.fields[k] = overlay(v, src.fields[k])
+			} else {
+				dst.set(k, src.fields[k])
+			}
+		}
+		return dst
+	case dst.isArray && src.isArray:
+		dst.array = append(dst.array, src.array...)
+		return dst
+	}
+	return src
+}
+
+// readSource parses the file by extension and resolves includes,
+// stack holds the including files to detect cycles
+func readSource(file string, stack []string) (*node, error) {
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range stack {
+		if f == abs {
+			return nil, &ConfigError{File: file, Err: fmt.Errorf("include cycle")}
+		}
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var root *node
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		root, err = parseYAML(file, content)
+	case ".toml":
+		root, err = parseTOML(file, content)
+	default:
+		root, err = parseJSON(file, content)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !root.object {
+		return nil, &ConfigError{File: file, Line: root.pos.Line, Column: root.pos.Column,
+			Err: fmt.Errorf("expect an object")}
+	}
+	return resolveIncludes(root, filepath.Dir(file), append(stack, abs))
+}
+
+// resolveIncludes returns the node with includes merged in,
+// files are relative to dir
+func resolveIncludes(n *node, dir string, stack []string) (*node, error) {
+	switch {
+	case n.object:
+		for _, k := range n.keys {
+			if k == INCLUDEKEY {
+				continue
+			}
+			v, err := resolveIncludes(n.fields[k], dir, stack)
+			if err != nil {
+				return nil, err
+			}
+			n.fields[k] = v
+		}
+	case n.isArray:
+		for i, v := range n.array {
+			v, err := resolveIncludes(v, dir, stack)
+			if err != nil {
+				return nil, err
+			}
+			n.array[i] = v
+		}
+	}
+	inc, ok := n.fields[INCLUDEKEY]
+	if !n.object || !ok {
+		return n, nil
+	}
+	n.remove(INCLUDEKEY)
+	files, err := includeFiles(inc, dir)
+	if err != nil {
+		return nil, err
+	}
+	var base *node
+	for _, f := range files {
+		v, err := readSource(f, stack)
+		if _, ok := err.(*ConfigError); !ok && err != nil {
+			return nil, &ConfigError{File: inc.pos.File, Line: inc.pos.Line, Column: inc.pos.Column,
+				Err: fmt.Errorf("include: %v", err)}
+		}
+		if err != nil {
+			return nil, err
+		}
+		base = overlay(base, v)
+	}
+	return overlay(base, n), nil
+}
+
+// includeFiles accepts a file or a list of files, patterns are expanded
+func includeFiles(inc *node, dir string) ([]string, error) {
+	list := []*node{inc}
+	if inc.isArray {
+		list = inc.array
+	}
+	var files []string
+	for _, v := range list {
+		name, ok := v.value.(string)
+		if !ok || name == "" {
+			return nil, &ConfigError{File: v.pos.File, Line: v.pos.Line, Column: v.pos.Column,
+				Err: fmt.Errorf("include: expect a file name")}
+		}
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(dir, name)
+		}
+		if !strings.ContainsAny(name, "*?[") {
+			files = append(files, name)
+			continue
+		}
+		matches, err := filepath.Glob(name)
+		if err != nil {
+			return nil, &ConfigError{File: v.pos.File, Line: v.pos.Line, Column: v.pos.Column,
+				Err: fmt.Errorf("include: %v", err)}
+		}
+		files = append(files, matches...)
+	}
+	return files, nil
+}
+
+// applyEnv overrides fields of the config type t with the environment
+func applyEnv(root *node, t reflect.Type, environ []string) error {
+	sort.Strings(environ)
+	for _, kv := range environ {
+		if !strings.HasPrefix(kv, ENVPREFIX) {
+			continue
+		}
+		i := strings.IndexByte(kv, '=')
+		if i < 0 {
+			continue
+		}
+		name, value := kv[:i], kv[i+1:]
+		if err := setEnv(root, t, strings.Split(name[len(ENVPREFIX):], "__"), name, value); err != nil {
+			return &ConfigError{File: "$" + name, Err: err}
+		}
+	}
+	return nil
+}
+
+// setEnv sets the field at segments, names which are not fields are errors
+// like unknown fields of the config file
+func setEnv(n *node, t reflect.Type, segments []string, name, value string) error {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	pos := position{File: "$" + name}
+	if len(segments) == 0 {
+		if t.Kind() == reflect.Struct && !reflect.PtrTo(t).Implements(unmarshalerType) ||
+			t.Kind() == reflect.Slice {
+			return fmt.Errorf("not a value, override its fields")
+		}
+		// scalars accept the string form
+		*n = node{pos: pos, value: value}
+		return nil
+	}
+	seg := segments[0]
+	switch t.Kind() {
+	case reflect.Struct:
+		var field reflect.StructField
+		var key string
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			tag := strings.Split(f.Tag.Get("json"), ",")[0]
+			if tag != "" && strings.ToUpper(tag) == seg {
+				field, key = f, tag
+				break
+			}
+		}
+		if key == "" {
+			return fmt.Errorf("unknown field %s", strings.ToLower(seg))
+		}
+		if !n.object {
+			return fmt.Errorf("not an object")
+		}
+		v, ok := n.fields[key]
+		if !ok {
+			v = &node{pos: pos}
+			if len(segments) > 1 {
+				v = newObject(pos)
+			}
+		}
+		if err := setEnv(v, field.Type, segments[1:], name, value); err != nil {
+			return err
+		}
+		if !ok && (v.value != nil || v.object && len(v.keys) > 0) {
+			n.set(key, v)
+		}
+	case reflect.Slice:
+		v := elementOf(n, seg)
+		if v == nil {
+			return fmt.Errorf("no element %s", seg)
+		}
+		return setEnv(v, t.Elem(), segments[1:], name, value)
+	}
+	return nil
+}
+
+// elementOf finds the element by index or by name
+func elementOf(n *node, seg string) *node {
+	if i, err := strconv.Atoi(seg); err == nil {
+		if i < 0 || i >= len(n.array) {
+			return nil
+		}
+		return n.array[i]
+	}
+	for _, v := range n.array {
+		if !v.object {
+			continue
+		}
+		if name, ok := v.fields["name"]; ok {
+			if s, ok := name.value.(string); ok && strings.ToUpper(s) == seg {
+				return v
+			}
+		}
+	}
+	return nil
+}
+
+func parseJSON(file string, content []byte) (*node, error) {
+	p := &jsonParser{file: file, content: content, dec: json.NewDecoder(bytes.NewReader(content))}
+	p.dec.UseNumber()
+	root, err := p.parse(p.start())
+	if err == nil {
+		offset := p.start()
+		if _, err = p.dec.Token(); err == io.EOF {
+			return root, nil
+		}
+		if err == nil {
+			line, column := lineColumn(content, offset)
+			return nil, &ConfigError{File: file, Line: line, Column: column,
+				Err: fmt.Errorf("unexpected data after the config")}
+		}
+	}
+	if e, ok := err.(*json.SyntaxError); ok {
+		// the offset is after the invalid character
+		offset := e.Offset
+		if offset > 0 {
+			offset--
+		}
+		line, column := lineColumn(content, offset)
+		return nil, &ConfigError{File: file, Line: line, Column: column, Err: err}
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return nil, &ConfigError{File: file, Err: err}
+}
+
+type jsonParser struct {
+	file    string
+	content []byte
+	dec     *json.Decoder
+}
+
+// parse reads the value starting at offset
+func (p *jsonParser) parse(offset int64) (*node, error) {
+	line, column := lineColumn(p.content, offset)
+	pos := position{File: p.file, Line: line, Column: column}
+	tok, err := p.dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch tok {
+	case json.Delim('{'):
+		n := newObject(pos)
+		for p.dec.More() {
+			offset := p.start()
+			tok, err := p.dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			key, _ := tok.(string)
+			v, err := p.parse(p.start())
+			if err != nil {
+				return nil, err
+			}
+			// the key locates the field
+			line, column := lineColumn(p.content, offset)
+			v.pos = position{File: p.file, Line: line, Column: column}
+			n.set(key, v)
+		}
+		_, err = p.dec.Token()
+		return n, err
+	case json.Delim('['):
+		n := &node{pos: pos, isArray: true}
+		for p.dec.More() {
+			v, err := p.parse(p.start())
+			if err != nil {
+				return nil, err
+			}
+			n.array = append(n.array, v)
+		}
+		_, err = p.dec.Token()
+		return n, err
+	}
+	return &node{pos: pos, value: tok}, nil
+}
+
+// start returns the offset of the next token
+func (p *jsonParser) start() int64 {
+	offset := p.dec.InputOffset()
+	for offset < int64(len(p.content)) && strings.IndexByte(" \t\r\n,:", p.content[offset]) >= 0 {
+		offset++
+	}
+	return offset
+}
+
+func lineColumn(content []byte, offset int64) (int, int) {
+	if offset > int64(len(content)) {
+		offset = int64(len(content))
+	}
+	line := bytes.Count(content[:offset], []byte("\n")) + 1
+	column := int(offset) - bytes.LastIndexByte(content[:offset], '\n')
+	return line, column
+}
+
+func parseYAML(file string, content []byte) (*node, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(content, &doc); err != nil {
+		return nil, &ConfigError{File: file, Err: err}
+	}
+	if len(doc.Content) == 0 {
+		// empty document
+		return newObject(position{File: file}), nil
+	}
+	return fromYAML(file, doc.Content[0])
+}
+
+func fromYAML(file string, y *yaml.Node) (*node, error) {
+	pos := position{File: file, Line: y.Line, Column: y.Column}
+	switch y.Kind {
+	case yaml.MappingNode:
+		n := newObject(pos)
+		for i := 0; i+1 < len(y.Content); i += 2 {
+			k := y.Content[i]
+			v, err := fromYAML(file, y.Content[i+1])
+			if err != nil {
+				return nil, err
+			}
+			// the key locates the field
+			v.pos = position{File: file, Line: k.Line, Column: k.Column}
+			n.set(k.Value, v)
+		}
+		return n, nil
+	case yaml.SequenceNode:
+		n := &node{pos: pos, isArray: true}
+		for _, e := range y.Content {
+			v, err := fromYAML(file, e)
+			if err != nil {
+				return nil, err
+			}
+			n.array = append(n.array, v)
+		}
+		return n, nil
+	case yaml.AliasNode:
+		n, err := fromYAML(file, y.Alias)
+		if err != nil {
+			return nil, err
+		}
+		n.pos = pos
+		return n, nil
+	}
+	var v interface{}
+	if err := y.Decode(&v); err != nil {
+		return nil, &ConfigError{File: file, Line: y.Line, Column: y.Column, Err: err}
+	}
+	return &node{pos: pos, value: v}, nil
+}
+
+// parseTOML does not locate fields, toml does not record positions of keys
+func parseTOML(file string, content []byte) (*node, error) {
+	var m map[string]interface{}
+	if _, err := toml.Decode(string(content), &m); err != nil {
+		// the message has the line
+		return nil, &ConfigError{File: file, Err: err}
+	}
+	return fromTOML("", position{File: file}, m, tomlPositions(file, content)), nil
+}
+
+// fromTOML builds the node at path, positions of the keys are looked up,
+// values without a key of their own take that of the parent
+func fromTOML(path string, pos position, v interface{}, positions map[string]position) *node {
+	if p, ok := positions[path]; ok {
+		pos = p
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		n := newObject(pos)
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			sub := k
+			if path != "" {
+				sub = path + "." + k
+			}
+			n.set(k, fromTOML(sub, pos, v[k], positions))
+		}
+		return n
+	case []map[string]interface{}:
+		n := &node{pos: pos, isArray: true}
+		for i, e := range v {
+			n.array = append(n.array, fromTOML(fmt.Sprintf("%s[%d]", path, i), pos, e, positions))
+		}
+		return n
+	case []interface{}:
+		n := &node{pos: pos, isArray: true}
+		for i, e := range v {
+			n.array = append(n.array, fromTOML(fmt.Sprintf("%s[%d]", path, i), pos, e, positions))
+		}
+		return n
+	}
+	return &node{pos: pos, value: v}
+}
+
+// tomlPositions finds the lines of table headers and keys, the decoder
+// keeps them to itself; keys inside inline tables are not found
+func tomlPositions(file string, content []byte) map[string]position {
+	m := make(map[string]position)
+	// number of elements of arrays of tables
+	arrays := make(map[string]int)
+	table := ""
+	// state of a value over several lines
+	depth, multi := 0, ""
+	for i, line := range strings.Split(string(content), "\n") {
+		if multi != "" || depth > 0 {
+			scanTOMLValue(line, &depth, &multi)
+			continue
+		}
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || trimmed[0] == '#' {
+			continue
+		}
+		pos := position{File: file, Line: i + 1, Column: len(line) - len(strings.TrimLeft(line, " \t")) + 1}
+		if trimmed[0] == '[' {
+			isArray := strings.HasPrefix(trimmed, "[[")
+			header := strings.TrimLeft(trimmed, "[")
+			if j := strings.IndexByte(header, ']'); j >= 0 {
+				header = header[:j]
+			}
+			segs := tomlKey(header)
+			table = ""
+			for j, seg := range segs {
+				table = joinPath(table, seg)
+				if j == len(segs)-1 {
+					break
+				}
+				if n, ok := arrays[table]; ok {
+					table = fmt.Sprintf("%s[%d]", table, n-1)
+				}
+			}
+			if _, ok := m[table]; !ok {
+				m[table] = pos
+			}
+			if isArray {
+				n := arrays[table]
+				arrays[table] = n + 1
+				table = fmt.Sprintf("%s[%d]", table, n)
+				m[table] = pos
+			}
+			continue
+		}
+		j := tomlAssign(trimmed)
+		if j < 0 {
+			continue
+		}
+		path := table
+		for _, seg := range tomlKey(trimmed[:j]) {
+			path = joinPath(path, seg)
+			if _, ok := m[path]; !ok {
+				m[path] = pos
+			}
+		}
+		scanTOMLValue(trimmed[j+1:], &depth, &multi)
+	}
+	return m
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// tomlKey splits a dotted key, quoted parts may contain dots
+func tomlKey(s string) []string {
+	var segs []string
+	var seg strings.Builder
+	quote := byte(0)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+			if c == '\\' && quote == '"' && i+1 < len(s) {
+				i++
+				c = s[i]
+			}
+			seg.WriteByte(c)
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '.':
+			segs = append(segs, strings.TrimSpace(seg.String()))
+			seg.Reset()
+		case c != ' ' && c != '\t':
+			seg.WriteByte(c)
+		}
+	}
+	return append(segs, strings.TrimSpace(seg.String()))
+}
+
+// tomlAssign returns the index of = after the key, or -1
+func tomlAssign(s string) int {
+	quote := byte(0)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '=':
+			return i
+		}
+	}
+	return -1
+}
+
+// scanTOMLValue follows strings and brackets of a value, so the lines
+// of a multi-line string or array are not taken as keys
+func scanTOMLValue(s string, depth *int, multi *string) {
+	for i := 0; i < len(s); i++ {
+		if *multi != "" {
+			if strings.HasPrefix(s[i:], *multi) {
+				i += len(*multi) - 1
+				*multi = ""
+			} else if s[i] == '\\' && *multi == `"""` {
+				i++
+			}
+			continue
+		}
+		switch c := s[i]; c {
+		case '#':
+			return
+		case '[', '{':
+			*depth++
+		case ']', '}':
+			*depth--
+		case '"', '\'':
+			delim := strings.Repeat(string(c), 3)
+			if strings.HasPrefix(s[i:], delim) {
+				*multi = delim
+				i += 2
+				continue
+			}
+			// a string ends on its line
+			for i++; i < len(s) && s[i] != c; i++ {
+				if s[i] == '\\' && c == '"' {
+					i++
+				}
+			}
+		}
+	}
+}
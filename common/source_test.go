@@ -0,0 +1,436 @@
+package common
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// the same config in each format
+func TestLoadConfigFormats(t *testing.T) {
+	files := map[string]string{
+		"client.json": `{
+  "local": ":1080",
+  "remote": "example.com:443",
+  "tls": true,
+  "sniff_limit": 1000,
+  "inbounds": [{"type": "http", "listen": ":8080", "users": [{"user": "al", "pass": "secret"}]}],
+  "strategy": [{"domain_suffix": ".cn", "next": "1.1.1.1:443"}, {"block": true}]
+}`,
+		"client.yaml": `
+local: ":1080"
+remote: example.com:443
+tls: true
+sniff_limit: 1000
+inbounds:
+  - type: http
+    listen: ":8080"
+    users:
+      - {user: al, pass: secret}
+strategy:
+  - domain_suffix: .cn
+    next: 1.1.1.1:443
+  - block: true
+`,
+		"client.toml": `
+local = ":1080"
+remote = "example.com:443"
+tls = true
+sniff_limit = 1000
+
+[[inbounds]]
+type = "http"
+listen = ":8080"
+users = [{user = "al", pass = "secret"}]
+
+[[strategy]]
+domain_suffix = ".cn"
+next = "1.1.1.1:443"
+
+[[strategy]]
+block = true
+`,
+	}
+	dir := t.TempDir()
+	var want []byte
+	for _, name := range []string{"client.json", "client.yaml", "client.toml"} {
+		var c ClientConfig
+		if err := LoadClientConfig(writeConfig(t, dir, name, files[name]), &c, nil); err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		got, _ := json.Marshal(&c)
+		if want == nil {
+			want = got
+		} else if string(got) != string(want) {
+			t.Errorf("%s: %s, expect %s", name, got, want)
+		}
+	}
+}
+
+func TestConfigErrorLocations(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		path    string
+		line    int
+		column  int
+	}{
+		{
+			name: "yaml unknown field",
+			file: "client.yaml",
+			content: `local: ":1080"
+remote: example.com:443
+inbounds:
+  - type: http
+    listn: ":8080"
+`,
+			path: "inbounds[0].listn",
+			line: 5, column: 5,
+		},
+		{
+			// yes is a string in yaml 1.2
+			name:    "yaml invalid boolean",
+			file:    "client.yaml",
+			content: "local: \":1080\"\nremote: example.com:443\ntls: yes\n",
+			path:    "tls",
+			line:    3, column: 1,
+		},
+		{
+			name: "yaml invalid value",
+			file: "client.yaml",
+			content: `local: ":1080"
+remote: example.com:443
+strategy:
+  - dns: 8.8.8.8:53
+  - next: bad
+`,
+			path: "strategy[1].next",
+			line: 5, column: 5,
+		},
+		{
+			name: "yaml absent field",
+			file: "client.yaml",
+			content: `remote: example.com:443
+inbounds:
+  - type: http
+`,
+			path: "inbounds[0].listen",
+			line: 3, column: 5,
+		},
+		{
+			name:    "yaml syntax error",
+			file:    "client.yaml",
+			content: "local: \":1080\"\n  remote: [\n",
+		},
+		{
+			name: "toml unknown field",
+			file: "client.toml",
+			content: `local = ":1080"
+remote = "example.com:443"
+
+[[inbounds]]
+type = "http"
+listen = ":8080"
+
+[[inbounds]]
+type = "http"
+listn = ":8081"
+`,
+			path: "inbounds[1].listn",
+			line: 10, column: 1,
+		},
+		{
+			name: "toml nested array of tables",
+			file: "client.toml",
+			content: `local = ":1080"
+remote = "example.com:443"
+
+[[inbounds]]
+type = "http"
+listen = ":8080"
+  [[inbounds.strategy]]
+  dns = "8.8.8.8:53"
+  [[inbounds.strategy]]
+  next = "bad"
+`,
+			path: "inbounds[0].strategy[1].next",
+			line: 10, column: 3,
+		},
+		{
+			// the lines of the string are not keys
+			name: "toml after a multi-line string",
+			file: "client.toml",
+			content: `local = ":1080"
+remote = "example.com:443"
+sniff_skip_ports = """
+tun_mtu = 1"""
+tun_mtu = 10
+`,
+			path: "tun_mtu",
+			line: 5, column: 1,
+		},
+		{
+			name:    "toml dotted key",
+			file:    "client.toml",
+			content: "local = \":1080\"\nremote = \"example.com:443\"\n\n[[forward]]\nlocal = \":53\"\n\"dest\" = \"8.8.8.8\"\n",
+			path:    "forward[0].dest",
+			line:    6, column: 1,
+		},
+		{
+			name:    "toml syntax error",
+			file:    "client.toml",
+			content: "local = \":1080\"\nremote = \n",
+		},
+	}
+	dir := t.TempDir()
+	for _, tt := range tests {
+		file := writeConfig(t, dir, tt.file, tt.content)
+		err := LoadClientConfig(file, &ClientConfig{}, nil)
+		ce, path := fieldPath(err)
+		if ce == nil {
+			t.Errorf("%s: error %v, expect a ConfigError", tt.name, err)
+			continue
+		}
+		if ce.File != file || ce.Line != tt.line || ce.Column != tt.column {
+			t.Errorf("%s: %v, expect at %d:%d", tt.name, err, tt.line, tt.column)
+		}
+		if path != tt.path {
+			t.Errorf("%s: %v, expect a FieldError at %s", tt.name, err, tt.path)
+		}
+	}
+}
+
+func TestIncludes(t *testing.T) {
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "strategy"), 0755)
+	writeConfig(t, dir, "strategy/a.json", `{"strategy": [{"domain_suffix": ".a"}]}`)
+	writeConfig(t, dir, "strategy/b.yaml", "strategy:\n  - domain_suffix: .b\n")
+	writeConfig(t, dir, "base.toml", "remote = \"base.example:443\"\ntls = true\n")
+	main := writeConfig(t, dir, "client.json", `{
+  "include": ["base.toml", "strategy/*"],
+  "local": ":1080",
+  "remote": "example.com:443",
+  "strategy": [{"domain_suffix": ".c"}]
+}`)
+	var c ClientConfig
+	if err := LoadClientConfig(main, &c, nil); err != nil {
+		t.Fatal(err)
+	}
+	// the including file wins on values
+	if c.Remote != "example.com:443" || !bool(c.TLS) {
+		t.Errorf("remote %s tls %v, expect example.com:443 true", c.Remote, c.TLS)
+	}
+	// arrays are appended after those included
+	var suffixes []string
+	for _, s := range c.StrategyGroup {
+		suffixes = append(suffixes, s.DomainSuffix)
+	}
+	if strings.Join(suffixes, " ") != ".a .b .c" {
+		t.Errorf("strategy %v, expect .a .b .c", suffixes)
+	}
+
+	// included into a worker
+	writeConfig(t, dir, "worker.yaml", "local: \":1080\"\nremote: example.com:443\nsniff_limit: -1\n")
+	workers := writeConfig(t, dir, "workers.json", `{"workers": [{"name": "a", "client": {"include": "worker.yaml"}}]}`)
+	err := LoadConfig(workers, &Config{})
+	if ce, path := fieldPath(err); ce == nil || path != "workers[0].client.sniff_limit" ||
+		ce.File != filepath.Join(dir, "worker.yaml") || ce.Line != 3 {
+		t.Errorf("worker error %v, expect sniff_limit in worker.yaml:3", err)
+	}
+}
+
+func TestIncludeErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		// error message
+		err string
+		// where the error is located
+		file string
+		line int
+	}{
+		{
+			name:  "self",
+			files: map[string]string{"client.json": `{"include": "client.json"}`},
+			err:   "include cycle",
+			file:  "client.json",
+		},
+		{
+			name: "cycle",
+			files: map[string]string{
+				"client.json": `{"include": "a.yaml"}`,
+				"a.yaml":      "include: [b.toml]\n",
+				"b.toml":      "include = \"client.json\"\n",
+			},
+			err:  "include cycle",
+			file: "client.json",
+		},
+		{
+			name:  "missing file",
+			files: map[string]string{"client.json": "{\n  \"include\": \"missing.json\"\n}"},
+			err:   "include:",
+			file:  "client.json",
+			line:  2,
+		},
+		{
+			name:  "not a file name",
+			files: map[string]string{"client.json": "{\n  \"include\": [1]\n}"},
+			err:   "expect a file name",
+			file:  "client.json",
+			line:  2,
+		},
+		{
+			name: "error in the included file",
+			files: map[string]string{
+				"client.json": `{"include": "a.json"}`,
+				"a.json":      "{\n  \"local\": \":1080\",\n  \"remot\": \"example.com:443\"\n}",
+			},
+			err:  "unknown field",
+			file: "a.json",
+			line: 3,
+		},
+		{
+			name: "included file not an object",
+			files: map[string]string{
+				"client.json": `{"include": "a.yaml"}`,
+				"a.yaml":      "- 1\n",
+			},
+			err:  "expect an object",
+			file: "a.yaml",
+			line: 1,
+		},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		for name, content := range tt.files {
+			writeConfig(t, dir, name, content)
+		}
+		err := LoadClientConfig(filepath.Join(dir, "client.json"), &ClientConfig{}, nil)
+		ce, ok := err.(*ConfigError)
+		if !ok || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: error %v, expect %s", tt.name, err, tt.err)
+			continue
+		}
+		if filepath.Base(ce.File) != tt.file || ce.Line != tt.line {
+			t.Errorf("%s: %v, expect at %s:%d", tt.name, err, tt.file, tt.line)
+		}
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	content := `{
+  "local": ":1080",
+  "tls": true,
+  "inbounds": [{"type": "http", "listen": ":8080"}, {"type": "socks5", "listen": ":1081"}],
+  "workers": [{"name": "b", "client": {"remote": "b.example:443"}}]
+}`
+	tests := []struct {
+		name    string
+		environ []string
+		t       interface{}
+		// the config as json, empty if an error
+		want string
+		err  string
+	}{
+		{
+			name:    "override",
+			environ: []string{"MITSUYU_LOCAL=:1090", "MITSUYU_TLS=false", "PATH=/bin"},
+			t:       &ClientConfig{},
+			want:    `{"inbounds":[{"listen":":8080","type":"http"},{"listen":":1081","type":"socks5"}],"local":":1090","tls":"false"}`,
+		},
+		{
+			name:    "add a field",
+			environ: []string{"MITSUYU_REMOTE=example.com:443"},
+			t:       &ClientConfig{},
+			want:    `{"inbounds":[{"listen":":8080","type":"http"},{"listen":":1081","type":"socks5"}],"local":":1080","remote":"example.com:443","tls":true}`,
+		},
+		{
+			name:    "element by index",
+			environ: []string{"MITSUYU_INBOUNDS__1__LISTEN=:1082"},
+			t:       &ClientConfig{},
+			want:    `{"inbounds":[{"listen":":8080","type":"http"},{"listen":":1082","type":"socks5"}],"local":":1080","tls":true}`,
+		},
+		{
+			name:    "element by name",
+			environ: []string{"MITSUYU_WORKERS__B__CLIENT__REMOTE=c.example:443", "MITSUYU_WORKERS__B__CLIENT__SNIFF_LIMIT=10"},
+			t:       &Config{},
+			want:    `{"workers":[{"client":{"remote":"c.example:443","sniff_limit":"10"},"name":"b"}]}`,
+		},
+		{
+			name:    "unknown field",
+			environ: []string{"MITSUYU_REMOT=example.com:443"},
+			t:       &ClientConfig{},
+			err:     "$MITSUYU_REMOT: unknown field remot",
+		},
+		{
+			name:    "not a value",
+			environ: []string{"MITSUYU_INBOUNDS=:8080"},
+			t:       &ClientConfig{},
+			err:     "$MITSUYU_INBOUNDS: not a value",
+		},
+		{
+			name:    "no element",
+			environ: []string{"MITSUYU_INBOUNDS__2__LISTEN=:8080"},
+			t:       &ClientConfig{},
+			err:     "$MITSUYU_INBOUNDS__2__LISTEN: no element 2",
+		},
+		{
+			name:    "no worker",
+			environ: []string{"MITSUYU_WORKERS__C__CLIENT__REMOTE=c.example:443"},
+			t:       &Config{},
+			err:     "$MITSUYU_WORKERS__C__CLIENT__REMOTE: no element C",
+		},
+	}
+	for _, tt := range tests {
+		root, err := parseJSON("client.json", []byte(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := tt.t.(*Config); ok {
+			root.remove("local")
+			root.remove("tls")
+			root.remove("inbounds")
+		} else {
+			root.remove("workers")
+		}
+		err = applyEnv(root, reflect.TypeOf(tt.t), tt.environ)
+		if tt.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+				t.Errorf("%s: error %v, expect %s", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got, _ := json.Marshal(root.plain()); string(got) != tt.want {
+			t.Errorf("%s: %s, expect %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+// the environment overrides the file, errors are located at the variable
+func TestLoadConfigEnv(t *testing.T) {
+	dir := t.TempDir()
+	file := writeConfig(t, dir, "client.yaml", "local: \":1080\"\nremote: example.com:443\n")
+	t.Setenv("MITSUYU_REMOTE", "env.example:443")
+	t.Setenv("MITSUYU_TLS_VERIFY", "false")
+	var c ClientConfig
+	if err := LoadClientConfig(file, &c, nil); err != nil {
+		t.Fatal(err)
+	}
+	if c.Remote != "env.example:443" || BoolOr(c.TLSVerify, true) {
+		t.Errorf("remote %s tls_verify %v, expect env.example:443 false", c.Remote, BoolOr(c.TLSVerify, true))
+	}
+	t.Setenv("MITSUYU_TUN_MTU", "10")
+	err := LoadClientConfig(file, &ClientConfig{}, nil)
+	if ce, path := fieldPath(err); ce == nil || ce.File != "$MITSUYU_TUN_MTU" || path != "tun_mtu" {
+		t.Errorf("error %v, expect tun_mtu at $MITSUYU_TUN_MTU", err)
+	}
+}
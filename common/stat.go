@@ -1,6 +1,8 @@
 package common
 
 import (
+	"fmt"
+	"io/ioutil"
 	"sync"
 	"time"
 )
@@ -30,46 +32,68 @@ func (s *Statistician) Config(b bool) {
 	s.enable = b
 }
 
+// SetLimit changes the limits in bytes per second, 0 is unlimited
+func (s *Statistician) SetLimit(uplimit, downlimit int) {
+	s.uplock.Lock()
+	s.uplimit = uplimit
+	s.uplock.Unlock()
+	s.downlock.Lock()
+	s.downlimit = downlimit
+	s.downlock.Unlock()
+}
+
+func (s *Statistician) GetLimit() (int, int) {
+	s.uplock.Lock()
+	defer s.uplock.Unlock()
+	s.downlock.Lock()
+	defer s.downlock.Unlock()
+	return s.uplimit, s.downlimit
+}
+
 func (s *Statistician) Restore(up, down uint64) {
 	s.uptraffic = up
 	s.downtraffic = down
 }
 
+// RecordUplink counts n if enabled, and holds the caller back to the
+// limit in any case
 func (s *Statistician) RecordUplink(n int) {
+	s.uplock.Lock()
+	defer s.uplock.Unlock()
 	if s.enable {
-		s.uplock.Lock()
-		defer s.uplock.Unlock()
 		s.uptraffic += uint64(n)
-		if s.uplimit == 0 {
-			return
-		}
-		if s.upleft -= n; s.upleft < 0 {
-			now := time.Now()
-			if now.Before(s.uprefresh) {
-				time.Sleep(s.uprefresh.Sub(now))
-			}
-			s.upleft = s.uplimit
-			s.uprefresh = time.Now().Add(1 * time.Second)
+	}
+	if s.uplimit == 0 {
+		return
+	}
+	if s.upleft -= n; s.upleft < 0 {
+		now := time.Now()
+		if now.Before(s.uprefresh) {
+			time.Sleep(s.uprefresh.Sub(now))
 		}
+		s.upleft = s.uplimit
+		s.uprefresh = time.Now().Add(1 * time.Second)
 	}
 }
 
+// RecordDownlink counts n if enabled, and holds the caller back to the
+// limit in any case
 func (s *Statistician) RecordDownlink(n int) {
+	s.downlock.Lock()
+	defer s.downlock.Unlock()
 	if s.enable {
-		s.downlock.Lock()
-		defer s.downlock.Unlock()
 		s.downtraffic += uint64(n)
-		if s.downlimit == 0 {
-			return
-		}
-		if s.downleft -= n; s.downleft < 0 {
-			now := time.Now()
-			if now.Before(s.downrefresh) {
-				time.Sleep(s.downrefresh.Sub(now))
-			}
-			s.downleft = s.downlimit
-			s.downrefresh = time.Now().Add(1 * time.Second)
+	}
+	if s.downlimit == 0 {
+		return
+	}
+	if s.downleft -= n; s.downleft < 0 {
+		now := time.Now()
+		if now.Before(s.downrefresh) {
+			time.Sleep(s.downrefresh.Sub(now))
 		}
+		s.downleft = s.downlimit
+		s.downrefresh = time.Now().Add(1 * time.Second)
 	}
 }
 
@@ -81,6 +105,30 @@ func (s *Statistician) StopRecord() {
 	s.enable = false
 }
 
+// Recording reports whether traffic is counted
+func (s *Statistician) Recording() bool {
+	s.uplock.Lock()
+	defer s.uplock.Unlock()
+	return s.enable
+}
+
 func (s *Statistician) GetTraffic() (uint64, uint64) {
 	return s.uptraffic, s.downtraffic
 }
+
+// LoadTraffic reads traffic saved by SaveTraffic
+func LoadTraffic(file string) (uint64, uint64, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return 0, 0, err
+	}
+	var up, down uint64
+	if _, err = fmt.Sscanf(string(content), "%d,%d", &up, &down); err != nil {
+		return 0, 0, err
+	}
+	return up, down, nil
+}
+
+func SaveTraffic(file string, up, down uint64) error {
+	return ioutil.WriteFile(file, []byte(fmt.Sprintf("%d,%d\n", up, down)), 0644)
+}
@@ -0,0 +1,63 @@
+package common
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// outcome of the outbound dial, sent back to client in grpc header
+const (
+	STATUS_OK               = "ok"
+	STATUS_FAILURE          = "failure"
+	STATUS_NOT_ALLOWED      = "not_allowed"
+	STATUS_NET_UNREACHABLE  = "network_unreachable"
+	STATUS_HOST_UNREACHABLE = "host_unreachable"
+	STATUS_REFUSED          = "refused"
+	STATUS_TTL_EXPIRED      = "ttl_expired"
+	// the status follows in the stream
+	STATUS_PENDING = "pending"
+)
+
+type StatusError struct {
+	Status string
+	Err    error
+}
+
+func (e *StatusError) Error() string {
+	if e.Err == nil {
+		return e.Status
+	}
+	return e.Status + ", " + e.Err.Error()
+}
+
+func (e *StatusError) Unwrap() error {
+	return e.Err
+}
+
+func StatusFromError(err error) string {
+	if err == nil {
+		return STATUS_OK
+	}
+	var se *StatusError
+	if errors.As(err, &se) {
+		return se.Status
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return STATUS_HOST_UNREACHABLE
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return STATUS_TTL_EXPIRED
+	}
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return STATUS_REFUSED
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return STATUS_HOST_UNREACHABLE
+	case errors.Is(err, syscall.ENETUNREACH):
+		return STATUS_NET_UNREACHABLE
+	}
+	return STATUS_FAILURE
+}
@@ -0,0 +1,86 @@
+package common
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+)
+
+// SignedList is published at the subscription url, the signature covers
+// the list as encoded, so it is verified before decoding
+type SignedList struct {
+	// base64 of ServerList in json
+	List string `json:"list"`
+	// base64 of the ed25519 signature of the decoded list
+	Signature string `json:"signature"`
+}
+
+type ServerList struct {
+	// unix seconds, a list older than the current one is rejected
+	Updated int64 `json:"updated"`
+	// share links
+	Servers []string `json:"servers"`
+}
+
+// SignList encodes the list signed by key
+func SignList(list *ServerList, key ed25519.PrivateKey) ([]byte, error) {
+	for _, link := range list.Servers {
+		if _, _, err := ParseLink(link); err != nil {
+			return nil, err
+		}
+	}
+	content, err := json.Marshal(list)
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(&SignedList{
+		List:      base64.StdEncoding.EncodeToString(content),
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(key, content)),
+	}, "", "  ")
+}
+
+// VerifyList decodes the signed list if the signature matches key,
+// every server must be a valid share link
+func VerifyList(content []byte, key ed25519.PublicKey) (*ServerList, error) {
+	var signed SignedList
+	if err := json.Unmarshal(content, &signed); err != nil {
+		return nil, fmt.Errorf("Subscribe: Invalid list, %v", err)
+	}
+	list, err := base64.StdEncoding.DecodeString(signed.List)
+	if err != nil {
+		return nil, fmt.Errorf("Subscribe: Invalid list, %v", err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(signed.Signature)
+	if err != nil || !ed25519.Verify(key, list, sig) {
+		return nil, fmt.Errorf("Subscribe: Invalid signature")
+	}
+	var servers ServerList
+	if err = json.Unmarshal(list, &servers); err != nil {
+		return nil, fmt.Errorf("Subscribe: Invalid list, %v", err)
+	}
+	for _, link := range servers.Servers {
+		if _, _, err := ParseLink(link); err != nil {
+			return nil, err
+		}
+	}
+	return &servers, nil
+}
+
+// ParsePublicKey decodes an ed25519 public key in base64
+func ParsePublicKey(s string) (ed25519.PublicKey, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(b) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid ed25519 public key %s", s)
+	}
+	return ed25519.PublicKey(b), nil
+}
+
+// ParsePrivateKey decodes an ed25519 private key in base64
+func ParsePrivateKey(s string) (ed25519.PrivateKey, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(b) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("invalid ed25519 private key")
+	}
+	return ed25519.PrivateKey(b), nil
+}
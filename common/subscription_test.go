@@ -0,0 +1,106 @@
+package common
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestVerifyList(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPub, otherPriv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := &ServerList{Updated: 1700000000, Servers: []string{
+		"mitsuyu://a.example:443/svc?tls=1#a",
+		"mitsuyu://192.0.2.1:80/#b",
+	}}
+	signed, err := SignList(list, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the list modified after signing
+	var tampered SignedList
+	json.Unmarshal(signed, &tampered)
+	content, _ := base64.StdEncoding.DecodeString(tampered.List)
+	content = []byte(strings.Replace(string(content), "a.example", "evil.example", 1))
+	tampered.List = base64.StdEncoding.EncodeToString(content)
+	tamperedContent, _ := json.Marshal(&tampered)
+	// a valid signature over an invalid link
+	content, _ = json.Marshal(&ServerList{Updated: 1, Servers: []string{"https://a.example/"}})
+	badLink, _ := json.Marshal(&SignedList{
+		List:      base64.StdEncoding.EncodeToString(content),
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(priv, content)),
+	})
+	otherSigned, err := SignList(list, otherPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		content []byte
+		key     ed25519.PublicKey
+		err     string
+	}{
+		{"valid", signed, pub, ""},
+		{"other key", signed, otherPub, "Invalid signature"},
+		{"signed by another key", otherSigned, pub, "Invalid signature"},
+		{"tampered", tamperedContent, pub, "Invalid signature"},
+		{"invalid link", badLink, pub, "Link:"},
+		{"no signature", []byte(`{"list": "e30="}`), pub, "Invalid signature"},
+		{"not base64", []byte(`{"list": "!", "signature": ""}`), pub, "Invalid list"},
+		{"not json", []byte("servers"), pub, "Invalid list"},
+	}
+	for _, tt := range tests {
+		got, err := VerifyList(tt.content, tt.key)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: error %v, expect %s", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if got.Updated != list.Updated || strings.Join(got.Servers, " ") != strings.Join(list.Servers, " ") {
+			t.Errorf("%s: %+v, expect %+v", tt.name, got, list)
+		}
+	}
+}
+
+func TestSignList(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = SignList(&ServerList{Servers: []string{"mitsuyu://a.example/"}}, priv); err == nil {
+		t.Errorf("SignList of an invalid link: expect an error")
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k, err := ParsePublicKey(base64.StdEncoding.EncodeToString(pub)); err != nil || !k.Equal(pub) {
+		t.Errorf("ParsePublicKey = %v %v", k, err)
+	}
+	if k, err := ParsePrivateKey(base64.StdEncoding.EncodeToString(priv)); err != nil || !k.Equal(priv) {
+		t.Errorf("ParsePrivateKey = %v %v", k, err)
+	}
+	// a private key is not a public key
+	for _, s := range []string{base64.StdEncoding.EncodeToString(priv), "!", ""} {
+		if _, err := ParsePublicKey(s); err == nil {
+			t.Errorf("ParsePublicKey(%q): expect an error", s)
+		}
+	}
+	if _, err := ParsePrivateKey(base64.StdEncoding.EncodeToString(pub)); err == nil {
+		t.Errorf("ParsePrivateKey of a public key: expect an error")
+	}
+}
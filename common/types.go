@@ -7,45 +7,143 @@ type Addr struct {
 }
 
 type Strategy struct {
-	DNS           string `json:"dns,omitempty"`        // "8.8.8.8:53"
-	Next          string `json:"next,omitempty"`       // "1.1.1.1:443"
-	Block         string `json:"block,omitempty"`      // "true","false"
+	DNS           string `json:"dns,omitempty"`  // "8.8.8.8:53"
+	Next          string `json:"next,omitempty"` // "1.1.1.1:443"
+	Block         Bool   `json:"block,omitempty"`
 	IPRange       string `json:"ip_range,omitempty"`   // "192.168.1.1/28"
 	PortRange     string `json:"port_range,omitempty"` //80, 443, 8080-8082
 	DomainPrefix  string `json:"domain_prefix,omitempty"`
 	DomainSuffix  string `json:"domain_suffix,omitempty"`
 	DomainContain string `json:"domain_contain,omitempty"`
+	// default true
+	Sniff *Bool `json:"sniff,omitempty"`
+}
+
+type User struct {
+	Username string `json:"user,omitempty"`
+	Password string `json:"pass,omitempty"`
+	// override client settings
+	Remote        string      `json:"remote,omitempty"`
+	StrategyGroup []*Strategy `json:"strategy,omitempty"`
+}
+
+type Forward struct {
+	Local string `json:"local,omitempty"`
+	Dest  string `json:"dest,omitempty"`
+	// override client settings
+	Remote        string      `json:"remote,omitempty"`
+	StrategyGroup []*Strategy `json:"strategy,omitempty"`
+}
+
+type Inbound struct {
+	// socks5, http, mixed, redirect, unix, forward, tproxy, tun
+	Type string `json:"type,omitempty"`
+	// address, unix socket path or tun device name
+	Listen    string `json:"listen,omitempty"`
+	DualStack Bool   `json:"dual_stack,omitempty"`
+	// forward only
+	Dest string `json:"dest,omitempty"`
+	// tun only
+	MTU   Int     `json:"mtu,omitempty"`
+	Users []*User `json:"users,omitempty"`
+	// override client settings
+	Remote        string      `json:"remote,omitempty"`
+	StrategyGroup []*Strategy `json:"strategy,omitempty"`
+}
+
+type Reverse struct {
+	// listen on the server
+	Port string `json:"port,omitempty"`
+	// dial on the client
+	Dest string `json:"dest,omitempty"`
+	// override client settings
+	Remote string `json:"remote,omitempty"`
 }
 
 type ServerConfig struct {
+	Version  Int    `json:"version,omitempty"`
 	LogLevel string `json:"log,omitempty"`
 	//
 	Addr        string `json:"listen,omitempty"`
 	ServiceName string `json:"service_name,omitempty"`
 	//
-	TLS     string `json:"tls,omitempty"`
+	TLS     Bool   `json:"tls,omitempty"`
 	TLSCert string `json:"tls_cert,omitempty"`
 	TLSKey  string `json:"tls_key,omitempty"`
+	//
+	ReverseHost  string `json:"reverse_host,omitempty"`
+	ReversePorts string `json:"reverse_ports,omitempty"`
+	// number in seconds
+	Drain Duration `json:"drain,omitempty"`
 }
 
 type ClientConfig struct {
+	Version  Int    `json:"version,omitempty"`
 	LogLevel string `json:"log,omitempty"`
 	//
 	Local       string `json:"local,omitempty"`
+	DualStack   Bool   `json:"dual_stack,omitempty"`
+	TProxy      string `json:"tproxy,omitempty"`
+	Tun         string `json:"tun,omitempty"`
+	TunMTU      Int    `json:"tun_mtu,omitempty"`
 	Remote      string `json:"remote,omitempty"`
 	ServiceName string `json:"service_name,omitempty"`
 	//
-	TLS       string `json:"tls,omitempty"`
-	TLSCA     string `json:"tls_ca,omitempty"`
-	TLSSNI    string `json:"tls_sni,omitempty"`
-	TLSVerify string `json:"tls_verify,omitempty"`
+	TLS    Bool   `json:"tls,omitempty"`
+	TLSCA  string `json:"tls_ca,omitempty"`
+	TLSSNI string `json:"tls_sni,omitempty"`
+	// sha256 of a certificate the server sends, trusted instead of tls_ca
+	TLSPin string `json:"tls_pin,omitempty"`
+	// default true
+	TLSVerify *Bool `json:"tls_verify,omitempty"`
+	//
+	Compress Bool `json:"compress,omitempty"`
+	//
+	SniffLimit Int `json:"sniff_limit,omitempty"`
+	// number in milliseconds
+	SniffTimeout   Duration `json:"sniff_timeout,omitempty"`
+	SniffSkipPorts string   `json:"sniff_skip_ports,omitempty"`
+	// default true, socks and http CONNECT are replied once the server
+	// dialed, before any data, so they are not sniffed
+	DeferReply *Bool `json:"defer_reply,omitempty"`
+	//
+	Users []*User `json:"users,omitempty"`
+	//
+	Forwards []*Forward `json:"forward,omitempty"`
 	//
-	Compress string `json:"compress,omitempty"`
+	Inbounds []*Inbound `json:"inbounds,omitempty"`
 	//
-	Padding string `json:"padding,omitempty"`
+	Reverses []*Reverse `json:"reverse,omitempty"`
 	//
-	UpLimit   string `json:"upload_limit,omitempty"`
-	DownLimit string `json:"download_limit,omitempty"`
+	Padding Int `json:"padding,omitempty"`
+	//
+	UpLimit   Int    `json:"upload_limit,omitempty"`
+	DownLimit Int    `json:"download_limit,omitempty"`
+	StatsFile string `json:"stats_file,omitempty"`
+	// number in seconds
+	Drain Duration `json:"drain,omitempty"`
+	// https url of a signed list of servers, which replace remote if not empty
+	Subscribe string `json:"subscribe,omitempty"`
+	// ed25519 public key of the list in base64
+	SubscribeKey string `json:"subscribe_key,omitempty"`
+	// number in seconds
+	SubscribeInterval Duration `json:"subscribe_interval,omitempty"`
+	// the last good list, the client starts with it if offline
+	SubscribeCache string `json:"subscribe_cache,omitempty"`
 	//
 	StrategyGroup []*Strategy `json:"strategy,omitempty"`
 }
+
+type WorkerConfig struct {
+	// unique in the config
+	Name string `json:"name,omitempty"`
+	// either server or client
+	Server *ServerConfig `json:"server,omitempty"`
+	Client *ClientConfig `json:"client,omitempty"`
+}
+
+// Config describes several workers run by one process
+type Config struct {
+	Version Int             `json:"version,omitempty"`
+	Workers []*WorkerConfig `json:"workers,omitempty"`
+}
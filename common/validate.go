@@ -0,0 +1,275 @@
+package common
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+func (c *Config) Validate() error {
+	if err := validateVersion(c.Version); err != nil {
+		return err
+	}
+	names := make(map[string]bool)
+	for i, w := range c.Workers {
+		path := fmt.Sprintf("workers[%d]", i)
+		if w.Name == "" {
+			return fieldErrorf(path+".name", "require a name")
+		}
+		if names[w.Name] {
+			return fieldErrorf(path+".name", "duplicate name %s", w.Name)
+		}
+		names[w.Name] = true
+		var err error
+		switch {
+		case w.Server != nil && w.Client != nil:
+			return fieldErrorf(path, "require either server or client")
+		case w.Server != nil:
+			path += ".server"
+			err = w.Server.Validate()
+		case w.Client != nil:
+			path += ".client"
+			err = w.Client.Validate()
+		default:
+			return fieldErrorf(path, "require either server or client")
+		}
+		if e, ok := err.(*FieldError); ok {
+			return &FieldError{Path: path + "." + e.Path, Err: e.Err}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *ServerConfig) Validate() error {
+	if err := validateVersion(c.Version); err != nil {
+		return err
+	}
+	if err := validateLogLevel(c.LogLevel); err != nil {
+		return err
+	}
+	if c.Addr == "" {
+		return fieldErrorf("listen", "require an address")
+	}
+	if c.TLS && (c.TLSCert == "" || c.TLSKey == "") {
+		return fieldErrorf("tls", "require tls_cert and tls_key")
+	}
+	if err := validatePortRange("reverse_ports", c.ReversePorts); err != nil {
+		return err
+	}
+	if c.Drain.Or(1, 0) < 0 {
+		return fieldErrorf("drain", "must not be negative")
+	}
+	return nil
+}
+
+func (c *ClientConfig) Validate() error {
+	if err := validateVersion(c.Version); err != nil {
+		return err
+	}
+	if err := validateLogLevel(c.LogLevel); err != nil {
+		return err
+	}
+	if c.Local == "" && len(c.Inbounds) == 0 {
+		return fieldErrorf("local", "require local or inbounds")
+	}
+	// subscribed servers replace remote
+	if c.Remote == "" && c.Subscribe == "" {
+		return fieldErrorf("remote", "require an address")
+	}
+	if _, err := ParseAddr(c.Remote); c.Remote != "" && err != nil {
+		return fieldErrorf("remote", "invalid address %s", c.Remote)
+	}
+	if err := c.validateSubscribe(); err != nil {
+		return err
+	}
+	if c.TLSPin != "" && !validPin(c.TLSPin) {
+		return fieldErrorf("tls_pin", "invalid pin %s, expect sha256 in hex", c.TLSPin)
+	}
+	if c.TunMTU != 0 && (c.TunMTU < 576 || c.TunMTU > 65535) {
+		return fieldErrorf("tun_mtu", "out of range 576-65535")
+	}
+	for _, f := range []struct {
+		path string
+		n    Int
+	}{
+		{"sniff_limit", c.SniffLimit},
+		{"padding", c.Padding},
+		{"upload_limit", c.UpLimit},
+		{"download_limit", c.DownLimit},
+	} {
+		if f.n < 0 {
+			return fieldErrorf(f.path, "must not be negative")
+		}
+	}
+	if c.SniffTimeout.Or(1, 0) < 0 {
+		return fieldErrorf("sniff_timeout", "must not be negative")
+	}
+	if c.Drain.Or(1, 0) < 0 {
+		return fieldErrorf("drain", "must not be negative")
+	}
+	if err := validatePortRange("sniff_skip_ports", c.SniffSkipPorts); err != nil {
+		return err
+	}
+	if err := validateUsers("users", c.Users); err != nil {
+		return err
+	}
+	for i, f := range c.Forwards {
+		path := fmt.Sprintf("forward[%d]", i)
+		if f.Local == "" {
+			return fieldErrorf(path+".local", "require an address")
+		}
+		if _, err := ParseAddr(f.Dest); err != nil {
+			return fieldErrorf(path+".dest", "invalid address %s", f.Dest)
+		}
+		if err := validateStrategyGroup(path+".strategy", f.StrategyGroup); err != nil {
+			return err
+		}
+	}
+	for i, ib := range c.Inbounds {
+		if err := ib.validate(fmt.Sprintf("inbounds[%d]", i)); err != nil {
+			return err
+		}
+	}
+	for i, r := range c.Reverses {
+		path := fmt.Sprintf("reverse[%d]", i)
+		if port, err := strconv.Atoi(r.Port); err != nil || port <= 0 || port > 65535 {
+			return fieldErrorf(path+".port", "invalid port %s", r.Port)
+		}
+		if _, err := ParseAddr(r.Dest); err != nil {
+			return fieldErrorf(path+".dest", "invalid address %s", r.Dest)
+		}
+	}
+	return validateStrategyGroup("strategy", c.StrategyGroup)
+}
+
+func (c *ClientConfig) validateSubscribe() error {
+	if c.Subscribe == "" {
+		return nil
+	}
+	if u, err := url.Parse(c.Subscribe); err != nil || u.Scheme != "https" || u.Host == "" {
+		return fieldErrorf("subscribe", "invalid url %s, expect https", c.Subscribe)
+	}
+	if c.SubscribeKey == "" {
+		return fieldErrorf("subscribe_key", "require the public key of the list")
+	}
+	if _, err := ParsePublicKey(c.SubscribeKey); err != nil {
+		return fieldErrorf("subscribe_key", "%v", err)
+	}
+	if c.SubscribeInterval.Or(1, 0) < 0 {
+		return fieldErrorf("subscribe_interval", "must not be negative")
+	}
+	return nil
+}
+
+func (ib *Inbound) validate(path string) error {
+	switch ib.Type {
+	case "socks5", "http", "mixed", "redirect", "unix", "tproxy", "tun":
+	case "forward":
+		if _, err := ParseAddr(ib.Dest); err != nil {
+			return fieldErrorf(path+".dest", "invalid address %s", ib.Dest)
+		}
+	default:
+		return fieldErrorf(path+".type", "invalid inbound type %s", ib.Type)
+	}
+	if ib.Listen == "" {
+		return fieldErrorf(path+".listen", "require an address")
+	}
+	if ib.MTU != 0 && (ib.MTU < 576 || ib.MTU > 65535) {
+		return fieldErrorf(path+".mtu", "out of range 576-65535")
+	}
+	if err := validateUsers(path+".users", ib.Users); err != nil {
+		return err
+	}
+	return validateStrategyGroup(path+".strategy", ib.StrategyGroup)
+}
+
+func validateVersion(version Int) error {
+	if version < 0 || version > CONFIGVERSION {
+		return fieldErrorf("version", "unsupported version %d, up to %d", version, CONFIGVERSION)
+	}
+	return nil
+}
+
+func validateLogLevel(level string) error {
+	switch level {
+	case "", "none", "error", "info", "debug":
+		return nil
+	}
+	return fieldErrorf("log", "invalid log level %s", level)
+}
+
+func validateUsers(path string, users []*User) error {
+	for i, u := range users {
+		sub := fmt.Sprintf("%s[%d]", path, i)
+		if u.Username == "" {
+			return fieldErrorf(sub+".user", "require a username")
+		}
+		if err := validateStrategyGroup(sub+".strategy", u.StrategyGroup); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateStrategyGroup(path string, group []*Strategy) error {
+	for i, s := range group {
+		sub := fmt.Sprintf("%s[%d]", path, i)
+		if s.DNS != "" {
+			if _, err := ParseAddr(s.DNS); err != nil {
+				return fieldErrorf(sub+".dns", "invalid address %s", s.DNS)
+			}
+		}
+		if s.Next != "" {
+			if _, err := ParseAddr(s.Next); err != nil {
+				return fieldErrorf(sub+".next", "invalid address %s", s.Next)
+			}
+		}
+		for _, r := range splitList(s.IPRange) {
+			if _, _, err := net.ParseCIDR(r); err != nil {
+				return fieldErrorf(sub+".ip_range", "invalid cidr %s", r)
+			}
+		}
+		if err := validatePortRange(sub+".port_range", s.PortRange); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validatePortRange checks ports like "80, 443, 8080-8082"
+func validatePortRange(path, portRange string) error {
+	for _, r := range splitList(portRange) {
+		bounds := strings.Split(r, "-")
+		if len(bounds) > 2 {
+			return fieldErrorf(path, "invalid port range %s", r)
+		}
+		var ports []int
+		for _, b := range bounds {
+			port, err := strconv.Atoi(strings.TrimSpace(b))
+			if err != nil || port < 0 || port > 65535 {
+				return fieldErrorf(path, "invalid port range %s", r)
+			}
+			ports = append(ports, port)
+		}
+		if len(ports) == 2 && ports[0] > ports[1] {
+			return fieldErrorf(path, "invalid port range %s", r)
+		}
+	}
+	return nil
+}
+
+// splitList splits comma separated values, empty ones are dropped
+func splitList(s string) []string {
+	var ss []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			ss = append(ss, v)
+		}
+	}
+	return ss
+}
@@ -0,0 +1,82 @@
+package common
+
+import "testing"
+
+func TestClientConfigValidate(t *testing.T) {
+	valid := func() *ClientConfig {
+		return &ClientConfig{Local: ":1080", Remote: "example.com:443"}
+	}
+	tests := []struct {
+		name   string
+		modify func(c *ClientConfig)
+		// empty if valid
+		path string
+	}{
+		{"valid", func(c *ClientConfig) {}, ""},
+		{"inbounds only", func(c *ClientConfig) { c.Local, c.Inbounds = "", []*Inbound{{Type: "mixed", Listen: ":1080"}} }, ""},
+		{"no local", func(c *ClientConfig) { c.Local = "" }, "local"},
+		{"invalid remote", func(c *ClientConfig) { c.Remote = "example.com" }, "remote"},
+		{"subscribe replaces remote", func(c *ClientConfig) { c.Remote, c.Subscribe = "", "http://example.com/list" }, "subscribe"},
+		{"invalid pin", func(c *ClientConfig) { c.TLSPin = "abc" }, "tls_pin"},
+		{"negative sniff limit", func(c *ClientConfig) { c.SniffLimit = -1 }, "sniff_limit"},
+		{"negative upload limit", func(c *ClientConfig) { c.UpLimit = -1 }, "upload_limit"},
+		{"tun mtu", func(c *ClientConfig) { c.TunMTU = 70000 }, "tun_mtu"},
+		{"sniff skip ports", func(c *ClientConfig) { c.SniffSkipPorts = "80, 443-" }, "sniff_skip_ports"},
+		{"user without name", func(c *ClientConfig) { c.Users = []*User{{Username: "al"}, {Password: "secret"}} }, "users[1].user"},
+		{"forward dest", func(c *ClientConfig) { c.Forwards = []*Forward{{Local: ":53", Dest: "8.8.8.8"}} }, "forward[0].dest"},
+		{"inbound type", func(c *ClientConfig) { c.Inbounds = []*Inbound{{Type: "socks4", Listen: ":1081"}} }, "inbounds[0].type"},
+		{"forward inbound dest", func(c *ClientConfig) { c.Inbounds = []*Inbound{{Type: "forward", Listen: ":53"}} }, "inbounds[0].dest"},
+		{"reverse port", func(c *ClientConfig) { c.Reverses = []*Reverse{{Port: "0", Dest: "127.0.0.1:22"}} }, "reverse[0].port"},
+		{
+			"strategy cidr",
+			func(c *ClientConfig) {
+				c.StrategyGroup = []*Strategy{{IPRange: "10.0.0.0/8"}, {IPRange: "10.0.0.0/8, 192.168.1.1"}}
+			},
+			"strategy[1].ip_range",
+		},
+		{
+			"inbound user strategy",
+			func(c *ClientConfig) {
+				c.Inbounds = []*Inbound{{Type: "http", Listen: ":8080", Users: []*User{{Username: "al", StrategyGroup: []*Strategy{{Next: "a"}}}}}}
+			},
+			"inbounds[0].users[0].strategy[0].next",
+		},
+	}
+	for _, tt := range tests {
+		c := valid()
+		tt.modify(c)
+		err := c.Validate()
+		if tt.path == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+			continue
+		}
+		if e, ok := err.(*FieldError); !ok || e.Path != tt.path {
+			t.Errorf("%s: error %v, expect a FieldError at %s", tt.name, err, tt.path)
+		}
+	}
+}
+
+func TestValidatePortRange(t *testing.T) {
+	tests := []struct {
+		portRange string
+		valid     bool
+	}{
+		{"", true},
+		{"80", true},
+		{"80, 443, 8080-8082", true},
+		{" 80 ,, 443 ", true},
+		{"0-65535", true},
+		{"8082-8080", false},
+		{"80-90-100", false},
+		{"65536", false},
+		{"http", false},
+		{"-1", false},
+	}
+	for _, tt := range tests {
+		if err := validatePortRange("ports", tt.portRange); (err == nil) != tt.valid {
+			t.Errorf("validatePortRange(%q) = %v, expect valid %v", tt.portRange, err, tt.valid)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// typed config values, which also accept the string form of old configs,
+// e.g. "true" for true and "1000" for 1000
+
+type Bool bool
+
+func (b *Bool) UnmarshalJSON(data []byte) error {
+	s, _ := unquote(data)
+	switch s {
+	case "true":
+		*b = true
+	case "false", "null", "":
+		*b = false
+	default:
+		return fmt.Errorf("invalid boolean %s", data)
+	}
+	return nil
+}
+
+// BoolOr returns def if b is not set
+func BoolOr(b *Bool, def bool) bool {
+	if b == nil {
+		return def
+	}
+	return bool(*b)
+}
+
+type Int int
+
+func (i *Int) UnmarshalJSON(data []byte) error {
+	s, quoted := unquote(data)
+	if s == "null" || (s == "" && quoted) {
+		*i = 0
+		return nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return fmt.Errorf("invalid integer %s", data)
+	}
+	*i = Int(n)
+	return nil
+}
+
+// Duration is either a string like "300ms" and "5s", or a number,
+// whose unit is decided by the field
+type Duration struct {
+	d    time.Duration
+	n    int64
+	bare bool
+	set  bool
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	s, quoted := unquote(data)
+	*d = Duration{}
+	if s == "null" || (s == "" && quoted) {
+		return nil
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		*d = Duration{n: n, bare: true, set: true}
+		return nil
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil || !quoted {
+		return fmt.Errorf("invalid duration %s", data)
+	}
+	*d = Duration{d: v, set: true}
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	if d.bare {
+		return []byte(strconv.FormatInt(d.n, 10)), nil
+	}
+	if !d.set {
+		return []byte(`""`), nil
+	}
+	return json.Marshal(d.d.String())
+}
+
+// Or returns the duration, a number is measured in unit, def if not set
+func (d Duration) Or(unit, def time.Duration) time.Duration {
+	if !d.set {
+		return def
+	}
+	if d.bare {
+		return time.Duration(d.n) * unit
+	}
+	return d.d
+}
+
+func (d Duration) IsSet() bool {
+	return d.set
+}
+
+func unquote(data []byte) (string, bool) {
+	data = bytes.TrimSpace(data)
+	if len(data) >= 2 && data[0] == '"' {
+		var s string
+		if err := json.Unmarshal(data, &s); err == nil {
+			return s, true
+		}
+	}
+	return string(data), false
+}
@@ -0,0 +1,117 @@
+package common
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestBool(t *testing.T) {
+	tests := []struct {
+		data string
+		want Bool
+		err  bool
+	}{
+		{`true`, true, false},
+		{`false`, false, false},
+		{`null`, false, false},
+		// old configs
+		{`"true"`, true, false},
+		{`"false"`, false, false},
+		{`""`, false, false},
+		{`1`, false, true},
+		{`"yes"`, false, true},
+	}
+	for _, tt := range tests {
+		b := Bool(!tt.want)
+		err := json.Unmarshal([]byte(tt.data), &b)
+		if tt.err {
+			if err == nil {
+				t.Errorf("Bool %s: expect an error", tt.data)
+			}
+		} else if err != nil || b != tt.want {
+			t.Errorf("Bool %s = %v %v, expect %v", tt.data, b, err, tt.want)
+		}
+	}
+}
+
+func TestInt(t *testing.T) {
+	tests := []struct {
+		data string
+		want Int
+		err  bool
+	}{
+		{`1000`, 1000, false},
+		{`-1`, -1, false},
+		{`null`, 0, false},
+		// old configs
+		{`"1000"`, 1000, false},
+		{`""`, 0, false},
+		{`1.5`, 0, true},
+		{`"many"`, 0, true},
+		{`true`, 0, true},
+	}
+	for _, tt := range tests {
+		i := Int(7)
+		err := json.Unmarshal([]byte(tt.data), &i)
+		if tt.err {
+			if err == nil {
+				t.Errorf("Int %s: expect an error", tt.data)
+			}
+		} else if err != nil || i != tt.want {
+			t.Errorf("Int %s = %d %v, expect %d", tt.data, i, err, tt.want)
+		}
+	}
+}
+
+func TestDuration(t *testing.T) {
+	tests := []struct {
+		data string
+		// measured in milliseconds if a number, 1h if not set
+		want time.Duration
+		set  bool
+		err  bool
+	}{
+		{`300`, 300 * time.Millisecond, true, false},
+		{`"300ms"`, 300 * time.Millisecond, true, false},
+		{`"5s"`, 5 * time.Second, true, false},
+		{`0`, 0, true, false},
+		// old configs
+		{`"300"`, 300 * time.Millisecond, true, false},
+		{`""`, time.Hour, false, false},
+		{`null`, time.Hour, false, false},
+		{`"soon"`, 0, false, true},
+		{`1.5`, 0, false, true},
+	}
+	for _, tt := range tests {
+		var d Duration
+		err := json.Unmarshal([]byte(tt.data), &d)
+		if tt.err {
+			if err == nil {
+				t.Errorf("Duration %s: expect an error", tt.data)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Duration %s: %v", tt.data, err)
+			continue
+		}
+		if got := d.Or(time.Millisecond, time.Hour); got != tt.want || d.IsSet() != tt.set {
+			t.Errorf("Duration %s = %v set %v, expect %v set %v", tt.data, got, d.IsSet(), tt.want, tt.set)
+		}
+	}
+}
+
+// durations are written back in the form they are read
+func TestDurationMarshal(t *testing.T) {
+	for _, data := range []string{`300`, `"5s"`, `""`} {
+		var d Duration
+		if err := json.Unmarshal([]byte(data), &d); err != nil {
+			t.Errorf("Duration %s: %v", data, err)
+			continue
+		}
+		if b, err := json.Marshal(d); err != nil || string(b) != data {
+			t.Errorf("Duration %s marshals to %s %v", data, b, err)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"mitsuyu/common"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// files written by genconf
+const (
+	CAFILE      = "ca.pem"
+	CAKEYFILE   = "ca.key"
+	CERTFILE    = "server.pem"
+	KEYFILE     = "server.key"
+	SERVERCONF  = "server.json"
+	CLIENTCONF  = "client.json"
+	GENCONFDAYS = 3650
+)
+
+type genconfOptions struct {
+	hosts  string
+	listen string
+	remote string
+	local  string
+	out    string
+	days   int
+	force  bool
+}
+
+func newGenconfFlagSet() (*flag.FlagSet, *genconfOptions) {
+	o := &genconfOptions{}
+	fs := flag.NewFlagSet("genconf", flag.ExitOnError)
+	fs.StringVar(&o.hosts, "hosts", "", "domain names and ips of the server, separate by comma, required")
+	fs.StringVar(&o.listen, "listen", "0.0.0.0:443", "listen address of the server")
+	fs.StringVar(&o.remote, "remote", "", "remote address of the client, default the first host with the listen port")
+	fs.StringVar(&o.local, "local", "127.0.0.1:1080", "local address of the client")
+	fs.StringVar(&o.out, "out", ".", "output directory")
+	fs.IntVar(&o.days, "days", GENCONFDAYS, "days the certificates are valid")
+	fs.BoolVar(&o.force, "force", false, "overwrite existing files")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: mitsuyu genconf -hosts example.com,203.0.113.1 [flags]\n\n")
+		fmt.Fprintf(fs.Output(), "writes %s, %s, %s, %s, %s and %s,\n", CAFILE, CAKEYFILE, CERTFILE, KEYFILE, SERVERCONF, CLIENTCONF)
+		fmt.Fprintf(fs.Output(), "keep %s offline, it issues certificates the clients trust\n\n", CAKEYFILE)
+		fs.PrintDefaults()
+	}
+	return fs, o
+}
+
+func runGenconf(args []string) int {
+	fs, o := newGenconfFlagSet()
+	fs.Parse(args)
+	hosts := splitHosts(o.hosts)
+	if len(hosts) == 0 || fs.NArg() > 0 {
+		fs.Usage()
+		return 2
+	}
+	if err := genconf(o, hosts); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	return 0
+}
+
+// genconf writes a private CA, a server certificate for the hosts,
+// and server and client configs with a random service name and user
+func genconf(o *genconfOptions, hosts []string) error {
+	_, port, err := net.SplitHostPort(o.listen)
+	if err != nil {
+		return fmt.Errorf("Genconf: Invalid listen address %s", o.listen)
+	}
+	remote := o.remote
+	if remote == "" {
+		remote = net.JoinHostPort(hosts[0], port)
+	}
+	remoteHost, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		return fmt.Errorf("Genconf: Invalid remote address %s", remote)
+	}
+	// the client verifies the remote host by default
+	sni := hosts[0]
+	for _, h := range hosts {
+		if h == remoteHost {
+			sni = ""
+		}
+	}
+	if err = os.MkdirAll(o.out, 0755); err != nil {
+		return err
+	}
+	if !o.force {
+		for _, name := range []string{CAFILE, CAKEYFILE, CERTFILE, KEYFILE, SERVERCONF, CLIENTCONF} {
+			if _, err := os.Stat(filepath.Join(o.out, name)); err == nil {
+				return fmt.Errorf("Genconf: %s exists, overwrite with -force", filepath.Join(o.out, name))
+			}
+		}
+	}
+
+	ca, caKey, err := common.GenerateCA("Mitsuyu CA", o.days)
+	if err != nil {
+		return err
+	}
+	cert, key, err := common.IssueCert(ca, caKey, hosts, o.days)
+	if err != nil {
+		return err
+	}
+	caKeyPEM, err := common.EncodeKey(caKey)
+	if err != nil {
+		return err
+	}
+	keyPEM, err := common.EncodeKey(key)
+	if err != nil {
+		return err
+	}
+
+	random, err := randomBytes(28)
+	if err != nil {
+		return err
+	}
+	serviceName := hex.EncodeToString(random[:8])
+	username := "user-" + hex.EncodeToString(random[8:12])
+	password := base64.RawURLEncoding.EncodeToString(random[12:])
+	// the fields in the order of the samples
+	server := struct {
+		Version     int    `json:"version"`
+		LogLevel    string `json:"log"`
+		Addr        string `json:"listen"`
+		ServiceName string `json:"service_name"`
+		TLS         bool   `json:"tls"`
+		TLSCert     string `json:"tls_cert"`
+		TLSKey      string `json:"tls_key"`
+	}{common.CONFIGVERSION, "info", o.listen, serviceName, true, CERTFILE, KEYFILE}
+	client := struct {
+		Version     int            `json:"version"`
+		LogLevel    string         `json:"log"`
+		Local       string         `json:"local"`
+		Remote      string         `json:"remote"`
+		ServiceName string         `json:"service_name"`
+		TLS         bool           `json:"tls"`
+		TLSCA       string         `json:"tls_ca"`
+		TLSSNI      string         `json:"tls_sni,omitempty"`
+		Users       []*common.User `json:"users"`
+	}{common.CONFIGVERSION, "info", o.local, remote, serviceName, true, CAFILE, sni,
+		[]*common.User{{Username: username, Password: password}}}
+	serverJSON, err := json.MarshalIndent(server, "", "  ")
+	if err != nil {
+		return err
+	}
+	clientJSON, err := json.MarshalIndent(client, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	for _, f := range []struct {
+		name    string
+		content []byte
+		private bool
+	}{
+		{CAFILE, common.EncodeCert(ca), false},
+		{CAKEYFILE, caKeyPEM, true},
+		// clients pinning the ca need it in the chain
+		{CERTFILE, append(common.EncodeCert(cert), common.EncodeCert(ca)...), false},
+		{KEYFILE, keyPEM, true},
+		{SERVERCONF, append(serverJSON, '\n'), true},
+		{CLIENTCONF, append(clientJSON, '\n'), true},
+	} {
+		mode := os.FileMode(0644)
+		if f.private {
+			mode = 0600
+		}
+		if err = ioutil.WriteFile(filepath.Join(o.out, f.name), f.content, mode); err != nil {
+			return err
+		}
+	}
+
+	// the configs must pass the checks they are deployed with
+	var s common.ServerConfig
+	if err = common.LoadServerConfig(filepath.Join(o.out, SERVERCONF), &s, nil); err != nil {
+		return err
+	}
+	var c common.ClientConfig
+	if err = common.LoadClientConfig(filepath.Join(o.out, CLIENTCONF), &c, nil); err != nil {
+		return err
+	}
+	fmt.Printf("server: %s %s %s, run mitsuyu server -c %s\n", SERVERCONF, CERTFILE, KEYFILE, SERVERCONF)
+	fmt.Printf("client: %s %s, run mitsuyu client -c %s\n", CLIENTCONF, CAFILE, CLIENTCONF)
+	fmt.Printf("paths are relative, run in the directory of the files, keep %s offline\n", CAKEYFILE)
+	return nil
+}
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	return b, err
+}
+
+// splitHosts splits hosts separated by comma
+func splitHosts(hosts string) []string {
+	var hs []string
+	for _, h := range strings.Split(hosts, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			hs = append(hs, h)
+		}
+	}
+	return hs
+}
@@ -1,10 +1,26 @@
 module mitsuyu
 
-go 1.16
+go 1.20
 
 require (
-	github.com/gizak/termui/v3 v3.1.0 // indirect
-	github.com/golang/protobuf v1.4.3 // indirect
-	google.golang.org/grpc v1.36.0 // indirect
-	google.golang.org/protobuf v1.25.0 // indirect
+	github.com/BurntSushi/toml v1.3.2
+	github.com/gizak/termui/v3 v3.1.0
+	github.com/golang/protobuf v1.5.2
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
+	golang.org/x/net v0.15.0
+	google.golang.org/grpc v1.53.0
+	google.golang.org/protobuf v1.30.0
+	gopkg.in/yaml.v3 v3.0.1
+	gvisor.dev/gvisor v0.0.0-20230927004350-cbd86285d259
+)
+
+require (
+	github.com/google/btree v1.0.1 // indirect
+	github.com/mattn/go-runewidth v0.0.2 // indirect
+	github.com/mitchellh/go-wordwrap v0.0.0-20150314170334-ad45545899c7 // indirect
+	github.com/nsf/termbox-go v0.0.0-20190121233118-02980233997d // indirect
+	golang.org/x/sys v0.12.0 // indirect
+	golang.org/x/text v0.13.0 // indirect
+	golang.org/x/time v0.0.0-20220210224613-90d013bbcef8 // indirect
+	google.golang.org/genproto v0.0.0-20230110181048-76db0878b65f // indirect
 )
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"mitsuyu/common"
+	"os"
+)
+
+func runLink(args []string) int {
+	if len(args) > 0 {
+		switch args[0] {
+		case "export":
+			return runLinkExport(args[1:])
+		case "import":
+			return runLinkImport(args[1:])
+		}
+	}
+	printLinkUsage()
+	return 2
+}
+
+func printLinkUsage() {
+	fmt.Println("usage: mitsuyu link export [-name name] [-qr] [-worker name] [client flags]")
+	fmt.Println("       mitsuyu link import [-o client.json] [-local addr] [-force] <link>")
+	fmt.Println()
+	fmt.Println("a link carries remote, service_name, tls, tls_sni, tls_pin, tls_verify, compress and padding,")
+	fmt.Println("tls_ca is shared as tls_pin, the server must send the ca along with its certificate")
+}
+
+// runLinkExport prints the link of a client config
+func runLinkExport(args []string) int {
+	fs, o := newFlagSet("client")
+	name := fs.String("name", "", "label of the link")
+	qr := fs.Bool("qr", false, "also render a qr code")
+	worker := fs.String("worker", "", "client of a combined config, default the first one")
+	fs.Parse(args)
+	conf, err := loadShared(o, *worker)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	link, err := common.ConfigLink(conf, *name)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	if *qr {
+		code, err := common.LinkQR(link)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		fmt.Print(code)
+	}
+	fmt.Println(link)
+	return 0
+}
+
+// loadShared loads the client config to share
+func loadShared(o *options, worker string) (*common.ClientConfig, error) {
+	combined, err := common.IsCombinedConfig(o.config)
+	if err != nil {
+		return nil, err
+	}
+	if !combined {
+		var c common.ClientConfig
+		if err = common.LoadClientConfig(o.config, &c, o.flags); err != nil {
+			return nil, err
+		}
+		return &c, nil
+	}
+	if o.flags.IsSet() {
+		return nil, fmt.Errorf("flags of fields do not apply to combined configs")
+	}
+	var conf common.Config
+	if err = common.LoadConfig(o.config, &conf); err != nil {
+		return nil, err
+	}
+	for _, w := range conf.Workers {
+		if w.Client != nil && (worker == "" || w.Name == worker) {
+			return w.Client, nil
+		}
+	}
+	return nil, fmt.Errorf("no client %s in %s", worker, o.config)
+}
+
+// runLinkImport writes a client config from a link
+func runLinkImport(args []string) int {
+	fs := flag.NewFlagSet("link import", flag.ExitOnError)
+	out := fs.String("o", "client.json", "config file to write")
+	local := fs.String("local", "127.0.0.1:1080", "local address of the client")
+	force := fs.Bool("force", false, "overwrite the config file")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		printLinkUsage()
+		return 2
+	}
+	shared, name, err := common.ParseLink(fs.Arg(0))
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	if _, err := os.Stat(*out); err == nil && !*force {
+		fmt.Printf("%s exists, overwrite with -force\n", *out)
+		return 1
+	}
+	// the fields in the order of the samples
+	conf := struct {
+		Version     int          `json:"version"`
+		LogLevel    string       `json:"log"`
+		Local       string       `json:"local"`
+		Remote      string       `json:"remote"`
+		ServiceName string       `json:"service_name,omitempty"`
+		TLS         bool         `json:"tls,omitempty"`
+		TLSSNI      string       `json:"tls_sni,omitempty"`
+		TLSPin      string       `json:"tls_pin,omitempty"`
+		TLSVerify   *common.Bool `json:"tls_verify,omitempty"`
+		Compress    bool         `json:"compress,omitempty"`
+		Padding     int          `json:"padding,omitempty"`
+	}{common.CONFIGVERSION, "info", *local, shared.Remote, shared.ServiceName, bool(shared.TLS),
+		shared.TLSSNI, shared.TLSPin, shared.TLSVerify, bool(shared.Compress), int(shared.Padding)}
+	content, err := json.MarshalIndent(conf, "", "  ")
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	if err = ioutil.WriteFile(*out, append(content, '\n'), 0600); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	var c common.ClientConfig
+	if err = common.LoadClientConfig(*out, &c, nil); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	if name != "" {
+		fmt.Printf("imported %s to %s\n", name, *out)
+	} else {
+		fmt.Printf("imported to %s\n", *out)
+	}
+	return 0
+}
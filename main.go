@@ -1,7 +1,6 @@
 package main
 
 import (
-	"flag"
 	"fmt"
 	"mitsuyu/api"
 	"mitsuyu/client"
@@ -10,70 +9,54 @@ import (
 	"mitsuyu/server"
 	"mitsuyu/terminal"
 	"os"
-	"strconv"
+	"os/signal"
+	"syscall"
 )
 
 const VERSION = "v1.0.0"
 
-var (
-	version = flag.Bool("v", false, "show version")
-
-	apii  = flag.String("api", "", "local api addr")
-	token = flag.String("token", "", "local api token")
-
-	mode   = flag.String("m", "", "mode, server/client/client_terminal")
-	local  = flag.String("l", "", "listen addr, [client] support socks5/http")
-	remote = flag.String("r", "", "[client] remote addr")
-	sname  = flag.String("sname", "", "service name [path=/service_name/proxy]")
-
-	tls      = flag.Bool("tls", false, "enable tls")
-	sni      = flag.String("tls-sni", "", "[client]server name")
-	verify   = flag.Bool("tls-verify", false, "[client] enable verify")
-	cafile   = flag.String("tls-verify-ca", "", "[client] specify ca-file")
-	certfile = flag.String("tls-cert", "cert.pem", "[server] certificate")
-	keyfile  = flag.String("tls-key", "key.pem", "[server] private key")
-
-	compress = flag.Bool("compress", false, "[client] enable compress")
-	config   = flag.String("c", "", "config file")
-	color    = flag.String("color", "black", "terminal background color")
-)
-
-func init() {
-	flag.Parse()
-}
-
 func main() {
-	if *version {
-		fmt.Println(VERSION)
-		os.Exit(0)
+	args := legacyArgs(os.Args[1:])
+	if len(args) == 0 {
+		printUsage()
+		os.Exit(2)
+	}
+	cmd := findCommand(args[0])
+	if cmd == nil {
+		fmt.Printf("unknown command %s\n\n", args[0])
+		printUsage()
+		os.Exit(2)
 	}
+	os.Exit(cmd.run(args[1:]))
+}
+
+// runWorkers runs the workers until SIGINT or SIGTERM, SIGHUP reloads the config
+func runWorkers(o *options) int {
 	m := manager.NewManager()
-	if *mode == "server" && *config == "" {
-		loadSingleServer(m)
-	} else if *mode == "server" && *config != "" {
-		loadServer(m)
-	} else if (*mode == "client" || *mode == "client_terminal") && *config == "" {
-		loadSingleClient(m)
-	} else if (*mode == "client" || *mode == "client_terminal") && *config != "" {
-		loadClient(m)
-	} else {
-		fmt.Println("use cmd flags or specify config file")
-		os.Exit(0)
+	if err := loadConfig(m, o); err != nil {
+		fmt.Println(err)
+		return 1
 	}
-	m.Start()
-	if (*mode == "client" || *mode == "client_terminal") && *apii != "" {
-		a := api.NewApi(m, *apii, *token)
-		a.Serve()
+	m.SetReloader(func() (*manager.Manager, error) {
+		n := manager.NewManager()
+		return n, loadConfig(n, o)
+	})
+	if o.kind != "server" && o.api != "" && m.GetClient() != nil {
+		a := api.NewApi(m, o.api, o.token)
+		if err := a.Serve(); err != nil {
+			// the workers keep running without api
+			fmt.Println(err)
+		}
 	}
-	if *mode == "client_terminal" || *apii != "" {
+	if o.kind == "terminal" || o.api != "" {
 		m.StartConnector()
 		m.StartStatistician()
 	}
-	if *mode == "client_terminal" {
-		t, err := terminal.NewTerminal(m, *color, 0.2, 0.7)
+	if o.kind == "terminal" && m.GetClient() != nil {
+		t, err := terminal.NewTerminal(m, o.color, 0.2, 0.7)
 		if err != nil {
 			fmt.Println(err)
-			os.Exit(0)
+			return 1
 		}
 		r := manager.NewLogRecorder()
 		m.SetRecorder(r)
@@ -82,68 +65,89 @@ func main() {
 	} else {
 		m.StartLog(os.Stdout)
 	}
-	select {}
+	m.Start()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for s := <-sig; s == syscall.SIGHUP; s = <-sig {
+		// errors are logged by manager
+		m.Reload()
+	}
+	// a second signal exits immediately
+	go func() {
+		<-sig
+		os.Exit(1)
+	}()
+	m.Stop()
+	m.StopLog()
+	return 0
 }
 
-func loadServer(m *manager.Manager) {
-	var s common.ServerConfig
-	if err := common.LoadServerConfig(*config, &s); err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+// loadConfig loads a combined config, or a single worker of the kind
+// from the config file and the flags
+func loadConfig(m *manager.Manager, o *options) error {
+	if o.config == "" && !o.flags.IsSet() {
+		return fmt.Errorf("specify a config file or flags, see mitsuyu help %s", o.kind)
 	}
-	ss, err := server.New(&s)
+	combined, err := common.IsCombinedConfig(o.config)
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		return err
 	}
-	m.Add(ss)
+	if combined {
+		if o.flags.IsSet() {
+			return fmt.Errorf("flags of fields do not apply to combined configs")
+		}
+		var conf common.Config
+		if err = common.LoadConfig(o.config, &conf); err != nil {
+			return err
+		}
+		return loadWorkers(m, &conf)
+	}
+	if o.kind == "server" {
+		return loadServer(m, o)
+	}
+	return loadClient(m, o)
 }
 
-func loadSingleServer(m *manager.Manager) {
-	conf := &common.ServerConfig{
-		Addr:        *local,
-		ServiceName: *sname,
-		TLS:         strconv.FormatBool(*tls),
-		TLSCert:     *certfile,
-		TLSKey:      *keyfile,
-	}
-	s, err := server.New(conf)
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+func loadWorkers(m *manager.Manager, conf *common.Config) error {
+	// validated by LoadConfig
+	for _, w := range conf.Workers {
+		var worker manager.Worker
+		var err error
+		if w.Server != nil {
+			worker, err = server.New(w.Server)
+		} else {
+			worker, err = client.New(w.Client)
+		}
+		if err == nil {
+			err = m.Add(w.Name, worker)
+		}
+		if err != nil {
+			return fmt.Errorf("Worker: %s, %v", w.Name, err)
+		}
 	}
-	m.Add(s)
+	return nil
 }
 
-func loadClient(m *manager.Manager) {
-	var c common.ClientConfig
-	if err := common.LoadClientConfig(*config, &c); err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+func loadServer(m *manager.Manager, o *options) error {
+	var s common.ServerConfig
+	if err := common.LoadServerConfig(o.config, &s, o.flags); err != nil {
+		return err
 	}
-	cc, err := client.New(&c)
+	ss, err := server.New(&s)
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		return err
 	}
-	m.Add(cc)
+	return m.Add("server", ss)
 }
 
-func loadSingleClient(m *manager.Manager) {
-	conf := &common.ClientConfig{
-		Local:       *local,
-		Remote:      *remote,
-		ServiceName: *sname,
-		TLS:         strconv.FormatBool(*tls),
-		TLSCA:       *cafile,
-		TLSSNI:      *sni,
-		TLSVerify:   strconv.FormatBool(*verify),
-		Compress:    strconv.FormatBool(*compress),
-	}
-	c, err := client.New(conf)
+func loadClient(m *manager.Manager, o *options) error {
+	var c common.ClientConfig
+	if err := common.LoadClientConfig(o.config, &c, o.flags); err != nil {
+		return err
+	}
+	cc, err := client.New(&c)
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		return err
 	}
-	m.Add(c)
+	return m.Add("client", cc)
 }
@@ -1,30 +1,78 @@
 package manager
 
 import (
+	"fmt"
 	"io"
+	"io/ioutil"
 	"mitsuyu/client"
 	"mitsuyu/common"
+	"sync"
+	"time"
+)
+
+const (
+	STATE_STARTING = "starting"
+	STATE_RUNNING  = "running"
+	STATE_FAILED   = "failed"
+	STATE_STOPPED  = "stopped"
+)
+
+const (
+	// a worker is running if Run does not return in time
+	STARTUPTIME = 1 * time.Second
+	MINBACKOFF  = 1 * time.Second
+	MAXBACKOFF  = 1 * time.Minute
 )
 
 type Worker interface {
-	Run()
-	Stop()
+	// Run serves until stop is closed, the error stops serving
+	Run(stop <-chan struct{}) error
+	// Reload takes the settings of a worker built from the new config,
+	// and reports whether a restart is required
+	Reload(w interface{}) (bool, error)
 	GetLogger() *common.Logger
 }
 
+type entry struct {
+	worker Worker
+	state  string
+	err    error
+	// nil if not supervised
+	stop   chan struct{}
+	exited chan struct{}
+}
+
+// Manager is a registry of named workers, which are
+// started, stopped and restarted individually;
+// failed workers are restarted with exponential backoff
 type Manager struct {
-	worker   Worker
+	names    []string
+	entries  map[string]*entry
+	lock     sync.Mutex
 	recorder *LogRecorder
-	//conns    *common.Connector
-	//stats    *common.Statistician
+	log      io.Writer
+	logging  bool
+	// recording of workers added by Reload
+	recordConns bool
+	recordStats bool
+	// builds the workers from the config
+	reloader   func() (*Manager, error)
+	reloadLock sync.Mutex
 }
 
 func NewManager() *Manager {
-	return &Manager{}
+	return &Manager{entries: make(map[string]*entry), log: ioutil.Discard}
 }
 
-func (m *Manager) Add(worker Worker) {
-	m.worker = worker
+func (m *Manager) Add(name string, worker Worker) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, ok := m.entries[name]; ok {
+		return fmt.Errorf("Manager: Duplicate worker %s", name)
+	}
+	m.names = append(m.names, name)
+	m.entries[name] = &entry{worker: worker, state: STATE_STOPPED}
+	return nil
 }
 
 func (m *Manager) SetRecorder(r *LogRecorder) {
@@ -35,75 +83,262 @@ func (m *Manager) GetRecorder() *LogRecorder {
 	return m.recorder
 }
 
-func (m *Manager) GetWorker() Worker {
-	return m.worker
+// GetNames returns the names in the order of adding
+func (m *Manager) GetNames() []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([]string(nil), m.names...)
+}
+
+func (m *Manager) GetWorker(name string) Worker {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if e, ok := m.entries[name]; ok {
+		return e.worker
+	}
+	return nil
+}
+
+// GetState returns the state and the last error of the worker
+func (m *Manager) GetState(name string) (string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if e, ok := m.entries[name]; ok {
+		return e.state, e.err
+	}
+	return "", fmt.Errorf("Manager: Unknown worker %s", name)
+}
+
+// IsRunning reports whether the worker is supervised,
+// it may be starting or waiting for restart
+func (m *Manager) IsRunning(name string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	e, ok := m.entries[name]
+	return ok && e.stop != nil
 }
 
+// GetClient returns the first client
 func (m *Manager) GetClient() *client.Client {
-	if c, ok := m.worker.(*client.Client); ok {
+	for _, name := range m.GetNames() {
+		if c := m.GetClientByName(name); c != nil {
+			return c
+		}
+	}
+	return nil
+}
+
+func (m *Manager) GetClientByName(name string) *client.Client {
+	if c, ok := m.GetWorker(name).(*client.Client); ok {
 		return c
 	}
 	return nil
 }
 
+// GetConnector returns the connector of the first client
 func (m *Manager) GetConnector() *common.Connector {
-	if c, ok := m.worker.(*client.Client); ok {
+	if c := m.GetClient(); c != nil {
 		return c.GetConnector()
 	}
 	return nil
 }
 
+// GetStatistician returns the statistician of the first client
 func (m *Manager) GetStatistician() *common.Statistician {
-	if c, ok := m.worker.(*client.Client); ok {
+	if c := m.GetClient(); c != nil {
+		return c.GetStatistician()
+	}
+	return nil
+}
+
+func (m *Manager) GetConnectorByName(name string) *common.Connector {
+	if c := m.GetClientByName(name); c != nil {
+		return c.GetConnector()
+	}
+	return nil
+}
+
+func (m *Manager) GetStatisticianByName(name string) *common.Statistician {
+	if c := m.GetClientByName(name); c != nil {
 		return c.GetStatistician()
 	}
 	return nil
 }
 
 func (m *Manager) Start() {
-	if m.worker != nil {
-		go m.worker.Run()
+	for _, name := range m.GetNames() {
+		m.StartWorker(name)
 	}
 }
 
+// Stop stops the workers in parallel, so they drain together
 func (m *Manager) Stop() {
-	if m.worker != nil {
-		m.worker.Stop()
+	wg := new(sync.WaitGroup)
+	for _, name := range m.GetNames() {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			m.StopWorker(name)
+		}(name)
+	}
+	wg.Wait()
+}
+
+func (m *Manager) StartWorker(name string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	e, ok := m.entries[name]
+	if !ok {
+		return fmt.Errorf("Manager: Unknown worker %s", name)
+	}
+	if e.stop != nil {
+		return fmt.Errorf("Manager: Worker %s is running", name)
+	}
+	e.stop = make(chan struct{}, 0)
+	e.exited = make(chan struct{}, 0)
+	e.state, e.err = STATE_STARTING, nil
+	go m.supervise(name, e, e.stop, e.exited)
+	return nil
+}
+
+// StopWorker returns after the worker exits
+func (m *Manager) StopWorker(name string) error {
+	m.lock.Lock()
+	e, ok := m.entries[name]
+	if !ok {
+		m.lock.Unlock()
+		return fmt.Errorf("Manager: Unknown worker %s", name)
+	}
+	stop, exited := e.stop, e.exited
+	e.stop, e.exited = nil, nil
+	m.lock.Unlock()
+	if stop == nil {
+		return fmt.Errorf("Manager: Worker %s is not running", name)
+	}
+	close(stop)
+	<-exited
+	return nil
+}
+
+// supervise runs the worker until stop is closed
+func (m *Manager) supervise(name string, e *entry, stop, exited chan struct{}) {
+	defer close(exited)
+	backoff := MINBACKOFF
+	for {
+		m.setState(e, STATE_STARTING, nil)
+		result := make(chan error, 1)
+		go func() {
+			result <- e.worker.Run(stop)
+		}()
+		var err error
+		select {
+		case err = <-result:
+		case <-time.After(STARTUPTIME):
+			m.setState(e, STATE_RUNNING, nil)
+			backoff = MINBACKOFF
+			err = <-result
+		}
+		select {
+		case <-stop:
+			m.setState(e, STATE_STOPPED, nil)
+			return
+		default:
+		}
+		if err == nil {
+			m.setState(e, STATE_STOPPED, nil)
+			m.logf(name, "Manager: Worker exited\n")
+			return
+		}
+		m.setState(e, STATE_FAILED, err)
+		m.logf(name, "Manager: %v, restart in %v\n", err, backoff)
+		select {
+		case <-stop:
+			m.setState(e, STATE_STOPPED, err)
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > MAXBACKOFF {
+			backoff = MAXBACKOFF
+		}
+	}
+}
+
+func (m *Manager) setState(e *entry, state string, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	e.state, e.err = state, err
+}
+
+func (m *Manager) logf(name, format string, a ...interface{}) {
+	m.lock.Lock()
+	w := m.log
+	m.lock.Unlock()
+	fmt.Fprintf(w, "["+name+"] "+format, a...)
+}
+
+func (m *Manager) RestartWorker(name string) error {
+	if m.IsRunning(name) {
+		if err := m.StopWorker(name); err != nil {
+			return err
+		}
 	}
+	return m.StartWorker(name)
 }
 
+// StartLog aggregates logs of all workers into dst,
+// each line is prefixed with the worker name if there are several
 func (m *Manager) StartLog(dst io.Writer) {
-	if m.worker != nil {
-		go m.worker.GetLogger().StartLog(dst)
+	names := m.GetNames()
+	lw := &logWriter{dst: dst}
+	m.lock.Lock()
+	m.log = lw
+	m.logging = true
+	m.lock.Unlock()
+	for _, name := range names {
+		var w io.Writer = lw
+		if len(names) > 1 {
+			w = &prefixWriter{prefix: "[" + name + "] ", w: lw}
+		}
+		go m.GetWorker(name).GetLogger().StartLog(w)
 	}
 }
 
 func (m *Manager) StopLog() {
-	if m.worker != nil {
-		m.worker.GetLogger().StopLog()
+	for _, name := range m.GetNames() {
+		m.GetWorker(name).GetLogger().StopLog()
 	}
 }
 
 func (m *Manager) StartConnector() {
-	if conns := m.GetConnector(); conns != nil {
-		go conns.StartRecord()
+	m.recordConns = true
+	for _, name := range m.GetNames() {
+		if conns := m.GetConnectorByName(name); conns != nil {
+			go conns.StartRecord()
+		}
 	}
 }
 
 func (m *Manager) StopConnector() {
-	if conns := m.GetConnector(); conns != nil {
-		conns.StopRecord()
+	for _, name := range m.GetNames() {
+		if conns := m.GetConnectorByName(name); conns != nil {
+			conns.StopRecord()
+		}
 	}
 }
 
 func (m *Manager) StartStatistician() {
-	if stats := m.GetStatistician(); stats != nil {
-		go stats.StartRecord()
+	m.recordStats = true
+	for _, name := range m.GetNames() {
+		if stats := m.GetStatisticianByName(name); stats != nil {
+			go stats.StartRecord()
+		}
 	}
 }
 
 func (m *Manager) StopStatistician() {
-	if stats := m.GetStatistician(); stats != nil {
-		stats.StopRecord()
+	for _, name := range m.GetNames() {
+		if stats := m.GetStatisticianByName(name); stats != nil {
+			stats.StopRecord()
+		}
 	}
 }
@@ -0,0 +1,128 @@
+package manager
+
+import (
+	"fmt"
+)
+
+// SetReloader sets how Reload builds the workers from the config
+func (m *Manager) SetReloader(reloader func() (*Manager, error)) {
+	m.reloader = reloader
+}
+
+// Reload builds the workers from the config and applies them: new
+// workers are started, missing ones are stopped, and the others take
+// the new settings in place, restarting only if their listeners change
+func (m *Manager) Reload() (err error) {
+	m.reloadLock.Lock()
+	defer m.reloadLock.Unlock()
+	defer func() {
+		if err != nil {
+			m.logf("manager", "%v\n", err)
+		}
+	}()
+	if m.reloader == nil {
+		return fmt.Errorf("Manager: Reload requires a config file")
+	}
+	n, err := m.reloader()
+	if err != nil {
+		return fmt.Errorf("Manager: Reload failed, %v", err)
+	}
+	for _, name := range m.GetNames() {
+		if n.GetWorker(name) == nil {
+			m.remove(name)
+			m.logf(name, "Manager: Removed\n")
+		}
+	}
+	for _, name := range n.GetNames() {
+		w := n.GetWorker(name)
+		old := m.GetWorker(name)
+		if old == nil {
+			m.Add(name, w)
+			m.attach(name, w)
+			m.StartWorker(name)
+			m.logf(name, "Manager: Added\n")
+			continue
+		}
+		restart, rerr := old.Reload(w)
+		if rerr != nil {
+			// server turns into client or vice versa
+			m.replace(name, w)
+			m.logf(name, "Manager: Replaced\n")
+			continue
+		}
+		if restart && m.IsRunning(name) {
+			m.logf(name, "Manager: Restart for new listeners\n")
+			if err = m.RestartWorker(name); err != nil {
+				return err
+			}
+		}
+		m.logf(name, "Manager: Reloaded\n")
+	}
+	return nil
+}
+
+// attach starts logging and recording of w as the others
+func (m *Manager) attach(name string, w Worker) {
+	m.lock.Lock()
+	lw, logging := m.log, m.logging
+	m.lock.Unlock()
+	if logging {
+		go w.GetLogger().StartLog(&prefixWriter{prefix: "[" + name + "] ", w: lw})
+	}
+	if m.recordConns || m.recordStats {
+		if c := m.GetClientByName(name); c != nil {
+			if m.recordConns {
+				go c.GetConnector().StartRecord()
+			}
+			if m.recordStats {
+				go c.GetStatistician().StartRecord()
+			}
+		}
+	}
+}
+
+// detach stops what attach starts
+func (m *Manager) detach(name string, w Worker) {
+	m.lock.Lock()
+	logging := m.logging
+	m.lock.Unlock()
+	if logging {
+		w.GetLogger().StopLog()
+	}
+	if c := m.GetClientByName(name); c != nil {
+		c.GetConnector().StopRecord()
+		c.GetStatistician().StopRecord()
+	}
+}
+
+func (m *Manager) remove(name string) {
+	w := m.GetWorker(name)
+	if m.IsRunning(name) {
+		m.StopWorker(name)
+	}
+	m.detach(name, w)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.entries, name)
+	for i, n := range m.names {
+		if n == name {
+			m.names = append(m.names[:i], m.names[i+1:]...)
+			break
+		}
+	}
+}
+
+func (m *Manager) replace(name string, w Worker) {
+	running := m.IsRunning(name)
+	if running {
+		m.StopWorker(name)
+	}
+	m.detach(name, m.GetWorker(name))
+	m.lock.Lock()
+	m.entries[name].worker = w
+	m.lock.Unlock()
+	m.attach(name, w)
+	if running {
+		m.StartWorker(name)
+	}
+}
@@ -2,6 +2,8 @@ package manager
 
 import (
 	"fmt"
+	"io"
+	"sync"
 )
 
 type LogRecorder struct {
@@ -25,3 +27,27 @@ func (r *LogRecorder) Write(b []byte) (n int, err error) {
 func (r *LogRecorder) GetChan() chan string {
 	return r.ch
 }
+
+// logWriter serializes writes of the loggers and the manager
+type logWriter struct {
+	dst  io.Writer
+	lock sync.Mutex
+}
+
+func (w *logWriter) Write(b []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.dst.Write(b)
+}
+
+type prefixWriter struct {
+	prefix string
+	w      io.Writer
+}
+
+func (w *prefixWriter) Write(b []byte) (int, error) {
+	if _, err := w.w.Write(append([]byte(w.prefix), b...)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
@@ -96,12 +96,14 @@ var file_mitsuyu_proto_rawDesc = []byte{
 	0x01, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x04, 0x68, 0x65, 0x61, 0x64, 0x12, 0x12, 0x0a, 0x04, 0x64,
 	0x61, 0x74, 0x61, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x04, 0x64, 0x61, 0x74, 0x61, 0x12,
 	0x12, 0x0a, 0x04, 0x74, 0x61, 0x69, 0x6c, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x04, 0x74,
-	0x61, 0x69, 0x6c, 0x32, 0x26, 0x0a, 0x07, 0x4d, 0x69, 0x74, 0x73, 0x75, 0x79, 0x75, 0x12, 0x1b,
+	0x61, 0x69, 0x6c, 0x32, 0x45, 0x0a, 0x07, 0x4d, 0x69, 0x74, 0x73, 0x75, 0x79, 0x75, 0x12, 0x1b,
 	0x0a, 0x05, 0x70, 0x72, 0x6f, 0x78, 0x79, 0x12, 0x05, 0x2e, 0x44, 0x61, 0x74, 0x61, 0x1a, 0x05,
-	0x2e, 0x44, 0x61, 0x74, 0x61, 0x22, 0x00, 0x28, 0x01, 0x30, 0x01, 0x42, 0x28, 0x5a, 0x26, 0x67,
-	0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x5a, 0x65, 0x70, 0x68, 0x79, 0x72,
-	0x43, 0x68, 0x69, 0x65, 0x6e, 0x2f, 0x4d, 0x69, 0x74, 0x73, 0x75, 0x79, 0x75, 0x2f, 0x6d, 0x69,
-	0x74, 0x73, 0x75, 0x79, 0x75, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+	0x2e, 0x44, 0x61, 0x74, 0x61, 0x22, 0x00, 0x28, 0x01, 0x30, 0x01, 0x12, 0x1d, 0x0a, 0x07, 0x72,
+	0x65, 0x76, 0x65, 0x72, 0x73, 0x65, 0x12, 0x05, 0x2e, 0x44, 0x61, 0x74, 0x61, 0x1a, 0x05, 0x2e,
+	0x44, 0x61, 0x74, 0x61, 0x22, 0x00, 0x28, 0x01, 0x30, 0x01, 0x42, 0x28, 0x5a, 0x26, 0x67, 0x69,
+	0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x5a, 0x65, 0x70, 0x68, 0x79, 0x72, 0x43,
+	0x68, 0x69, 0x65, 0x6e, 0x2f, 0x4d, 0x69, 0x74, 0x73, 0x75, 0x79, 0x75, 0x2f, 0x6d, 0x69, 0x74,
+	0x73, 0x75, 0x79, 0x75, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
 }
 
 var (
@@ -122,9 +124,11 @@ var file_mitsuyu_proto_goTypes = []interface{}{
 }
 var file_mitsuyu_proto_depIdxs = []int32{
 	0, // 0: Mitsuyu.proxy:input_type -> Data
-	0, // 1: Mitsuyu.proxy:output_type -> Data
-	1, // [1:2] is the sub-list for method output_type
-	0, // [0:1] is the sub-list for method input_type
+	0, // 1: Mitsuyu.reverse:input_type -> Data
+	0, // 2: Mitsuyu.proxy:output_type -> Data
+	0, // 3: Mitsuyu.reverse:output_type -> Data
+	2, // [2:4] is the sub-list for method output_type
+	0, // [0:2] is the sub-list for method input_type
 	0, // [0:0] is the sub-list for extension type_name
 	0, // [0:0] is the sub-list for extension extendee
 	0, // [0:0] is the sub-list for field type_name
@@ -21,6 +21,7 @@ const _ = grpc.SupportPackageIsVersion7
 /* ORIGIN
 type MitsuyuClient interface {
 	Proxy(ctx context.Context, opts ...grpc.CallOption) (Mitsuyu_ProxyClient, error)
+	Reverse(ctx context.Context, opts ...grpc.CallOption) (Mitsuyu_ReverseClient, error)
 }
 
 type mitsuyuClient struct {
@@ -30,6 +31,7 @@ type mitsuyuClient struct {
 
 type MitsuyuClient interface {
 	Proxy(ctx context.Context, opts ...grpc.CallOption) (Mitsuyu_ProxyClient, error)
+	Reverse(ctx context.Context, opts ...grpc.CallOption) (Mitsuyu_ReverseClient, error)
 }
 
 type mitsuyuClient struct {
@@ -51,6 +53,15 @@ func (c *mitsuyuClient) Proxy(ctx context.Context, opts ...grpc.CallOption) (Mit
 	x := &mitsuyuProxyClient{stream}
 	return x, nil
 }
+
+func (c *mitsuyuClient) Reverse(ctx context.Context, opts ...grpc.CallOption) (Mitsuyu_ReverseClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Mitsuyu_ServiceDesc.Streams[1], "/Mitsuyu/reverse", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &mitsuyuReverseClient{stream}
+	return x, nil
+}
 */
 
 func (c *mitsuyuClient) Proxy(ctx context.Context, opts ...grpc.CallOption) (Mitsuyu_ProxyClient, error) {
@@ -84,11 +95,43 @@ func (x *mitsuyuProxyClient) Recv() (*Data, error) {
 	return m, nil
 }
 
+func (c *mitsuyuClient) Reverse(ctx context.Context, opts ...grpc.CallOption) (Mitsuyu_ReverseClient, error) {
+	stream, err := c.cc.NewStream(ctx, &genMitsuyu_ServiceDesc(c.serviceName).Streams[1], "/"+c.serviceName+"/reverse", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &mitsuyuReverseClient{stream}
+	return x, nil
+}
+
+type Mitsuyu_ReverseClient interface {
+	Send(*Data) error
+	Recv() (*Data, error)
+	grpc.ClientStream
+}
+
+type mitsuyuReverseClient struct {
+	grpc.ClientStream
+}
+
+func (x *mitsuyuReverseClient) Send(m *Data) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *mitsuyuReverseClient) Recv() (*Data, error) {
+	m := new(Data)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // MitsuyuServer is the server API for Mitsuyu service.
 // All implementations must embed UnimplementedMitsuyuServer
 // for forward compatibility
 type MitsuyuServer interface {
 	Proxy(Mitsuyu_ProxyServer) error
+	Reverse(Mitsuyu_ReverseServer) error
 	mustEmbedUnimplementedMitsuyuServer()
 }
 
@@ -99,6 +142,9 @@ type UnimplementedMitsuyuServer struct {
 func (UnimplementedMitsuyuServer) Proxy(Mitsuyu_ProxyServer) error {
 	return status.Errorf(codes.Unimplemented, "method Proxy not implemented")
 }
+func (UnimplementedMitsuyuServer) Reverse(Mitsuyu_ReverseServer) error {
+	return status.Errorf(codes.Unimplemented, "method Reverse not implemented")
+}
 func (UnimplementedMitsuyuServer) mustEmbedUnimplementedMitsuyuServer() {}
 
 // UnsafeMitsuyuServer may be embedded to opt out of forward compatibility for this service.
@@ -138,6 +184,32 @@ func (x *mitsuyuProxyServer) Recv() (*Data, error) {
 	return m, nil
 }
 
+func _Mitsuyu_Reverse_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(MitsuyuServer).Reverse(&mitsuyuReverseServer{stream})
+}
+
+type Mitsuyu_ReverseServer interface {
+	Send(*Data) error
+	Recv() (*Data, error)
+	grpc.ServerStream
+}
+
+type mitsuyuReverseServer struct {
+	grpc.ServerStream
+}
+
+func (x *mitsuyuReverseServer) Send(m *Data) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *mitsuyuReverseServer) Recv() (*Data, error) {
+	m := new(Data)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // Mitsuyu_ServiceDesc is the grpc.ServiceDesc for Mitsuyu service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -155,6 +227,12 @@ var Mitsuyu_ServiceDesc = grpc.ServiceDesc{
 			ServerStreams: true,
 			ClientStreams: true,
 		},
+		{
+			StreamName:    "reverse",
+			Handler:       _Mitsuyu_Reverse_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
 	},
 	Metadata: "mitsuyu.proto",
 }
@@ -172,6 +250,12 @@ func genMitsuyu_ServiceDesc(serviceName string) *grpc.ServiceDesc {
 				ServerStreams: true,
 				ClientStreams: true,
 			},
+			{
+				StreamName:    "reverse",
+				Handler:       _Mitsuyu_Reverse_Handler,
+				ServerStreams: true,
+				ClientStreams: true,
+			},
 		},
 		Metadata: "mitsuyu.proto",
 	}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"time"
+)
+
+func (s *Server) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+	return s.cert, nil
+}
+
+func (s *Server) getDrain() time.Duration {
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+	return s.drain
+}
+
+// Reload takes the settings of w, which is built from the new config;
+// streams in flight keep going. It reports whether the address,
+// service name or tls mode changed, which requires a restart
+func (s *Server) Reload(w interface{}) (bool, error) {
+	n, ok := w.(*Server)
+	if !ok {
+		return false, fmt.Errorf("Server: Unable to reload from %T", w)
+	}
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+	s.cert = n.cert
+	s.reverseHost = n.reverseHost
+	s.reversePorts = n.reversePorts
+	s.drain = n.drain
+	s.logger.SetLevel(n.logger.GetLevel())
+
+	restart := s.addr != n.addr ||
+		s.serviceName != n.serviceName ||
+		(s.tls == nil) != (n.tls == nil)
+	if restart {
+		s.addr = n.addr
+		s.serviceName = n.serviceName
+		if n.tls != nil {
+			// keep the callback bound to s
+			s.tls = &tls.Config{
+				GetCertificate: s.getCertificate,
+				ClientAuth:     tls.NoClientCert,
+			}
+		} else {
+			s.tls = nil
+		}
+	}
+	return restart, nil
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"google.golang.org/grpc/metadata"
+	"mitsuyu/client"
+	"mitsuyu/common"
+	"mitsuyu/mitsuyu"
+	"mitsuyu/transport"
+	"net"
+	"strconv"
+	"time"
+)
+
+// an incoming connection is closed if no client claims it in time
+const REVERSETIMEOUT = DIALTIMEOUT
+
+// Reverse serves two kinds of streams. A control stream asks to listen on
+// a port and is notified of each incoming connection, while a data stream
+// claims an incoming connection by its id
+func (s *Server) Reverse(stream mitsuyu.Mitsuyu_ReverseServer) error {
+	md, ok := metadata.FromIncomingContext(stream.Context())
+	if !ok {
+		return fmt.Errorf("Reverse: Unknown headers")
+	}
+	if id := md.Get("conn"); len(id) != 0 {
+		return s.reverseConn(id[0], stream)
+	}
+	if port := md.Get("port"); len(port) != 0 {
+		return s.reverseListen(port[0], stream)
+	}
+	return fmt.Errorf("Reverse: Unknown headers")
+}
+
+func (s *Server) reverseListen(port string, stream mitsuyu.Mitsuyu_ReverseServer) error {
+	s.configLock.RLock()
+	reverseHost, reversePorts := s.reverseHost, s.reversePorts
+	s.configLock.RUnlock()
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 1 || p > 65535 {
+		stream.SendHeader(metadata.Pairs("status", common.STATUS_NOT_ALLOWED))
+		return fmt.Errorf("Reverse: Invalid port %s", port)
+	}
+	port = strconv.Itoa(p)
+	if reversePorts == "" || !client.MatchPortRange(port, reversePorts) {
+		stream.SendHeader(metadata.Pairs("status", common.STATUS_NOT_ALLOWED))
+		return fmt.Errorf("Reverse: Port %s not allowed", port)
+	}
+	lis, err := net.Listen("tcp", net.JoinHostPort(reverseHost, port))
+	if err != nil {
+		stream.SendHeader(metadata.Pairs("status", common.StatusFromError(err)))
+		return fmt.Errorf("Reverse: %v", err)
+	}
+	defer lis.Close()
+	if !s.addReverse(lis) {
+		stream.SendHeader(metadata.Pairs("status", common.STATUS_FAILURE))
+		return fmt.Errorf("Reverse: Server is shutting down")
+	}
+	defer s.removeReverse(lis)
+	if err = stream.SendHeader(metadata.Pairs("status", common.STATUS_OK, "bind", lis.Addr().String())); err != nil {
+		return fmt.Errorf("Reverse: %v", err)
+	}
+	// log info
+	s.logger.Infof(fmt.Sprintf("reverse|%s|listen\n", lis.Addr()))
+	// the client stops listening by closing the control stream
+	go func() {
+		for {
+			if _, err := stream.Recv(); err != nil {
+				lis.Close()
+				return
+			}
+		}
+	}()
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			break
+		}
+		id := newConnID()
+		s.lock.Lock()
+		s.pending[id] = conn
+		s.lock.Unlock()
+		time.AfterFunc(REVERSETIMEOUT, func() {
+			if conn := s.claim(id); conn != nil {
+				conn.Close()
+			}
+		})
+		if err = stream.Send(transport.NewConn(id)); err != nil {
+			break
+		}
+	}
+	// log info
+	s.logger.Infof(fmt.Sprintf("reverse|%s|close\n", lis.Addr()))
+	return nil
+}
+
+func (s *Server) reverseConn(id string, stream mitsuyu.Mitsuyu_ReverseServer) error {
+	conn := s.claim(id)
+	if conn == nil {
+		stream.SendHeader(metadata.Pairs("status", common.STATUS_FAILURE))
+		return fmt.Errorf("Reverse: Unknown connection %s", id)
+	}
+	if err := stream.SendHeader(metadata.Pairs("status", common.STATUS_OK, "bind", conn.RemoteAddr().String())); err != nil {
+		conn.Close()
+		return fmt.Errorf("Reverse: %v", err)
+	}
+	if err := relay(conn, stream); err != nil {
+		return fmt.Errorf("Reverse: %v", err)
+	}
+	return nil
+}
+
+func (s *Server) addReverse(lis net.Listener) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closing {
+		return false
+	}
+	s.reverses[lis] = struct{}{}
+	return true
+}
+
+func (s *Server) removeReverse(lis net.Listener) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.reverses, lis)
+}
+
+// closeReverses ends the control streams by closing their listeners,
+// and the incoming connections nobody has claimed
+func (s *Server) closeReverses() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closing = true
+	for lis := range s.reverses {
+		lis.Close()
+	}
+	for id, conn := range s.pending {
+		conn.Close()
+		delete(s.pending, id)
+	}
+}
+
+// claim removes the incoming connection from pending
+func (s *Server) claim(id string) net.Conn {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	conn := s.pending[id]
+	delete(s.pending, id)
+	return conn
+}
+
+func newConnID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
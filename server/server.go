@@ -3,43 +3,75 @@ package server
 import (
 	//"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 	_ "google.golang.org/grpc/encoding/gzip" // install gzip
 	"google.golang.org/grpc/metadata"
+	"io"
 	"mitsuyu/client"
 	"mitsuyu/common"
 	"mitsuyu/mitsuyu"
 	"mitsuyu/transport"
 	"net"
-	"os"
 	"sync"
+	"time"
 )
 
 const BUFFERSIZE = 4096
 
+const UDPBUFFERSIZE = 65535
+
+const DIALTIMEOUT = 10 * time.Second
+
+const UDPTIMEOUT = transport.UDPTIMEOUT
+
+const DRAINTIMEOUT = 5 * time.Second
+
 type Server struct {
-	addr        string
-	serviceName string
-	tls         *tls.Config
-	logger      *common.Logger
-	done        chan struct{}
+	addr         string
+	serviceName  string
+	reverseHost  string
+	reversePorts string
+	pending      map[string]net.Conn
+	// listeners of reverse control streams, refused while closing
+	reverses map[net.Listener]struct{}
+	closing  bool
+	lock     sync.Mutex
+	tls      *tls.Config
+	cert     *tls.Certificate
+	drain    time.Duration
+	// guards the settings swapped by Reload
+	configLock sync.RWMutex
+	logger     *common.Logger
 	mitsuyu.UnimplementedMitsuyuServer
 }
 
 func New(config *common.ServerConfig) (*Server, error) {
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("Common: %v", err)
+	}
 	s := &Server{addr: config.Addr, serviceName: config.ServiceName}
-	if config.TLS == "true" {
+	// reverse tunnels are disabled if no port is allowed
+	s.reverseHost = config.ReverseHost
+	s.reversePorts = config.ReversePorts
+	s.pending = make(map[string]net.Conn)
+	s.reverses = make(map[net.Listener]struct{})
+	if config.TLS {
 		cert, err := tls.LoadX509KeyPair(config.TLSCert, config.TLSKey)
 		if err != nil {
 			return nil, fmt.Errorf("Common: Invalid cert or key")
 		}
+		// the certificate may be swapped by Reload
+		s.cert = &cert
 		s.tls = &tls.Config{
-			Certificates: []tls.Certificate{cert},
-			ClientAuth:   tls.NoClientCert,
+			GetCertificate: s.getCertificate,
+			ClientAuth:     tls.NoClientCert,
 		}
 	}
+	// in-flight streams are closed after drain on shutdown
+	s.drain = config.Drain.Or(time.Second, DRAINTIMEOUT)
 	s.logger = common.NewLogger(config.LogLevel)
 	return s, nil
 }
@@ -52,13 +84,16 @@ func (s *Server) GetLogger() *common.Logger {
 	return s.logger
 }
 
-func (s *Server) Run() {
-	s.done = make(chan struct{}, 0)
+// Run serves until stop is closed and returns nil then,
+// or the error which prevents it from serving
+func (s *Server) Run(stop <-chan struct{}) error {
+	s.lock.Lock()
+	s.closing = false
+	s.lock.Unlock()
 	lis, err := net.Listen("tcp", s.addr)
 	if err != nil {
 		if lis, err = net.Listen("unix", s.addr); err != nil {
-			fmt.Printf("Server: Unable to bind %s, %v\n", s.addr, err)
-			os.Exit(0)
+			return fmt.Errorf("Server: Unable to bind %s, %v", s.addr, err)
 		}
 	}
 	defer lis.Close()
@@ -70,15 +105,23 @@ func (s *Server) Run() {
 	ss := grpc.NewServer(opts...)
 	mitsuyu.RegisterMitsuyuServer(ss, s, s.serviceName)
 	go ss.Serve(lis)
-	defer ss.Stop()
-	<-s.done
-}
-
-func (s *Server) Stop() {
-	defer func() {
-		recover()
+	<-stop
+	// reverse control streams never finish by themselves
+	s.closeReverses()
+	// stop accepting, then wait for streams until the drain period is over
+	graceful := make(chan struct{}, 0)
+	go func() {
+		ss.GracefulStop()
+		close(graceful)
 	}()
-	close(s.done)
+	select {
+	case <-graceful:
+	case <-time.After(s.getDrain()):
+		// log info
+		s.logger.Infof("Server: Drain period is over, close streams\n")
+		ss.Stop()
+	}
+	return nil
 }
 
 // grpc functions
@@ -88,16 +131,59 @@ func (s *Server) Proxy(stream mitsuyu.Mitsuyu_ProxyServer) error {
 		return fmt.Errorf("Proxy: Unknown headers")
 	}
 
+	// a client asking for the status in the stream is answered at once,
+	// which tells it from an older server
+	inStream := len(md.Get("status")) != 0
+	if inStream {
+		if err := stream.SendHeader(metadata.Pairs("status", common.STATUS_PENDING)); err != nil {
+			return fmt.Errorf("Proxy: %v", err)
+		}
+	}
 	// start proxy
 	out, err := decideDestination(md)
 	if err != nil {
+		sendStatus(stream, inStream, common.StatusFromError(err), "")
+		return fmt.Errorf("Proxy: %v", err)
+	}
+	if err = sendStatus(stream, inStream, common.STATUS_OK, bindAddr(out)); err != nil {
+		out.Close()
+		return fmt.Errorf("Proxy: %v", err)
+	}
+	if err = relay(out, stream); err != nil {
 		return fmt.Errorf("Proxy: %v", err)
 	}
-	wg := new(sync.WaitGroup)
-	wg.Add(2)
-	go forward(wg, out, stream)
-	go reverse(wg, out, stream)
-	wg.Wait()
+	return nil
+}
+
+// sendStatus reports the outcome of the dial in the header, or in the
+// stream if asked
+func sendStatus(stream mitsuyu.Mitsuyu_ProxyServer, inStream bool, status, bind string) error {
+	if inStream {
+		return stream.Send(transport.NewStatus(status, bind))
+	}
+	return stream.SendHeader(metadata.Pairs("status", status, "bind", bind))
+}
+
+// relay pumps data between out and the stream until both directions
+// finish, out is closed then
+func relay(out transport.Outbound, stream mitsuyu.Mitsuyu_ProxyServer) error {
+	defer out.Close()
+	// one more for the linger
+	errc := make(chan error, 3)
+	linger := transport.NewLinger(transport.HALFCLOSETIMEOUT, func() {
+		select {
+		case errc <- fmt.Errorf("idle after half-close"):
+		default:
+		}
+	})
+	defer linger.Stop()
+	go forward(errc, linger, out, stream)
+	go reverse(errc, linger, out, stream)
+	for i := 0; i < 2; i++ {
+		if err := <-errc; err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -107,7 +193,11 @@ func decideDestination(md metadata.MD) (out transport.Outbound, err error) {
 			err = fmt.Errorf("Proxy: Unable to decide destination %v", e)
 		}
 	}()
-	var isdn, host, port, dns, next string
+	var network, isdn, host, port, dns, next string
+	network = "tcp"
+	if n := md.Get("network"); len(n) != 0 && n[0] == "udp" {
+		network = "udp"
+	}
 	isdn = md.Get("isdn")[0]
 	host = md.Get("xxhost")[0]
 	port = md.Get("port")[0]
@@ -124,54 +214,106 @@ func decideDestination(md metadata.MD) (out transport.Outbound, err error) {
 			Local:       "null",
 			Remote:      next,
 			ServiceName: serviceNames[0],
-			TLS:         "true",
-			TLSVerify:   "true",
-			Compress:    "true",
+			TLS:         true,
+			Compress:    true,
 		}
 		c, err := client.New(conf)
 		if err != nil {
 			return nil, err
 		}
-		return c.CallMitsuyuProxy(md)
+		ccc, err := c.CallMitsuyuProxy(md)
+		if err != nil {
+			return nil, err
+		}
+		if status, _ := ccc.Status(); status != common.STATUS_OK {
+			ccc.Close()
+			return nil, &common.StatusError{Status: status}
+		}
+		return ccc, nil
 	}
 	// dns
 	var addr string
 	if dns == "default" || isdn == "false" {
-		return net.Dial("tcp", host+":"+port)
+		return net.DialTimeout(network, net.JoinHostPort(host, port), DIALTIMEOUT)
 	}
 	if ip, err := ipLookup(host, dns); err != nil {
-		addr = host + ":" + port
+		addr = net.JoinHostPort(host, port)
 	} else {
-		addr = ip + ":" + port
+		addr = net.JoinHostPort(ip, port)
 	}
-	return net.Dial("tcp", addr)
+	return net.DialTimeout(network, addr, DIALTIMEOUT)
 }
 
-func forward(wg *sync.WaitGroup, out transport.Outbound, stream mitsuyu.Mitsuyu_ProxyServer) {
-	defer out.Close()
+func bindAddr(out transport.Outbound) string {
+	switch o := out.(type) {
+	case net.Conn:
+		return o.LocalAddr().String()
+	case *transport.GRPCStreamClient:
+		if _, bind := o.Status(); bind != nil {
+			return net.JoinHostPort(bind.Host, bind.Port)
+		}
+	}
+	return ""
+}
+
+// client to destination, client half-close is passed on
+func forward(errc chan error, linger *transport.Linger, out transport.Outbound, stream mitsuyu.Mitsuyu_ProxyServer) {
 	for {
 		r, err := stream.Recv()
+		if err == io.EOF {
+			linger.Start()
+			errc <- transport.CloseWrite(out)
+			return
+		}
 		if err != nil {
-			break
+			errc <- err
+			return
 		}
+		linger.Active()
 		if _, err = out.Write(r.GetData()); err != nil {
-			break
+			errc <- err
+			return
 		}
 	}
-	wg.Done()
 }
 
-func reverse(wg *sync.WaitGroup, out transport.Outbound, stream mitsuyu.Mitsuyu_ProxyServer) {
-	defer out.Close()
-	buf := make([]byte, BUFFERSIZE)
+// destination to client, eof is sent as a mark since the server stream
+// is unable to half-close
+func reverse(errc chan error, linger *transport.Linger, out transport.Outbound, stream mitsuyu.Mitsuyu_ProxyServer) {
+	udp, isUDP := out.(*net.UDPConn)
+	size := BUFFERSIZE
+	if isUDP {
+		size = UDPBUFFERSIZE
+	}
+	buf := make([]byte, size)
 	for {
+		if isUDP {
+			udp.SetReadDeadline(time.Now().Add(UDPTIMEOUT))
+		}
 		n, err := out.Read(buf)
-		if err != nil {
-			break
+		if ne, ok := err.(net.Error); ok && ne.Timeout() && isUDP {
+			// idle udp flow
+			err = io.EOF
+		}
+		if errors.Is(err, net.ErrClosed) && isUDP {
+			// closed by forward after client half-close
+			err = io.EOF
+		}
+		if n > 0 {
+			linger.Active()
+			if err := stream.Send(&mitsuyu.Data{Data: buf[:n]}); err != nil {
+				errc <- err
+				return
+			}
 		}
-		if err = stream.Send(&mitsuyu.Data{Data: buf[:n]}); err != nil {
-			break
+		if err == io.EOF {
+			linger.Start()
+			errc <- stream.Send(transport.NewEOF())
+			return
+		}
+		if err != nil {
+			errc <- err
+			return
 		}
 	}
-	wg.Done()
 }
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"mitsuyu/common"
+	"os"
+	"strings"
+	"time"
+)
+
+func runSubscribe(args []string) int {
+	if len(args) > 0 {
+		switch args[0] {
+		case "keygen":
+			return runSubscribeKeygen(args[1:])
+		case "sign":
+			return runSubscribeSign(args[1:])
+		case "verify":
+			return runSubscribeVerify(args[1:])
+		}
+	}
+	printSubscribeUsage()
+	return 2
+}
+
+func printSubscribeUsage() {
+	fmt.Println("usage: mitsuyu subscribe keygen [-o subscribe.key] [-force]")
+	fmt.Println("       mitsuyu subscribe sign -key subscribe.key [-o list.json] <links file>")
+	fmt.Println("       mitsuyu subscribe verify -key <public key> <list.json>")
+	fmt.Println()
+	fmt.Println("the links file has a mitsuyu:// link per line, blank lines and lines starting with # are skipped,")
+	fmt.Println("publish the signed list over https and set subscribe and subscribe_key of the clients")
+}
+
+// runSubscribeKeygen writes a private key and prints the public key
+func runSubscribeKeygen(args []string) int {
+	fs := flag.NewFlagSet("subscribe keygen", flag.ExitOnError)
+	out := fs.String("o", "subscribe.key", "private key file to write")
+	force := fs.Bool("force", false, "overwrite the key file")
+	fs.Parse(args)
+	if _, err := os.Stat(*out); err == nil && !*force {
+		fmt.Printf("%s exists, overwrite with -force\n", *out)
+		return 1
+	}
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	content := base64.StdEncoding.EncodeToString(priv) + "\n"
+	if err = ioutil.WriteFile(*out, []byte(content), 0600); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	fmt.Printf("wrote %s, keep it private\n", *out)
+	fmt.Printf("subscribe_key: %s\n", base64.StdEncoding.EncodeToString(pub))
+	return 0
+}
+
+// runSubscribeSign signs the links of a file as a list updated now
+func runSubscribeSign(args []string) int {
+	fs := flag.NewFlagSet("subscribe sign", flag.ExitOnError)
+	keyFile := fs.String("key", "subscribe.key", "private key file")
+	out := fs.String("o", "", "list file to write, default stdout")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		printSubscribeUsage()
+		return 2
+	}
+	keyContent, err := ioutil.ReadFile(*keyFile)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	key, err := common.ParsePrivateKey(strings.TrimSpace(string(keyContent)))
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	links, err := ioutil.ReadFile(fs.Arg(0))
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	list := &common.ServerList{Updated: time.Now().Unix()}
+	scanner := bufio.NewScanner(bytes.NewReader(links))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		list.Servers = append(list.Servers, line)
+	}
+	content, err := common.SignList(list, key)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	content = append(content, '\n')
+	if *out == "" {
+		os.Stdout.Write(content)
+		return 0
+	}
+	if err = ioutil.WriteFile(*out, content, 0644); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	fmt.Printf("signed %d servers to %s\n", len(list.Servers), *out)
+	return 0
+}
+
+// runSubscribeVerify checks a list as the clients do
+func runSubscribeVerify(args []string) int {
+	fs := flag.NewFlagSet("subscribe verify", flag.ExitOnError)
+	pub := fs.String("key", "", "public key, the subscribe_key of the clients")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		printSubscribeUsage()
+		return 2
+	}
+	key, err := common.ParsePublicKey(*pub)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	content, err := ioutil.ReadFile(fs.Arg(0))
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	list, err := common.VerifyList(content, key)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	fmt.Printf("updated %s\n", time.Unix(list.Updated, 0).Format(time.RFC3339))
+	for _, link := range list.Servers {
+		fmt.Println(link)
+	}
+	return 0
+}
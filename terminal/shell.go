@@ -3,6 +3,7 @@ package terminal
 import (
 	"fmt"
 	ui "github.com/gizak/termui/v3"
+	"mitsuyu/common"
 	"os"
 	"strconv"
 	"strings"
@@ -61,6 +62,40 @@ func (t *Terminal) handle(cmd string, history *[]string) string {
 	case "shutdown":
 		m.Stop()
 		ret = "service: shutdown successfully"
+	case "reload":
+		if err := m.Reload(); err != nil {
+			ret = err.Error()
+		} else {
+			ret = "service: reload successfully"
+		}
+	case "workers":
+		for _, name := range m.GetNames() {
+			state, err := m.GetState(name)
+			if err != nil {
+				state += ", " + err.Error()
+			}
+			*history = append(*history, fmt.Sprintf("%s: %s", name, state))
+		}
+		ret = "===================="
+	case "start", "stop", "restart":
+		if len(cmds) != 2 {
+			ret = cmd + ": command not found"
+			break
+		}
+		var err error
+		switch cmds[0] {
+		case "start":
+			err = m.StartWorker(cmds[1])
+		case "stop":
+			err = m.StopWorker(cmds[1])
+		case "restart":
+			err = m.RestartWorker(cmds[1])
+		}
+		if err != nil {
+			ret = err.Error()
+		} else {
+			ret = fmt.Sprintf("%s: %s successfully", cmds[1], cmds[0])
+		}
 	case "exit":
 		ui.Close()
 		os.Exit(0)
@@ -78,6 +113,24 @@ func (t *Terminal) handle(cmd string, history *[]string) string {
 			ret = "===================="
 		}
 
+	case "link":
+		// link [qr], share the running config
+		cc := m.GetClient()
+		if cc == nil || len(cmds) > 2 || (len(cmds) == 2 && cmds[1] != "qr") {
+			ret = cmd + ": command not found"
+			break
+		}
+		link := cc.ShareLink("")
+		if len(cmds) == 2 {
+			qr, err := common.LinkQR(link)
+			if err != nil {
+				ret = err.Error()
+				break
+			}
+			*history = append(*history, strings.Split(strings.TrimRight(qr, "\n"), "\n")...)
+		}
+		ret = link
+
 	case "set":
 		cc := m.GetClient()
 		if len(cmds) != 3 || cc == nil {
@@ -2,12 +2,29 @@ package transport
 
 import (
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"io"
+	"mitsuyu/common"
 	"mitsuyu/mitsuyu"
+	"sync"
+	"time"
 )
 
+// how long to wait for the server to answer the request for the status,
+// older servers never do
+const STATUSWAIT = 3 * time.Second
+
 type GRPCStreamClient struct {
 	conn   *grpc.ClientConn
 	stream mitsuyu.Mitsuyu_ProxyClient
+	once   sync.Once
+	status string
+	bind   *common.Addr
+	rbuf   []byte
+	// the status was asked in the stream
+	inStream bool
+	// the server does not send the status
+	legacy bool
 }
 
 func NewGRPCStreamClient(conn *grpc.ClientConn, stream mitsuyu.Mitsuyu_ProxyClient) *GRPCStreamClient {
@@ -18,12 +35,102 @@ func (c *GRPCStreamClient) GetStream() mitsuyu.Mitsuyu_ProxyClient {
 	return c.stream
 }
 
+// AskStatus tells that the status was asked in the stream, legacy is
+// whether the server is known not to send it
+func (c *GRPCStreamClient) AskStatus(legacy bool) {
+	c.inStream, c.legacy = true, legacy
+}
+
+// Legacy reports whether the server did not send the status
+func (c *GRPCStreamClient) Legacy() bool {
+	c.Status()
+	return c.legacy
+}
+
+// Target is the address of the server
+func (c *GRPCStreamClient) Target() string {
+	return c.conn.Target()
+}
+
+// Status waits for the server to dial the destination, an older server
+// dials before any data and is taken as ok
+func (c *GRPCStreamClient) Status() (string, *common.Addr) {
+	c.once.Do(func() {
+		c.status = common.STATUS_FAILURE
+		if c.legacy {
+			c.status = common.STATUS_OK
+			return
+		}
+		md, err := c.header()
+		if err != nil {
+			return
+		}
+		status := md.Get("status")
+		switch {
+		case len(status) == 0:
+			// an older server answered with data
+			c.status, c.legacy = common.STATUS_OK, true
+		case status[0] == common.STATUS_PENDING:
+			r, err := c.stream.Recv()
+			if err != nil || !IsStatus(r) {
+				return
+			}
+			c.status = string(r.GetData())
+			c.bind, _ = common.ParseAddr(string(r.GetTail()))
+		default:
+			c.status = status[0]
+			if bind := md.Get("bind"); len(bind) != 0 {
+				c.bind, _ = common.ParseAddr(bind[0])
+			}
+		}
+	})
+	return c.status, c.bind
+}
+
+// header waits for the header, up to STATUSWAIT if the status was asked
+// in the stream, since an older server sends it only with data
+func (c *GRPCStreamClient) header() (metadata.MD, error) {
+	if !c.inStream {
+		return c.stream.Header()
+	}
+	type result struct {
+		md  metadata.MD
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		md, err := c.stream.Header()
+		done <- result{md, err}
+	}()
+	select {
+	case r := <-done:
+		return r.md, r.err
+	case <-time.After(STATUSWAIT):
+		return metadata.MD{}, nil
+	}
+}
+
+// Read keeps what does not fit in b for the next call
 func (c *GRPCStreamClient) Read(b []byte) (int, error) {
-	r, err := c.stream.Recv()
-	if err != nil {
-		return 0, err
+	for len(c.rbuf) == 0 {
+		r, err := c.stream.Recv()
+		if err != nil {
+			return 0, err
+		}
+		if IsEOF(r) {
+			return 0, io.EOF
+		}
+		if IsStatus(r) {
+			// sent after STATUSWAIT
+			if status := string(r.GetData()); status != common.STATUS_OK {
+				return 0, &common.StatusError{Status: status}
+			}
+			continue
+		}
+		c.rbuf = r.GetData()
 	}
-	n := copy(b, r.GetData())
+	n := copy(b, c.rbuf)
+	c.rbuf = c.rbuf[n:]
 	return n, nil
 }
 func (c *GRPCStreamClient) ShallowRead(b *[]byte) (int, error) {
@@ -39,6 +146,10 @@ func (c *GRPCStreamClient) Write(b []byte) (int, error) {
 	return len(b), c.stream.Send(&mitsuyu.Data{Data: b})
 }
 
+func (c *GRPCStreamClient) CloseWrite() error {
+	return c.stream.CloseSend()
+}
+
 func (c *GRPCStreamClient) Close() error {
 	return c.conn.Close()
 }
@@ -1,21 +1,41 @@
 package transport
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/base64"
 	"fmt"
+	"io"
 	"mitsuyu/common"
 	"net"
 	"net/http"
-	"net/url"
 	"strings"
+	"time"
 )
 
+// hop-by-hop headers, rfc7230 section 6.1
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
 type Http struct {
 	conn   net.Conn
+	reader *bufio.Reader
+	req    *http.Request
 	addr   *common.Addr
-	method string
 	proto  string
+	users  []*common.User
+	user   *common.User
 	buffer *bytes.Buffer
+	reply  bool
 }
 
 func (h *Http) Addr() *common.Addr {
@@ -26,7 +46,16 @@ func (h *Http) Proto() string {
 	return h.proto
 }
 func (h *Http) IsTun() bool {
-	return h.method == "connect"
+	return h.req.Method == http.MethodConnect
+}
+
+func (h *Http) Request() *http.Request {
+	return h.req
+}
+
+// User returns the authenticated user, nil if no auth
+func (h *Http) User() *common.User {
+	return h.user
 }
 
 func (h *Http) SetAddr(addr *common.Addr) {
@@ -37,130 +66,262 @@ func (h *Http) SetBuffer(buffer *bytes.Buffer) {
 	h.buffer = buffer
 }
 
+// Reply completes the CONNECT tunnel or sends an error page,
+// plain http needs no reply on success
+func (h *Http) Reply(status string, bind *common.Addr) error {
+	if h.reply {
+		return nil
+	}
+	if status == common.STATUS_OK {
+		if !h.IsTun() {
+			return nil
+		}
+		h.reply = true
+		return handshakeTunnel(h.conn)
+	}
+	h.reply = true
+	switch status {
+	case common.STATUS_NOT_ALLOWED:
+		return sendErrorPage(h.conn, http.StatusForbidden, "Blocked by strategy", nil)
+	case common.STATUS_TTL_EXPIRED:
+		return sendErrorPage(h.conn, http.StatusGatewayTimeout, "Timed out connecting to "+h.req.Host, nil)
+	}
+	return sendErrorPage(h.conn, http.StatusBadGateway, "Unable to reach "+h.req.Host+", "+status, nil)
+}
+
 func (h *Http) Read(b []byte) (int, error) {
 	if h.buffer == nil {
-		return h.conn.Read(b)
+		return h.reader.Read(b)
 	}
 	n, err := h.buffer.Read(b)
-	h.buffer = nil
+	if h.buffer.Len() == 0 {
+		h.buffer = nil
+	}
 	return n, err
 }
+
+func (h *Http) SetReadDeadline(t time.Time) error {
+	return h.conn.SetReadDeadline(t)
+}
 func (h *Http) Write(b []byte) (int, error) {
 	return h.conn.Write(b)
 }
+func (h *Http) CloseWrite() error {
+	return CloseWrite(h.conn)
+}
+
 func (h *Http) Close() error {
 	return h.conn.Close()
 }
 
-func HttpHandshake(buf []byte, conn net.Conn) (*Http, error) {
-	buff := bytes.Split(buf, []byte("\r\n"))
-	method, link, err := parseFirstLine(string(buff[0]))
-	if err != nil {
-		return nil, wrapErrorHttp(err)
+// IsHttp reports whether buf starts with a http request line
+func IsHttp(buf []byte) bool {
+	i := bytes.IndexByte(buf, ' ')
+	if i <= 0 || i > 16 {
+		return false
 	}
-
-	// https
-	if method == "connect" {
-		addr := parseHost(link, "443")
-		if err = handshakeTunnel(conn); err != nil {
-			return nil, wrapErrorHttp(err)
+	for _, c := range buf[:i] {
+		if c < 'A' || c > 'Z' {
+			return false
 		}
-		return &Http{conn: conn, addr: addr, method: "connect", proto: "https"}, nil
 	}
+	return true
+}
 
-	// plain http
-	header := parseHeader(buff)
-	buffer := new(bytes.Buffer)
-	if u, err := url.Parse(link); err != nil {
-		buffer.Write(buff[0])
-	} else {
-		buffer.Write([]byte(fmt.Sprintf("%s %s HTTP/1.1", strings.ToUpper(method), u.RequestURI())))
-	}
-	buffer.Write([]byte("\r\n"))
-	header.Write(buffer)
-	buffer.Write([]byte("\r\n"))
-	addr := parseHost(header.Get("Host"), "80")
-	if l := len(buff); len(buff[l-1]) != 0 || len(buff[l-2]) != 0 {
-		buffer.Write(buff[l-1])
-		ll, b := buffer.Len(), buffer.Bytes()
-		if _, err = conn.Read(b[ll:]); err != nil {
-			return nil, err
-		}
+// HttpHandshake requires basic auth if users is not empty
+func HttpHandshake(buf []byte, conn net.Conn, users []*common.User) (*Http, error) {
+	if !IsHttp(buf) {
+		return nil, wrapErrorHttp(fmt.Errorf("Unable to parse request line"))
+	}
+	reader := bufio.NewReader(io.MultiReader(bytes.NewReader(buf), conn))
+	h := &Http{conn: conn, reader: reader, users: users}
+	if err := h.Next(); err != nil {
+		return nil, err
 	}
-	return &Http{conn: conn, addr: addr, method: method, proto: "http", buffer: buffer}, nil
+	return h, nil
 }
 
-func parseFirstLine(line string) (method, link string, err error) {
-	var methods = [...]string{"head", "get", "post", "connect"}
-	strs := strings.SplitN(line, " ", 3)
-	if len(strs) != 3 {
-		err = fmt.Errorf("Unable to parse header")
-		return
+// Next reads the next request on a keep-alive connection,
+// each request may target a different host
+func (h *Http) Next() error {
+	req, err := http.ReadRequest(h.reader)
+	if err == io.EOF {
+		return err
 	}
-	method = strings.ToLower(strings.TrimSpace(strs[0]))
-	link = strings.ToLower(strings.TrimSpace(strs[1]))
-	version := strings.ToLower(strings.TrimSpace(strs[2]))
-	if version != "http/1.1" {
-		err = fmt.Errorf("Support HTTP/1.1 only")
-		return
+	if err != nil {
+		return wrapErrorHttp(err)
+	}
+	if req.Host == "" {
+		sendErrorPage(h.conn, http.StatusBadRequest, "Missing host", nil)
+		return wrapErrorHttp(fmt.Errorf("Missing host"))
 	}
-	ok := false
-	for _, m := range methods {
-		if method == m {
-			ok = true
-			break
+	h.req = req
+	h.reply = false
+	if len(h.users) != 0 {
+		username, password, _ := parseBasicAuth(req.Header.Get("Proxy-Authorization"))
+		if h.user = MatchUser(h.users, username, password); h.user == nil {
+			h.reply = true
+			header := http.Header{"Proxy-Authenticate": {`Basic realm="mitsuyu"`}}
+			sendErrorPage(h.conn, http.StatusProxyAuthRequired, "Proxy authentication required", header)
+			if username == "" {
+				return wrapErrorHttp(fmt.Errorf("Auth required"))
+			}
+			return wrapErrorHttp(fmt.Errorf("Auth failed, user %s", username))
 		}
 	}
-	if !ok {
-		err = fmt.Errorf("Unable to parse header")
-		return
+	// https
+	if req.Method == http.MethodConnect {
+		// tunnel is established after the outbound is ready
+		h.addr = parseHost(req.Host, "443")
+		h.proto = "https"
+		return nil
 	}
-	return method, link, nil
+	// plain http
+	h.addr = parseHost(req.Host, "80")
+	h.proto = "http"
+	return nil
 }
 
-func parseHeader(buf [][]byte) http.Header {
-	header := make(http.Header, 20)
-	for i, l := 1, len(buf); i < l; i++ {
-		b := bytes.SplitN(buf[i], []byte(":"), 2)
-		if len(b) != 2 {
-			continue
+// RoundTrip forwards the current request to rw and relays the response,
+// it returns true if the connection can be reused for the next request
+func (h *Http) RoundTrip(rw io.ReadWriter) (bool, error) {
+	req := h.req
+	keepAlive := !req.Close
+	upgrade := upgradeType(req.Header)
+	removeHopHeaders(req.Header)
+	if upgrade != "" {
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", upgrade)
+	} else {
+		req.Close = true
+	}
+	// do not add the default user agent of net/http
+	if _, ok := req.Header["User-Agent"]; !ok {
+		req.Header["User-Agent"] = []string{""}
+	}
+	if strings.EqualFold(req.Header.Get("Expect"), "100-continue") {
+		req.Header.Del("Expect")
+		if _, err := io.WriteString(h.conn, "HTTP/1.1 100 Continue\r\n\r\n"); err != nil {
+			return false, wrapErrorHttp(err)
+		}
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- req.Write(rw)
+	}()
+	reader := bufio.NewReader(rw)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return false, wrapErrorHttp(err)
+	}
+	defer resp.Body.Close()
+	// websocket, h2c, ..
+	if resp.StatusCode == http.StatusSwitchingProtocols && upgrade != "" {
+		if err = resp.Write(h.conn); err != nil {
+			return false, wrapErrorHttp(err)
+		}
+		go func() {
+			io.Copy(rw, h.reader)
+			if cw, ok := rw.(interface{ CloseWrite() error }); ok {
+				cw.CloseWrite()
+			}
+		}()
+		io.Copy(h.conn, reader)
+		return false, nil
+	}
+	removeHopHeaders(resp.Header)
+	// the proxy speaks its own version to the application
+	resp.Proto, resp.ProtoMajor, resp.ProtoMinor = "HTTP/1.1", 1, 1
+	if resp.ContentLength < 0 && len(resp.TransferEncoding) == 0 && req.Method != http.MethodHead {
+		if req.ProtoAtLeast(1, 1) {
+			resp.TransferEncoding = []string{"chunked"}
+		} else {
+			keepAlive = false
 		}
-		key := bytes.TrimSpace(b[0])
-		values := bytes.Split(bytes.TrimSpace(b[1]), []byte(","))
-		for _, v := range values {
-			header.Add(string(key), string(bytes.TrimSpace(v)))
+	}
+	resp.Close = !keepAlive
+	if keepAlive && !req.ProtoAtLeast(1, 1) {
+		resp.Header.Set("Connection", "keep-alive")
+	}
+	if err = resp.Write(h.conn); err != nil {
+		return false, wrapErrorHttp(err)
+	}
+	if err = <-errc; err != nil {
+		return false, wrapErrorHttp(err)
+	}
+	return keepAlive, nil
+}
+
+func upgradeType(header http.Header) string {
+	for _, v := range header["Connection"] {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), "upgrade") {
+				return header.Get("Upgrade")
+			}
 		}
 	}
-	header.Del("Proxy-Connection")
-	header.Del("Proxy-Authenticate")
-	header.Del("Proxy-Authorization")
-	header.Del("TE")
-	header.Del("Trailers")
-	header.Del("Transfer-Encoding")
-	header.Del("Upgrade")
-	connections := header.Get("Connection")
-	if connections == "" {
-		return header
+	return ""
+}
+
+func removeHopHeaders(header http.Header) {
+	for _, v := range header["Connection"] {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				header.Del(s)
+			}
+		}
 	}
-	for _, h := range strings.Split(connections, ",") {
-		header.Del(strings.TrimSpace(h))
+	for _, s := range hopHeaders {
+		header.Del(s)
 	}
-	return header
 }
 
 func parseHost(link, dport string) *common.Addr {
-	var host, port string
-	hs := strings.SplitN(link, ":", 2)
-	host = hs[0]
-	if len(hs) == 2 {
-		port = hs[1]
-	} else {
-		port = dport
+	host, port, err := net.SplitHostPort(link)
+	if err != nil {
+		host, port = strings.Trim(link, "[]"), dport
 	}
+	host = strings.ToLower(host)
 	isdn := net.ParseIP(host) == nil
 	return &common.Addr{Host: host, Port: port, Isdn: isdn}
 }
 
+func parseBasicAuth(auth string) (username, password string, ok bool) {
+	const prefix = "Basic "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return
+	}
+	b, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return
+	}
+	s := strings.SplitN(string(b), ":", 2)
+	if len(s) != 2 {
+		return
+	}
+	return s[0], s[1], true
+}
+
+// the connection is closed after an error page
+func sendErrorPage(conn net.Conn, code int, msg string, header http.Header) error {
+	text := fmt.Sprintf("%d %s", code, http.StatusText(code))
+	body := fmt.Sprintf("<html><head><title>%s</title></head><body><h1>%s</h1><p>%s</p></body></html>\n", text, text, msg)
+	if header == nil {
+		header = make(http.Header)
+	}
+	header.Set("Content-Type", "text/html; charset=utf-8")
+	resp := &http.Response{
+		StatusCode:    code,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Close:         true,
+	}
+	return resp.Write(conn)
+}
+
 func handshakeTunnel(conn net.Conn) error {
 	_, err := conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
 	return err
@@ -0,0 +1,205 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"mitsuyu/common"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestHttpHandshake(t *testing.T) {
+	users := []*common.User{{Username: "al", Password: "secret"}}
+	basic := "Basic " + base64.StdEncoding.EncodeToString([]byte("al:secret"))
+	tests := []struct {
+		name  string
+		buf   string
+		users []*common.User
+		addr  *common.Addr
+		proto string
+		// status line of the error page
+		reply string
+		err   bool
+	}{
+		{
+			name:  "connect",
+			buf:   "CONNECT example.com:8443 HTTP/1.1\r\nHost: example.com:8443\r\n\r\n",
+			addr:  &common.Addr{Isdn: true, Host: "example.com", Port: "8443"},
+			proto: "https",
+		},
+		{
+			name:  "connect default port",
+			buf:   "CONNECT example.com HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			addr:  &common.Addr{Isdn: true, Host: "example.com", Port: "443"},
+			proto: "https",
+		},
+		{
+			name:  "absolute url",
+			buf:   "GET http://Example.com/index.html HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			addr:  &common.Addr{Isdn: true, Host: "example.com", Port: "80"},
+			proto: "http",
+		},
+		{
+			name:  "ipv6",
+			buf:   "GET http://[2001:db8::1]:8080/ HTTP/1.1\r\nHost: [2001:db8::1]:8080\r\n\r\n",
+			addr:  &common.Addr{Host: "2001:db8::1", Port: "8080"},
+			proto: "http",
+		},
+		{
+			name:  "auth",
+			buf:   "CONNECT 192.0.2.1:443 HTTP/1.1\r\nHost: 192.0.2.1:443\r\nProxy-Authorization: " + basic + "\r\n\r\n",
+			users: users,
+			addr:  &common.Addr{Host: "192.0.2.1", Port: "443"},
+			proto: "https",
+		},
+		{
+			name:  "auth required",
+			buf:   "CONNECT 192.0.2.1:443 HTTP/1.1\r\nHost: 192.0.2.1:443\r\n\r\n",
+			users: users,
+			reply: "HTTP/1.1 407 Proxy Authentication Required",
+			err:   true,
+		},
+		{
+			name:  "auth failed",
+			buf:   "GET http://192.0.2.1/ HTTP/1.1\r\nHost: 192.0.2.1\r\nProxy-Authorization: Basic YWw6YmFk\r\n\r\n",
+			users: users,
+			reply: "HTTP/1.1 407 Proxy Authentication Required",
+			err:   true,
+		},
+		{
+			name:  "missing host",
+			buf:   "GET / HTTP/1.0\r\n\r\n",
+			reply: "HTTP/1.1 400 Bad Request",
+			err:   true,
+		},
+		{
+			name: "not http",
+			buf:  "\x16\x03\x01\x00\x05hello",
+			err:  true,
+		},
+	}
+	for _, tt := range tests {
+		conn, replies := handshakeConn(nil)
+		h, err := HttpHandshake([]byte(tt.buf), conn, tt.users)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: expect an error", tt.name)
+			}
+		} else if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else {
+			if *h.Addr() != *tt.addr {
+				t.Errorf("%s: addr %+v, expect %+v", tt.name, *h.Addr(), *tt.addr)
+			}
+			if h.Proto() != tt.proto {
+				t.Errorf("%s: proto %s, expect %s", tt.name, h.Proto(), tt.proto)
+			}
+			if tt.users != nil && h.User() != tt.users[0] {
+				t.Errorf("%s: user %v, expect %v", tt.name, h.User(), tt.users[0])
+			}
+		}
+		conn.Close()
+		b := <-replies
+		if line, _, _ := strings.Cut(string(b), "\r\n"); line != tt.reply {
+			t.Errorf("%s: reply %q, expect %q", tt.name, line, tt.reply)
+		}
+	}
+}
+
+// each request on a keep-alive connection is routed by its own host
+func TestHttpNext(t *testing.T) {
+	first := "GET http://a.example/ HTTP/1.1\r\nHost: a.example\r\n\r\n"
+	second := "GET http://b.example:8080/ HTTP/1.1\r\nHost: b.example:8080\r\n\r\n"
+	conn, replies := handshakeConn([]byte(second))
+	defer func() {
+		conn.Close()
+		<-replies
+	}()
+	h, err := HttpHandshake([]byte(first), conn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Addr().Host != "a.example" {
+		t.Errorf("first host %s, expect a.example", h.Addr().Host)
+	}
+	if err = h.Next(); err != nil {
+		t.Fatal(err)
+	}
+	if h.Addr().Host != "b.example" || h.Addr().Port != "8080" {
+		t.Errorf("second addr %+v, expect b.example:8080", *h.Addr())
+	}
+}
+
+func TestHttpRoundTrip(t *testing.T) {
+	req := "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n" +
+		"Proxy-Connection: keep-alive\r\nConnection: X-Hop\r\nX-Hop: 1\r\nX-End: 1\r\n\r\n"
+	conn, replies := handshakeConn(nil)
+	h, err := HttpHandshake([]byte(req), conn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the destination, behind the outbound
+	out, dest := net.Pipe()
+	received := make(chan *http.Request, 1)
+	go func() {
+		r, err := http.ReadRequest(bufio.NewReader(dest))
+		if err != nil {
+			received <- nil
+			return
+		}
+		received <- r
+		dest.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\nKeep-Alive: timeout=5\r\n\r\nok"))
+		dest.Close()
+	}()
+	keepAlive, err := h.RoundTrip(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !keepAlive {
+		t.Errorf("keep-alive is false, expect true")
+	}
+	r := <-received
+	if r == nil {
+		t.Fatal("no request at the destination")
+	}
+	for _, k := range []string{"Proxy-Connection", "X-Hop"} {
+		if r.Header.Get(k) != "" {
+			t.Errorf("hop header %s is forwarded", k)
+		}
+	}
+	if r.Header.Get("X-End") != "1" {
+		t.Errorf("end-to-end header X-End is dropped")
+	}
+	if r.RequestURI != "/" {
+		t.Errorf("request uri %s, expect /", r.RequestURI)
+	}
+	conn.Close()
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(<-replies)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Keep-Alive") != "" || resp.Close {
+		t.Errorf("response %d %v close=%v, expect 200 without hop headers", resp.StatusCode, resp.Header, resp.Close)
+	}
+}
+
+func TestParseHost(t *testing.T) {
+	tests := []struct {
+		link, dport string
+		want        common.Addr
+	}{
+		{"example.com", "80", common.Addr{Isdn: true, Host: "example.com", Port: "80"}},
+		{"EXAMPLE.com:8080", "80", common.Addr{Isdn: true, Host: "example.com", Port: "8080"}},
+		{"192.0.2.1", "443", common.Addr{Host: "192.0.2.1", Port: "443"}},
+		{"[2001:db8::1]", "443", common.Addr{Host: "2001:db8::1", Port: "443"}},
+		{"[2001:db8::1]:8443", "443", common.Addr{Host: "2001:db8::1", Port: "8443"}},
+	}
+	for _, tt := range tests {
+		if got := parseHost(tt.link, tt.dport); *got != tt.want {
+			t.Errorf("parseHost(%s, %s) = %+v, expect %+v", tt.link, tt.dport, *got, tt.want)
+		}
+	}
+}
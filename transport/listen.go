@@ -0,0 +1,52 @@
+package transport
+
+import (
+	"fmt"
+	"net"
+)
+
+// ListenTCP listens on addr, and also on the ipv6 counterpart of addr
+// if dualStack, e.g. 127.0.0.1 -> ::1, 0.0.0.0 -> ::
+func ListenTCP(addr string, dualStack bool) ([]net.Listener, error) {
+	var addr6 string
+	if dualStack {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		ip := net.ParseIP(host)
+		switch {
+		case host == "":
+			// already dual stack
+		case ip == nil || ip.To4() == nil:
+			// hostname or ipv6
+		case ip.IsLoopback():
+			addr6 = net.JoinHostPort("::1", port)
+		case ip.IsUnspecified():
+			addr6 = net.JoinHostPort("::", port)
+		default:
+			return nil, fmt.Errorf("no ipv6 counterpart of %s", host)
+		}
+	}
+	network := "tcp"
+	if addr6 != "" {
+		// tcp on 0.0.0.0 would take [::] too
+		network = "tcp4"
+	}
+	lis, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if addr6 == "" {
+		return []net.Listener{lis}, nil
+	}
+	// the same port if it was chosen by the system
+	host6, _, _ := net.SplitHostPort(addr6)
+	addr6 = net.JoinHostPort(host6, fmt.Sprint(lis.Addr().(*net.TCPAddr).Port))
+	lis6, err := listenV6Only(addr6)
+	if err != nil {
+		lis.Close()
+		return nil, err
+	}
+	return []net.Listener{lis, lis6}, nil
+}
@@ -0,0 +1,62 @@
+package transport
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestListenTCP(t *testing.T) {
+	tests := []struct {
+		addr      string
+		dualStack bool
+		// dialed on the port of the first listener
+		dial []string
+	}{
+		{"127.0.0.1:0", false, []string{"127.0.0.1"}},
+		{"127.0.0.1:0", true, []string{"127.0.0.1", "::1"}},
+		{"0.0.0.0:0", true, []string{"127.0.0.1", "::1"}},
+		{"0.0.0.0:0", false, []string{"127.0.0.1"}},
+		{"[::1]:0", true, []string{"::1"}},
+	}
+	for _, tt := range tests {
+		listeners, err := ListenTCP(tt.addr, tt.dualStack)
+		if err != nil {
+			t.Errorf("ListenTCP(%s, %v): %v", tt.addr, tt.dualStack, err)
+			continue
+		}
+		port := listeners[0].Addr().(*net.TCPAddr).Port
+		for _, lis := range listeners {
+			if p := lis.Addr().(*net.TCPAddr).Port; p != port {
+				t.Errorf("ListenTCP(%s, %v): ports %d and %d", tt.addr, tt.dualStack, port, p)
+			}
+			go func(lis net.Listener) {
+				for {
+					conn, err := lis.Accept()
+					if err != nil {
+						return
+					}
+					conn.Close()
+				}
+			}(lis)
+		}
+		for _, host := range tt.dial {
+			addr := net.JoinHostPort(host, fmt.Sprint(port))
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Errorf("ListenTCP(%s, %v): dial %s: %v", tt.addr, tt.dualStack, addr, err)
+				continue
+			}
+			conn.Close()
+		}
+		for _, lis := range listeners {
+			lis.Close()
+		}
+	}
+}
+
+func TestListenTCPNoCounterpart(t *testing.T) {
+	if _, err := ListenTCP("192.0.2.1:0", true); err == nil {
+		t.Errorf("ListenTCP(192.0.2.1:0, true): expect an error")
+	}
+}
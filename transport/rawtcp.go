@@ -4,7 +4,7 @@ import (
 	"bytes"
 	"mitsuyu/common"
 	"net"
-	"strings"
+	"time"
 )
 
 type RawTCP struct {
@@ -18,29 +18,27 @@ func NewRawTCP(conn net.Conn) *RawTCP {
 	return &RawTCP{conn: conn}
 }
 
-func NewRawTCPWithSniff(buf []byte, conn net.Conn) (*RawTCP, error) {
-	var host, port, proto string
-	var err error
-	if host, err = SniffFromHTTP(buf); err == nil {
-		s := strings.SplitN(host, ":", 2)
-		host = s[0]
-		if len(s) == 1 {
-			port = "80"
-		} else {
-			port = s[1]
-		}
-		proto = "http"
-	} else if host, err = SniffFromHTTPS(buf); err == nil {
-		port = "443"
-		proto = "https"
-	}
+// NewRawTCPWithAddr connects conn to a fixed destination
+func NewRawTCPWithAddr(proto string, conn net.Conn, addr *common.Addr) *RawTCP {
+	return &RawTCP{proto: proto, addr: addr, conn: conn}
+}
+
+// NewRawTCPWithSniff sniffs the destination from the first request,
+// which may be read from conn beyond buf up to limit bytes
+func NewRawTCPWithSniff(buf []byte, conn net.Conn, limit int) (*RawTCP, *Sniffed, error) {
+	buf, sniffed, err := SniffRead(buf, conn, limit)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	port := "80"
+	if sniffed.Proto == "https" {
+		port = "443"
+	}
+	host, port := splitHostPort(sniffed.Host, port)
 	var isdn = net.ParseIP(host) == nil
 	addr := &common.Addr{Isdn: isdn, Host: host, Port: port}
 	buffer := bytes.NewBuffer(buf)
-	return &RawTCP{proto: proto, addr: addr, buffer: buffer, conn: conn}, nil
+	return &RawTCP{proto: sniffed.Proto, addr: addr, buffer: buffer, conn: conn}, sniffed, nil
 }
 
 func (c *RawTCP) Addr() *common.Addr {
@@ -59,6 +57,11 @@ func (c *RawTCP) SetBuffer(buffer *bytes.Buffer) {
 	c.buffer = buffer
 }
 
+// Reply does nothing, the application is not aware of the proxy
+func (c *RawTCP) Reply(status string, bind *common.Addr) error {
+	return nil
+}
+
 func (c *RawTCP) ShallowRead(b *[]byte) (int, error) {
 	return c.conn.Read(*b)
 }
@@ -68,14 +71,24 @@ func (c *RawTCP) Read(b []byte) (int, error) {
 		return c.conn.Read(b)
 	}
 	n, err := c.buffer.Read(b)
-	c.buffer = nil
+	if c.buffer.Len() == 0 {
+		c.buffer = nil
+	}
 	return n, err
 }
 
+func (c *RawTCP) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
 func (c *RawTCP) Write(b []byte) (int, error) {
 	return c.conn.Write(b)
 }
 
+func (c *RawTCP) CloseWrite() error {
+	return CloseWrite(c.conn)
+}
+
 func (c *RawTCP) Close() error {
 	return c.conn.Close()
 }
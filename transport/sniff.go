@@ -3,152 +3,390 @@ package transport
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"mitsuyu/common"
+	"net"
+	"net/http"
 	"strings"
+	"time"
 )
 
-func GetDomainName(in Inbound) {
+// default max bytes to accumulate for sniffing
+const SNIFFLIMIT = 16384
+
+// default time to wait for the first request
+const SNIFFTIMEOUT = 300 * time.Millisecond
+
+// the rest of a fragmented request is expected to arrive within SNIFFDEADLINE
+const SNIFFDEADLINE = 200 * time.Millisecond
+
+// ErrSniffIncomplete is returned if more data is required
+var ErrSniffIncomplete = fmt.Errorf("Common: sniff requires more data")
+
+type Sniffed struct {
+	Proto string
+	// may contain port
+	Host string
+	ALPN []string
+}
+
+// GetDomainName sniffs the first request of in, and sets its address to
+// the sniffed domain name, data read is put back to the buffer of in.
+// It gives up if nothing arrives within timeout
+func GetDomainName(in Inbound, limit int, timeout time.Duration) *Sniffed {
+	if limit <= 0 {
+		limit = SNIFFLIMIT
+	}
+	if timeout <= 0 {
+		timeout = SNIFFTIMEOUT
+	}
+	if udp, ok := in.(*UDP); ok {
+		return getDomainNameFromQUIC(udp, limit, timeout)
+	}
 	buf := make([]byte, 1024)
+	d, ok := in.(interface{ SetReadDeadline(t time.Time) error })
+	if ok {
+		d.SetReadDeadline(time.Now().Add(timeout))
+	}
 	n, err := in.Read(buf)
+	if ok {
+		d.SetReadDeadline(time.Time{})
+	}
 	if err != nil {
-		return
+		return nil
 	}
-	buffer := bytes.NewBuffer(buf[:n])
-	in.SetBuffer(buffer)
-	host, err := SniffHost(buf[:n])
+	data, sniffed, err := SniffRead(buf[:n], in, limit)
+	in.SetBuffer(bytes.NewBuffer(data))
 	if err != nil {
-		return
+		return nil
 	}
-	dname := strings.Split(host, ":")[0]
-	addr := &common.Addr{Isdn: true, Host: dname, Port: in.Addr().Port}
+	dname, _ := splitHostPort(sniffed.Host, in.Addr().Port)
+	addr := &common.Addr{Isdn: net.ParseIP(dname) == nil, Host: dname, Port: in.Addr().Port}
 	in.SetAddr(addr)
+	return sniffed
 }
 
-func SniffHost(buf []byte) (string, error) {
+// getDomainNameFromQUIC peeks datagrams until the ClientHello is complete,
+// datagrams are left in the flow
+func getDomainNameFromQUIC(in *UDP, limit int, timeout time.Duration) *Sniffed {
+	var datagrams [][]byte
+	for size := 0; size < limit; timeout = SNIFFDEADLINE {
+		d, err := in.Peek(len(datagrams), timeout)
+		if err != nil {
+			return nil
+		}
+		datagrams = append(datagrams, d)
+		size += len(d)
+		hello, err := SniffFromQUIC(datagrams)
+		if err == ErrSniffIncomplete {
+			continue
+		}
+		if err != nil {
+			return nil
+		}
+		dname, _ := splitHostPort(hello.ServerName, in.Addr().Port)
+		in.SetAddr(&common.Addr{Isdn: net.ParseIP(dname) == nil, Host: dname, Port: in.Addr().Port})
+		return &Sniffed{Proto: "quic", Host: hello.ServerName, ALPN: hello.ALPN}
+	}
+	return nil
+}
+
+// SniffRead keeps reading from r until the request in buf is sniffed,
+// limit is reached or no data arrives within SNIFFDEADLINE, it returns
+// all data read, r is read only if it supports SetReadDeadline
+func SniffRead(buf []byte, r io.Reader, limit int) ([]byte, *Sniffed, error) {
+	if limit <= 0 {
+		limit = SNIFFLIMIT
+	}
+	sniffed, err := Sniff(buf)
+	if err != ErrSniffIncomplete {
+		return buf, sniffed, err
+	}
+	d, ok := r.(interface{ SetReadDeadline(t time.Time) error })
+	if !ok {
+		return buf, nil, err
+	}
+	defer d.SetReadDeadline(time.Time{})
+	tmp := make([]byte, 4096)
+	for err == ErrSniffIncomplete && len(buf) < limit {
+		if len(tmp) > limit-len(buf) {
+			tmp = tmp[:limit-len(buf)]
+		}
+		d.SetReadDeadline(time.Now().Add(SNIFFDEADLINE))
+		n, rerr := r.Read(tmp)
+		buf = append(buf, tmp[:n]...)
+		if n > 0 {
+			sniffed, err = Sniff(buf)
+		}
+		if rerr != nil {
+			break
+		}
+	}
+	return buf, sniffed, err
+}
+
+// Sniff detects http, h2c or tls
+func Sniff(buf []byte) (*Sniffed, error) {
+	if IsHttp2(buf) {
+		host, err := SniffFromHTTP2(buf)
+		if err != nil {
+			return nil, err
+		}
+		return &Sniffed{Proto: "h2c", Host: host}, nil
+	}
 	host, err := SniffFromHTTP(buf)
-	if err != nil {
-		host, err = SniffFromHTTPS(buf)
+	if err == nil {
+		return &Sniffed{Proto: "http", Host: host}, nil
+	}
+	hello, err2 := ParseClientHello(buf)
+	if err2 == nil {
+		return &Sniffed{Proto: "https", Host: hello.ServerName, ALPN: hello.ALPN}, nil
+	}
+	if err == ErrSniffIncomplete || err2 == ErrSniffIncomplete {
+		return nil, ErrSniffIncomplete
 	}
+	return nil, err2
+}
+
+func SniffHost(buf []byte) (string, error) {
+	sniffed, err := Sniff(buf)
 	if err != nil {
 		return "", err
 	}
-	return host, nil
+	return sniffed.Host, nil
 }
 
 func SniffFromHTTP(buf []byte) (string, error) {
 	var errorNotHTTP = fmt.Errorf("Common: sniff from HTTP failed")
-	// borrow from http.go
+	// the request may be incomplete, parse it by hand
 	buff := bytes.Split(buf, []byte("\r\n"))
+	if len(buff) == 1 {
+		if IsHttp(buf) {
+			return "", ErrSniffIncomplete
+		}
+		return "", errorNotHTTP
+	}
 	_, _, err := parseFirstLine(string(buff[0]))
 	if err != nil {
 		return "", errorNotHTTP
 	}
+	end := bytes.Index(buf, []byte("\r\n\r\n"))
+	if end == -1 {
+		// the last line may be cut
+		buff = buff[:len(buff)-1]
+	}
 	header := parseHeader(buff)
 	host := header.Get("Host")
+	if host == "" && end == -1 {
+		return "", ErrSniffIncomplete
+	}
 	if host == "" {
 		return "", errorNotHTTP
 	}
 	return host, nil
 }
 
+func parseFirstLine(line string) (method, link string, err error) {
+	strs := strings.SplitN(line, " ", 3)
+	if len(strs) != 3 || !IsHttp([]byte(line)) {
+		err = fmt.Errorf("Unable to parse header")
+		return
+	}
+	method = strings.ToLower(strings.TrimSpace(strs[0]))
+	link = strings.ToLower(strings.TrimSpace(strs[1]))
+	version := strings.ToLower(strings.TrimSpace(strs[2]))
+	if version != "http/1.1" && version != "http/1.0" {
+		err = fmt.Errorf("Support HTTP/1.x only")
+		return
+	}
+	return method, link, nil
+}
+
+func parseHeader(buf [][]byte) http.Header {
+	header := make(http.Header, 20)
+	for i, l := 1, len(buf); i < l; i++ {
+		b := bytes.SplitN(buf[i], []byte(":"), 2)
+		if len(b) != 2 {
+			continue
+		}
+		key := bytes.TrimSpace(b[0])
+		values := bytes.Split(bytes.TrimSpace(b[1]), []byte(","))
+		for _, v := range values {
+			header.Add(string(key), string(bytes.TrimSpace(v)))
+		}
+	}
+	return header
+}
+
 func SniffFromHTTPS(buf []byte) (string, error) {
+	hello, err := ParseClientHello(buf)
+	if err != nil {
+		return "", err
+	}
+	return hello.ServerName, nil
+}
+
+type ClientHello struct {
+	ServerName string
+	ALPN       []string
+}
+
+// ParseClientHello parses a tls ClientHello which may span several
+// records, ErrSniffIncomplete is returned if buf ends early
+func ParseClientHello(buf []byte) (*ClientHello, error) {
+	msg, err := readHandshake(buf)
+	if err != nil {
+		return nil, err
+	}
+	return parseClientHello(msg)
+}
+
+// parseClientHello parses the body of a ClientHello handshake message
+func parseClientHello(msg []byte) (*ClientHello, error) {
 	var errorNotHTTPS = fmt.Errorf("Common: sniff from HTTPS failed")
-	// tls
-	if len(buf) < 5 || buf[0] != 0x16 {
-		return "", errorNotHTTPS
-	}
-	// version
-	if buf[1] != 0x03 || buf[2] < 0x01 || buf[2] > 0x04 {
-		return "", errorNotHTTPS
-	}
-	// max length
-	var maxlen = int(buf[3])<<8 | int(buf[4])
-	if maxlen+5 > len(buf) || maxlen < 42 {
-		return "", errorNotHTTPS
-	}
-	var index = 43
-	var next = 0
-	// session id
-	next = countNext(buf[index:], 1)
-	if next == -1 || index+next+1+2 > maxlen+5 {
-		return "", errorNotHTTPS
-	}
-	index = index + next + 1
-	// cipher suits
-	next = countNext(buf[index:], 2)
-	if next == -1 || next%2 == 1 || index+next+2+1 > maxlen+5 {
-		return "", errorNotHTTPS
-	}
-	index = index + next + 2
-	// compression method
-	next = countNext(buf[index:], 1)
-	if next == -1 || index+next+1+2 > maxlen+5 {
-		return "", errorNotHTTPS
-	}
-	index = index + next + 1
-	// extensions
-	next = countNext(buf[index:], 2)
-	if next == -1 || index+next+2 != maxlen+5 {
-		return "", errorNotHTTPS
-	}
-	index += 2
-	for {
-		if index+4 > maxlen+5 {
-			return "", errorNotHTTPS
+	// version, random
+	if len(msg) < 34 {
+		return nil, errorNotHTTPS
+	}
+	msg = msg[34:]
+	var ok bool
+	// session id, cipher suites, compression methods
+	for _, n := range []int{1, 2, 1} {
+		if _, msg, ok = readVector(msg, n); !ok {
+			return nil, errorNotHTTPS
 		}
-		if buf[index] == 0x00 && buf[index+1] == 0x00 {
-			break
+	}
+	exts, _, ok := readVector(msg, 2)
+	if !ok {
+		return nil, errorNotHTTPS
+	}
+	hello := new(ClientHello)
+	for len(exts) > 0 {
+		if len(exts) < 2 {
+			return nil, errorNotHTTPS
+		}
+		typ := int(exts[0])<<8 | int(exts[1])
+		var ext []byte
+		if ext, exts, ok = readVector(exts[2:], 2); !ok {
+			return nil, errorNotHTTPS
+		}
+		switch typ {
+		case 0x0000:
+			hello.ServerName = parseSNI(ext)
+		case 0x0010:
+			hello.ALPN = parseALPN(ext)
 		}
-		next = countNext(buf[index+2:], 2)
-		index = index + next + 4
 	}
-	snilen := countNext(buf[index+2:], 2)
-	host := parseSNI(buf[index+4 : index+snilen+4])
-	if host == "" {
-		return "", errorNotHTTPS
+	if hello.ServerName == "" {
+		return nil, errorNotHTTPS
 	}
-	return host, nil
+	return hello, nil
+}
 
+// readHandshake reassembles the first handshake message from records
+// and returns its body, which must be a ClientHello
+func readHandshake(buf []byte) ([]byte, error) {
+	var errorNotHTTPS = fmt.Errorf("Common: sniff from HTTPS failed")
+	var msg []byte
+	for {
+		// record header
+		if len(buf) < 1 {
+			return nil, ErrSniffIncomplete
+		}
+		if buf[0] != 0x16 {
+			return nil, errorNotHTTPS
+		}
+		if len(buf) >= 3 && (buf[1] != 0x03 || buf[2] > 0x04) {
+			return nil, errorNotHTTPS
+		}
+		if len(buf) < 5 {
+			return nil, ErrSniffIncomplete
+		}
+		n := int(buf[3])<<8 | int(buf[4])
+		if n == 0 || n > 1<<14 {
+			return nil, errorNotHTTPS
+		}
+		if len(buf) < 5+n {
+			msg = append(msg, buf[5:]...)
+			if len(msg) >= 1 && msg[0] != 0x01 {
+				return nil, errorNotHTTPS
+			}
+			return nil, ErrSniffIncomplete
+		}
+		msg = append(msg, buf[5:5+n]...)
+		buf = buf[5+n:]
+		// handshake header
+		if msg[0] != 0x01 {
+			return nil, errorNotHTTPS
+		}
+		if len(msg) < 4 {
+			continue
+		}
+		l := int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3])
+		if len(msg) >= 4+l {
+			return msg[4 : 4+l], nil
+		}
+	}
 }
 
-func countNext(buf []byte, n int) int {
-	var step int
-	if n == 1 {
-		step = int(buf[0])
-	} else if n == 2 {
-		step = int(buf[0])<<8 | int(buf[1])
-	} else {
-		return -1
+// readVector reads a vector with n bytes length prefix
+func readVector(buf []byte, n int) (vec, rest []byte, ok bool) {
+	if len(buf) < n {
+		return nil, nil, false
+	}
+	var l int
+	for _, b := range buf[:n] {
+		l = l<<8 | int(b)
 	}
-	if step+n > len(buf) {
-		return -1
+	buf = buf[n:]
+	if len(buf) < l {
+		return nil, nil, false
 	}
-	return step
+	return buf[:l], buf[l:], true
 }
 
 func parseSNI(buf []byte) string {
-	maxlen := int(buf[0])<<8 | int(buf[1])
-	buf = buf[2:]
-	if len(buf) != maxlen {
+	list, _, ok := readVector(buf, 2)
+	if !ok {
 		return ""
 	}
-	for {
-		if len(buf) < 3 {
-			return ""
-		}
-		nameType := buf[0]
-		nameLen := int(buf[1])<<8 | int(buf[2])
-		buf = buf[3:]
-		if len(buf) < nameLen {
+	for len(list) > 0 {
+		nameType := list[0]
+		var name []byte
+		if name, list, ok = readVector(list[1:], 2); !ok {
 			return ""
 		}
 		if nameType == 0x00 {
-			host := string(buf[:nameLen])
+			host := string(name)
 			if strings.HasSuffix(host, ".") {
 				return ""
 			}
 			return host
 		}
 	}
+	return ""
+}
+
+func parseALPN(buf []byte) []string {
+	list, _, ok := readVector(buf, 2)
+	if !ok {
+		return nil
+	}
+	var protos []string
+	for len(list) > 0 {
+		var proto []byte
+		if proto, list, ok = readVector(list, 1); !ok {
+			return nil
+		}
+		protos = append(protos, string(proto))
+	}
+	return protos
+}
 
+// splitHostPort returns the default port if host has no port
+func splitHostPort(host, port string) (string, string) {
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		return h, p
+	}
+	return strings.Trim(host, "[]"), port
 }
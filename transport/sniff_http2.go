@@ -0,0 +1,101 @@
+package transport
+
+import (
+	"bytes"
+	"fmt"
+
+	"golang.org/x/net/http2/hpack"
+)
+
+// client connection preface of h2c with prior knowledge
+var http2Preface = []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+
+// IsHttp2 reports whether buf starts with, or is a part of, the preface
+func IsHttp2(buf []byte) bool {
+	if len(buf) < 3 {
+		return false
+	}
+	if len(buf) < len(http2Preface) {
+		return bytes.HasPrefix(http2Preface, buf)
+	}
+	return bytes.HasPrefix(buf, http2Preface)
+}
+
+// SniffFromHTTP2 returns :authority, or host, of the first HEADERS frame
+func SniffFromHTTP2(buf []byte) (string, error) {
+	var errorNotHTTP2 = fmt.Errorf("Common: sniff from HTTP/2 failed")
+	if len(buf) < len(http2Preface) {
+		return "", ErrSniffIncomplete
+	}
+	buf = buf[len(http2Preface):]
+	var block []byte
+	var stream uint32
+	for {
+		// frame header
+		if len(buf) < 9 {
+			return "", ErrSniffIncomplete
+		}
+		length := int(buf[0])<<16 | int(buf[1])<<8 | int(buf[2])
+		typ, flags := buf[3], buf[4]
+		id := (uint32(buf[5])<<24 | uint32(buf[6])<<16 | uint32(buf[7])<<8 | uint32(buf[8])) & 0x7fffffff
+		// SETTINGS_MAX_FRAME_SIZE is not negotiated yet
+		if length > 1<<14 {
+			return "", errorNotHTTP2
+		}
+		if len(buf) < 9+length {
+			return "", ErrSniffIncomplete
+		}
+		payload := buf[9 : 9+length]
+		buf = buf[9+length:]
+		switch {
+		case typ == 0x01 && block == nil:
+			// HEADERS
+			if flags&0x08 != 0 {
+				// PADDED
+				if len(payload) < 1 || int(payload[0]) >= len(payload) {
+					return "", errorNotHTTP2
+				}
+				payload = payload[1 : len(payload)-int(payload[0])]
+			}
+			if flags&0x20 != 0 {
+				// PRIORITY
+				if len(payload) < 5 {
+					return "", errorNotHTTP2
+				}
+				payload = payload[5:]
+			}
+			block = append([]byte{}, payload...)
+			stream = id
+		case typ == 0x09 && block != nil && id == stream:
+			// CONTINUATION
+			block = append(block, payload...)
+		case block != nil:
+			// the header block must be contiguous
+			return "", errorNotHTTP2
+		default:
+			// SETTINGS, WINDOW_UPDATE, PRIORITY..
+			continue
+		}
+		// END_HEADERS
+		if flags&0x04 == 0 {
+			continue
+		}
+		fields, err := hpack.NewDecoder(4096, nil).DecodeFull(block)
+		if err != nil {
+			return "", errorNotHTTP2
+		}
+		var host string
+		for _, f := range fields {
+			if f.Name == ":authority" {
+				return f.Value, nil
+			}
+			if f.Name == "host" && host == "" {
+				host = f.Value
+			}
+		}
+		if host == "" {
+			return "", errorNotHTTP2
+		}
+		return host, nil
+	}
+}
@@ -0,0 +1,114 @@
+package transport
+
+import (
+	"bytes"
+	"testing"
+
+	"golang.org/x/net/http2/hpack"
+)
+
+// headerBlock encodes fields with hpack, names and values in turn
+func headerBlock(fields ...string) []byte {
+	var b bytes.Buffer
+	enc := hpack.NewEncoder(&b)
+	for i := 0; i+1 < len(fields); i += 2 {
+		enc.WriteField(hpack.HeaderField{Name: fields[i], Value: fields[i+1]})
+	}
+	return b.Bytes()
+}
+
+func http2Frame(typ, flags byte, stream uint32, payload []byte) []byte {
+	l := len(payload)
+	b := []byte{byte(l >> 16), byte(l >> 8), byte(l), typ, flags,
+		byte(stream >> 24), byte(stream >> 16), byte(stream >> 8), byte(stream)}
+	return append(b, payload...)
+}
+
+func TestSniffFromHTTP2(t *testing.T) {
+	settings := http2Frame(0x04, 0x00, 0, []byte{0x00, 0x03, 0x00, 0x00, 0x00, 0x64})
+	windowUpdate := http2Frame(0x08, 0x00, 0, []byte{0x00, 0x0f, 0x00, 0x01})
+	block := headerBlock(":method", "GET", ":scheme", "http", ":authority", "example.com:8080", ":path", "/")
+	cat := func(frames ...[]byte) []byte {
+		return bytes.Join(append([][]byte{http2Preface}, frames...), nil)
+	}
+	// pad length, block, padding
+	padded := append(append([]byte{3}, block...), 0, 0, 0)
+	// exclusive, dependency, weight
+	priority := append([]byte{0x80, 0x00, 0x00, 0x00, 0x0f}, block...)
+	full := cat(settings, http2Frame(0x01, 0x05, 1, block))
+	tests := []struct {
+		name string
+		buf  []byte
+		// ErrSniffIncomplete if empty with err
+		host string
+		err  error
+	}{
+		{"headers", full, "example.com:8080", nil},
+		{"after settings", cat(settings, windowUpdate, http2Frame(0x01, 0x05, 1, block)), "example.com:8080", nil},
+		{"padded", cat(http2Frame(0x01, 0x0d, 1, padded)), "example.com:8080", nil},
+		{"priority", cat(http2Frame(0x01, 0x25, 1, priority)), "example.com:8080", nil},
+		{"padded priority", cat(http2Frame(0x01, 0x2d, 1, append(append([]byte{2}, priority...), 0, 0))), "example.com:8080", nil},
+		{
+			"continuation",
+			cat(http2Frame(0x01, 0x01, 1, block[:5]), http2Frame(0x09, 0x00, 1, block[5:10]), http2Frame(0x09, 0x04, 1, block[10:])),
+			"example.com:8080", nil,
+		},
+		{"host", cat(http2Frame(0x01, 0x05, 1, headerBlock(":method", "GET", "host", "example.org"))), "example.org", nil},
+		{
+			"authority before host",
+			cat(http2Frame(0x01, 0x05, 1, headerBlock("host", "example.org", ":authority", "example.com"))),
+			"example.com", nil,
+		},
+		{"preface cut", http2Preface[:10], "", ErrSniffIncomplete},
+		{"preface only", cat(), "", ErrSniffIncomplete},
+		{"frame header cut", full[:len(http2Preface)+len(settings)+4], "", ErrSniffIncomplete},
+		{"frame cut", full[:len(full)-3], "", ErrSniffIncomplete},
+		{"continuation missing", cat(http2Frame(0x01, 0x01, 1, block[:5])), "", ErrSniffIncomplete},
+		{"no authority", cat(http2Frame(0x01, 0x05, 1, headerBlock(":method", "GET", ":path", "/"))), "", nil},
+		{"interleaved", cat(http2Frame(0x01, 0x01, 1, block[:5]), settings, http2Frame(0x09, 0x04, 1, block[5:])), "", nil},
+		{"continuation of another stream", cat(http2Frame(0x01, 0x01, 1, block[:5]), http2Frame(0x09, 0x04, 3, block[5:])), "", nil},
+		{"bad padding", cat(http2Frame(0x01, 0x0d, 1, append([]byte{200}, block...))), "", nil},
+		{"bad hpack", cat(http2Frame(0x01, 0x05, 1, []byte{0xff, 0xff, 0xff, 0xff})), "", nil},
+		{"frame too large", cat(http2Frame(0x00, 0x00, 1, make([]byte, 1<<14+1))), "", nil},
+	}
+	for _, tt := range tests {
+		host, err := SniffFromHTTP2(tt.buf)
+		switch {
+		case tt.host != "":
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			} else if host != tt.host {
+				t.Errorf("%s: host %s, expect %s", tt.name, host, tt.host)
+			}
+		case tt.err != nil:
+			if err != tt.err {
+				t.Errorf("%s: error %v, expect %v", tt.name, err, tt.err)
+			}
+		default:
+			if err == nil || err == ErrSniffIncomplete {
+				t.Errorf("%s: host %s error %v, expect a failure", tt.name, host, err)
+			}
+		}
+	}
+}
+
+func TestIsHttp2(t *testing.T) {
+	tests := []struct {
+		buf  []byte
+		want bool
+	}{
+		{http2Preface, true},
+		{append(append([]byte(nil), http2Preface...), 0x00, 0x00, 0x00, 0x04), true},
+		// the rest in the next package
+		{http2Preface[:3], true},
+		{http2Preface[:10], true},
+		{http2Preface[:2], false},
+		{[]byte("PRI * HTTP/1.1\r\n"), false},
+		{[]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"), false},
+	}
+	for _, tt := range tests {
+		if got := IsHttp2(tt.buf); got != tt.want {
+			t.Errorf("IsHttp2(%q) = %v, expect %v", tt.buf, got, tt.want)
+		}
+	}
+}
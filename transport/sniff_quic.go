@@ -0,0 +1,255 @@
+package transport
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+)
+
+// rfc9001, rfc9369
+var (
+	quicSaltV1 = []byte{0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17,
+		0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a}
+	quicSaltV2 = []byte{0x0d, 0xed, 0xe3, 0xde, 0xf7, 0x00, 0xa6, 0xdb, 0x81, 0x93,
+		0x81, 0xbe, 0x6e, 0x26, 0x9d, 0xcb, 0xf9, 0xbd, 0x2e, 0xd9}
+)
+
+const (
+	quicVersion1 = 0x00000001
+	quicVersion2 = 0x6b3343cf
+)
+
+// quicCrypto collects the CRYPTO frames of client Initial packets
+type quicCrypto map[uint64][]byte
+
+// SniffFromQUIC decrypts the client Initial packets in datagrams and
+// returns the ClientHello, which may span several datagrams
+func SniffFromQUIC(datagrams [][]byte) (*ClientHello, error) {
+	var errorNotQUIC = fmt.Errorf("Common: sniff from QUIC failed")
+	crypto := make(quicCrypto)
+	for _, d := range datagrams {
+		if err := crypto.readDatagram(d); err != nil {
+			return nil, errorNotQUIC
+		}
+	}
+	if len(crypto) == 0 {
+		return nil, errorNotQUIC
+	}
+	// reassemble from offset 0, frames may be out of order or overlapped
+	var msg []byte
+	for grown := true; grown; {
+		grown = false
+		for offset, data := range crypto {
+			end := offset + uint64(len(data))
+			if offset <= uint64(len(msg)) && end > uint64(len(msg)) {
+				msg = append(msg, data[uint64(len(msg))-offset:]...)
+				grown = true
+			}
+		}
+	}
+	if len(msg) < 4 {
+		return nil, ErrSniffIncomplete
+	}
+	if msg[0] != 0x01 {
+		return nil, errorNotQUIC
+	}
+	l := int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3])
+	if len(msg) < 4+l {
+		return nil, ErrSniffIncomplete
+	}
+	return parseClientHello(msg[4 : 4+l])
+}
+
+// readDatagram reads coalesced long header packets, the rest of
+// the datagram is ignored once a packet is not an Initial
+func (c quicCrypto) readDatagram(d []byte) error {
+	for len(d) > 0 {
+		// long header, fixed bit
+		if d[0]&0xc0 != 0xc0 || len(d) < 7 {
+			return nil
+		}
+		version := binary.BigEndian.Uint32(d[1:5])
+		var salt []byte
+		var initial byte
+		var labels [3]string
+		switch version {
+		case quicVersion1:
+			salt, initial = quicSaltV1, 0
+			labels = [3]string{"quic key", "quic iv", "quic hp"}
+		case quicVersion2:
+			salt, initial = quicSaltV2, 1
+			labels = [3]string{"quicv2 key", "quicv2 iv", "quicv2 hp"}
+		default:
+			return fmt.Errorf("unsupported version %x", version)
+		}
+		if (d[0]>>4)&0x03 != initial {
+			return nil
+		}
+		// dcid, scid
+		i := 5
+		dcid, rest, ok := readVector(d[i:], 1)
+		if !ok || len(dcid) > 20 {
+			return fmt.Errorf("invalid dcid")
+		}
+		i = len(d) - len(rest)
+		if _, rest, ok = readVector(d[i:], 1); !ok {
+			return fmt.Errorf("invalid scid")
+		}
+		i = len(d) - len(rest)
+		// token
+		tokenLen, n := readVarint(d[i:])
+		if n == 0 || uint64(len(d)-i-n) < tokenLen {
+			return fmt.Errorf("invalid token")
+		}
+		i += n + int(tokenLen)
+		length, n := readVarint(d[i:])
+		if n == 0 || uint64(len(d)-i-n) < length {
+			return fmt.Errorf("invalid length")
+		}
+		i += n
+		packet, next := d[:i+int(length)], d[i+int(length):]
+		payload, err := openInitial(packet, i, dcid, salt, labels)
+		if err != nil {
+			return err
+		}
+		if err = c.readFrames(payload); err != nil {
+			return err
+		}
+		d = next
+	}
+	return nil
+}
+
+// openInitial removes header protection and decrypts the packet whose
+// packet number starts at pnOffset
+func openInitial(packet []byte, pnOffset int, dcid, salt []byte, labels [3]string) ([]byte, error) {
+	secret := hkdfExtract(salt, dcid)
+	client := hkdfExpandLabel(secret, "client in", 32)
+	key := hkdfExpandLabel(client, labels[0], 16)
+	iv := hkdfExpandLabel(client, labels[1], 12)
+	hp := hkdfExpandLabel(client, labels[2], 16)
+	// header protection sample
+	if len(packet) < pnOffset+4+16 {
+		return nil, fmt.Errorf("packet too short")
+	}
+	block, err := aes.NewCipher(hp)
+	if err != nil {
+		return nil, err
+	}
+	mask := make([]byte, 16)
+	block.Encrypt(mask, packet[pnOffset+4:pnOffset+4+16])
+	header := append([]byte(nil), packet[:pnOffset+4]...)
+	header[0] ^= mask[0] & 0x0f
+	pnLen := int(header[0]&0x03) + 1
+	var pn uint64
+	for i := 0; i < pnLen; i++ {
+		header[pnOffset+i] ^= mask[1+i]
+		pn = pn<<8 | uint64(header[pnOffset+i])
+	}
+	header = header[:pnOffset+pnLen]
+	// payload
+	block, err = aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, 12)
+	copy(nonce, iv)
+	for i := 0; i < 8; i++ {
+		nonce[11-i] ^= byte(pn >> (8 * i))
+	}
+	return aead.Open(nil, nonce, packet[pnOffset+pnLen:], header)
+}
+
+// readFrames keeps CRYPTO frames, Initial packets from the client carry
+// only PADDING, PING, ACK, CRYPTO and CONNECTION_CLOSE
+func (c quicCrypto) readFrames(b []byte) error {
+	for len(b) > 0 {
+		typ, n := readVarint(b)
+		if n == 0 {
+			return fmt.Errorf("invalid frame")
+		}
+		b = b[n:]
+		switch typ {
+		case 0x00, 0x01:
+			// PADDING, PING
+		case 0x02, 0x03:
+			// ACK: largest, delay, range count, first range, ranges, [ecn]
+			var fields [4]uint64
+			for i := range fields {
+				if fields[i], n = readVarint(b); n == 0 {
+					return fmt.Errorf("invalid ack")
+				}
+				b = b[n:]
+			}
+			count := 2 * fields[2]
+			if typ == 0x03 {
+				count += 3
+			}
+			for ; count > 0; count-- {
+				if _, n = readVarint(b); n == 0 {
+					return fmt.Errorf("invalid ack")
+				}
+				b = b[n:]
+			}
+		case 0x06:
+			// CRYPTO
+			offset, n := readVarint(b)
+			if n == 0 {
+				return fmt.Errorf("invalid crypto")
+			}
+			b = b[n:]
+			length, n := readVarint(b)
+			if n == 0 || uint64(len(b)-n) < length {
+				return fmt.Errorf("invalid crypto")
+			}
+			b = b[n:]
+			c[offset] = append([]byte(nil), b[:length]...)
+			b = b[length:]
+		case 0x1c:
+			return fmt.Errorf("connection closed")
+		default:
+			return fmt.Errorf("unexpected frame %x", typ)
+		}
+	}
+	return nil
+}
+
+// readVarint returns the value and its size, which is 0 if b is too short
+func readVarint(b []byte) (uint64, int) {
+	if len(b) == 0 {
+		return 0, 0
+	}
+	n := 1 << (b[0] >> 6)
+	if len(b) < n {
+		return 0, 0
+	}
+	v := uint64(b[0] & 0x3f)
+	for _, x := range b[1:n] {
+		v = v<<8 | uint64(x)
+	}
+	return v, n
+}
+
+func hkdfExtract(salt, secret []byte) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(secret)
+	return mac.Sum(nil)
+}
+
+// hkdfExpandLabel with empty context, length is no more than 32
+func hkdfExpandLabel(secret []byte, label string, length int) []byte {
+	label = "tls13 " + label
+	info := []byte{byte(length >> 8), byte(length), byte(len(label))}
+	info = append(info, label...)
+	info = append(info, 0x00, 0x01)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(info)
+	return mac.Sum(nil)[:length]
+}
@@ -0,0 +1,188 @@
+package transport
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"os"
+	"strings"
+	"testing"
+)
+
+// rfc9001 a.1, rfc9369 a.1
+var quicDCID = []byte{0x83, 0x94, 0xc8, 0xf0, 0x3e, 0x51, 0x57, 0x08}
+
+// readHex reads a hex dump in testdata
+func readHex(t *testing.T, name string) []byte {
+	b, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = hex.DecodeString(strings.Join(strings.Fields(string(b)), ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// sealInitial returns a client Initial packet of version 1 carrying payload
+func sealInitial(t *testing.T, dcid, payload []byte) []byte {
+	const pn = 2
+	client := hkdfExpandLabel(hkdfExtract(quicSaltV1, dcid), "client in", 32)
+	key := hkdfExpandLabel(client, "quic key", 16)
+	iv := hkdfExpandLabel(client, "quic iv", 12)
+	hp := hkdfExpandLabel(client, "quic hp", 16)
+	// 4 bytes packet number
+	header := []byte{0xc3, 0x00, 0x00, 0x00, 0x01, byte(len(dcid))}
+	header = append(header, dcid...)
+	length := 4 + len(payload) + 16
+	header = append(header, 0x00, 0x00, 0x40|byte(length>>8), byte(length))
+	pnOffset := len(header)
+	header = append(header, 0x00, 0x00, 0x00, pn)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := append([]byte(nil), iv...)
+	nonce[11] ^= pn
+	packet := aead.Seal(append([]byte(nil), header...), nonce, payload, header)
+	block, err = aes.NewCipher(hp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mask := make([]byte, 16)
+	block.Encrypt(mask, packet[pnOffset+4:pnOffset+4+16])
+	packet[0] ^= mask[0] & 0x0f
+	for i := 0; i < 4; i++ {
+		packet[pnOffset+i] ^= mask[1+i]
+	}
+	return packet
+}
+
+// cryptoFrame returns a CRYPTO frame with 2 bytes offset and length
+func cryptoFrame(offset int, data []byte) []byte {
+	b := []byte{0x06, 0x40 | byte(offset>>8), byte(offset), 0x40 | byte(len(data)>>8), byte(len(data))}
+	return append(b, data...)
+}
+
+func TestQUICInitialSecrets(t *testing.T) {
+	tests := []struct {
+		name   string
+		salt   []byte
+		labels [2]string
+		secret string
+		key    string
+		iv     string
+	}{
+		{
+			"v1", quicSaltV1, [2]string{"quic key", "quic iv"},
+			"c00cf151ca5be075ed0ebfb5c80323c42d6b7db67881289af4008f1f6c357aea",
+			"1f369613dd76d5467730efcbe3b1a22d",
+			"fa044b2f42a3fd3b46fb255c",
+		},
+		{
+			"v2", quicSaltV2, [2]string{"quicv2 key", "quicv2 iv"},
+			"14ec9d6eb9fd7af83bf5a668bc17a7e283766aade7ecd0891f70f9ff7f4bf47b",
+			"8b1a0bc121284290a29e0971b5cd045d",
+			"91f73e2351d8fa91660e909f",
+		},
+	}
+	for _, tt := range tests {
+		client := hkdfExpandLabel(hkdfExtract(tt.salt, quicDCID), "client in", 32)
+		if got := hex.EncodeToString(client); got != tt.secret {
+			t.Errorf("%s: client secret %s, expect %s", tt.name, got, tt.secret)
+		}
+		if got := hex.EncodeToString(hkdfExpandLabel(client, tt.labels[0], 16)); got != tt.key {
+			t.Errorf("%s: key %s, expect %s", tt.name, got, tt.key)
+		}
+		if got := hex.EncodeToString(hkdfExpandLabel(client, tt.labels[1], 12)); got != tt.iv {
+			t.Errorf("%s: iv %s, expect %s", tt.name, got, tt.iv)
+		}
+	}
+}
+
+func TestSniffFromQUIC(t *testing.T) {
+	v1 := readHex(t, "rfc9001_client_initial.hex")
+	v2 := readHex(t, "rfc9369_client_initial.hex")
+	// a ClientHello in two datagrams
+	msg := clientHello(t, "example.org", []string{"h3"})[5:]
+	half := len(msg) / 2
+	first := sealInitial(t, quicDCID, cryptoFrame(0, msg[:half]))
+	second := sealInitial(t, quicDCID, append(cryptoFrame(half, msg[half:]), make([]byte, 32)...))
+	// PING, ACK and an overlapping CRYPTO frame before the rest
+	mixed := []byte{0x01, 0x02, 0x00, 0x00, 0x00, 0x00}
+	mixed = append(mixed, cryptoFrame(half-10, msg[half-10:])...)
+	tampered := append([]byte(nil), v1...)
+	tampered[len(tampered)-1] ^= 0x01
+	unsupported := append([]byte(nil), v1...)
+	copy(unsupported[1:5], []byte{0xff, 0x00, 0x00, 0x1d})
+	tests := []struct {
+		name      string
+		datagrams [][]byte
+		// ErrSniffIncomplete if empty with err
+		host string
+		alpn []string
+		err  error
+	}{
+		{"rfc9001", [][]byte{v1}, "example.com", []string{"alpn"}, nil},
+		{"rfc9369", [][]byte{v2}, "example.com", []string{"alpn"}, nil},
+		{"two datagrams", [][]byte{first, second}, "example.org", []string{"h3"}, nil},
+		{"out of order", [][]byte{second, first}, "example.org", []string{"h3"}, nil},
+		{"overlapped", [][]byte{first, sealInitial(t, quicDCID, mixed)}, "example.org", []string{"h3"}, nil},
+		{"coalesced", [][]byte{append(append([]byte(nil), first...), second...)}, "example.org", []string{"h3"}, nil},
+		{"first datagram", [][]byte{first}, "", nil, ErrSniffIncomplete},
+		{"second datagram", [][]byte{second}, "", nil, ErrSniffIncomplete},
+		{"tampered", [][]byte{tampered}, "", nil, nil},
+		{"unsupported version", [][]byte{unsupported}, "", nil, nil},
+		{"short header", [][]byte{{0x40, 0x01, 0x02, 0x03}}, "", nil, nil},
+		{"cut", [][]byte{v1[:600]}, "", nil, nil},
+	}
+	for _, tt := range tests {
+		hello, err := SniffFromQUIC(tt.datagrams)
+		switch {
+		case tt.host != "":
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			} else if hello.ServerName != tt.host || strings.Join(hello.ALPN, ",") != strings.Join(tt.alpn, ",") {
+				t.Errorf("%s: %+v, expect %s %v", tt.name, hello, tt.host, tt.alpn)
+			}
+		case tt.err != nil:
+			if err != tt.err {
+				t.Errorf("%s: error %v, expect %v", tt.name, err, tt.err)
+			}
+		default:
+			if err == nil || err == ErrSniffIncomplete {
+				t.Errorf("%s: error %v, expect a failure", tt.name, err)
+			}
+		}
+	}
+}
+
+func TestReadVarint(t *testing.T) {
+	// rfc9000 a.1
+	tests := []struct {
+		b    string
+		want uint64
+		n    int
+	}{
+		{"c2197c5eff14e88c", 151288809941952652, 8},
+		{"9d7f3e7d", 494878333, 4},
+		{"7bbd", 15293, 2},
+		{"25", 37, 1},
+		{"4025", 37, 2},
+		// followed by the next field
+		{"25ff", 37, 1},
+		{"7b", 0, 0},
+		{"", 0, 0},
+	}
+	for _, tt := range tests {
+		b, _ := hex.DecodeString(tt.b)
+		if v, n := readVarint(b); v != tt.want || n != tt.n {
+			t.Errorf("readVarint(%s) = %d, %d, expect %d, %d", tt.b, v, n, tt.want, tt.n)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package transport
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// clientHello returns the first record crypto/tls sends
+func clientHello(t *testing.T, sni string, alpn []string) []byte {
+	client, server := net.Pipe()
+	defer server.Close()
+	go tls.Client(client, &tls.Config{ServerName: sni, NextProtos: alpn, InsecureSkipVerify: true}).Handshake()
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(server, header); err != nil {
+		t.Fatal(err)
+	}
+	record := make([]byte, 5+(int(header[3])<<8|int(header[4])))
+	copy(record, header)
+	if _, err := io.ReadFull(server, record[5:]); err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+// fragment splits the handshake message of record into records of size
+func fragment(record []byte, size int) []byte {
+	var b []byte
+	msg := record[5:]
+	for len(msg) > 0 {
+		n := size
+		if n > len(msg) {
+			n = len(msg)
+		}
+		b = append(b, 0x16, 0x03, 0x01, byte(n>>8), byte(n))
+		b = append(b, msg[:n]...)
+		msg = msg[n:]
+	}
+	return b
+}
+
+func TestParseClientHello(t *testing.T) {
+	record := clientHello(t, "example.com", []string{"h2", "http/1.1"})
+	want := &ClientHello{ServerName: "example.com", ALPN: []string{"h2", "http/1.1"}}
+	noSNI := clientHello(t, "", nil)
+	tests := []struct {
+		name string
+		buf  []byte
+		// ErrSniffIncomplete if nil with err
+		want *ClientHello
+		err  error
+	}{
+		{"one record", record, want, nil},
+		{"records of 1 byte", fragment(record, 1), want, nil},
+		// the handshake header spans two records
+		{"records of 3 bytes", fragment(record, 3), want, nil},
+		{"records of 100 bytes", fragment(record, 100), want, nil},
+		{"followed by data", append(fragment(record, 64), 0x17, 0x03, 0x03, 0x00, 0x01, 0x00), want, nil},
+		{"record header cut", record[:3], nil, ErrSniffIncomplete},
+		{"record cut", record[:len(record)/2], nil, ErrSniffIncomplete},
+		{"second record missing", fragment(record, 100)[:105], nil, ErrSniffIncomplete},
+		{"second record cut", fragment(record, 100)[:110], nil, ErrSniffIncomplete},
+		{"empty", nil, nil, ErrSniffIncomplete},
+		{"no sni", noSNI, nil, nil},
+		{"not a handshake", []byte{0x17, 0x03, 0x03, 0x00, 0x01, 0x00}, nil, nil},
+		{"not a client hello", []byte{0x16, 0x03, 0x03, 0x00, 0x04, 0x02, 0x00, 0x00, 0x00}, nil, nil},
+		{"bad version", []byte{0x16, 0x02, 0x00, 0x00, 0x04}, nil, nil},
+		{"http", []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"), nil, nil},
+	}
+	for _, tt := range tests {
+		hello, err := ParseClientHello(tt.buf)
+		switch {
+		case tt.want != nil:
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			} else if !reflect.DeepEqual(hello, tt.want) {
+				t.Errorf("%s: %+v, expect %+v", tt.name, hello, tt.want)
+			}
+		case tt.err != nil:
+			if err != tt.err {
+				t.Errorf("%s: error %v, expect %v", tt.name, err, tt.err)
+			}
+		default:
+			if err == nil || err == ErrSniffIncomplete {
+				t.Errorf("%s: error %v, expect a failure", tt.name, err)
+			}
+		}
+	}
+}
+
+func TestSniff(t *testing.T) {
+	record := clientHello(t, "example.com", []string{"h2"})
+	tests := []struct {
+		name string
+		buf  []byte
+		want *Sniffed
+		err  error
+	}{
+		{"http", []byte("GET / HTTP/1.1\r\nHost: example.com:8080\r\n\r\n"), &Sniffed{Proto: "http", Host: "example.com:8080"}, nil},
+		{"http cut", []byte("GET / HTTP/1.1\r\nUser-Agent: x\r\nHo"), nil, ErrSniffIncomplete},
+		{"https", fragment(record, 50), &Sniffed{Proto: "https", Host: "example.com", ALPN: []string{"h2"}}, nil},
+		{"https cut", fragment(record, 50)[:120], nil, ErrSniffIncomplete},
+	}
+	for _, tt := range tests {
+		sniffed, err := Sniff(tt.buf)
+		if err != tt.err {
+			t.Errorf("%s: error %v, expect %v", tt.name, err, tt.err)
+			continue
+		}
+		if !reflect.DeepEqual(sniffed, tt.want) {
+			t.Errorf("%s: %+v, expect %+v", tt.name, sniffed, tt.want)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package transport
+
+import (
+	"bytes"
+	"fmt"
+	"mitsuyu/common"
+	"net"
+	"strconv"
+	"time"
+)
+
+type Socks4 struct {
+	conn   net.Conn
+	addr   *common.Addr
+	buffer *bytes.Buffer
+	reply  bool
+}
+
+func (s4 *Socks4) Addr() *common.Addr {
+	return s4.addr
+}
+
+func (s4 *Socks4) Proto() string {
+	return "socks4"
+}
+
+func (s4 *Socks4) SetAddr(addr *common.Addr) {
+	s4.addr = addr
+}
+
+func (s4 *Socks4) SetBuffer(buffer *bytes.Buffer) {
+	s4.buffer = buffer
+}
+
+// Reply sends the deferred reply, only the first call takes effect
+func (s4 *Socks4) Reply(status string, bind *common.Addr) error {
+	if s4.reply {
+		return nil
+	}
+	s4.reply = true
+	var rep byte = 0x5b
+	if status == common.STATUS_OK {
+		rep = 0x5a
+	}
+	return sendSocks4Reply(s4.conn, rep, bind)
+}
+
+func (s4 *Socks4) Read(b []byte) (int, error) {
+	if s4.buffer == nil {
+		return s4.conn.Read(b)
+	}
+	n, err := s4.buffer.Read(b)
+	if s4.buffer.Len() == 0 {
+		s4.buffer = nil
+	}
+	return n, err
+}
+
+func (s4 *Socks4) SetReadDeadline(t time.Time) error {
+	return s4.conn.SetReadDeadline(t)
+}
+func (s4 *Socks4) Write(b []byte) (int, error) {
+	return s4.conn.Write(b)
+}
+func (s4 *Socks4) CloseWrite() error {
+	return CloseWrite(s4.conn)
+}
+
+func (s4 *Socks4) Close() error {
+	return s4.conn.Close()
+}
+
+// IsSocks4 reports whether buf starts like a socks4 connect request,
+// which may be followed by data
+func IsSocks4(buf []byte) bool {
+	return len(buf) >= 9 && buf[0] == 0x04 && buf[1] == 0x01 && bytes.IndexByte(buf[8:], 0x00) >= 0
+}
+
+// Socks4Handshake handles both socks4 and socks4a,
+// which are refused if users is not empty since neither supports password
+func Socks4Handshake(buf []byte, conn net.Conn, users []*common.User) (*Socks4, error) {
+	if !IsSocks4(buf) {
+		return nil, wrapErrorSocks4(fmt.Errorf("bad request"))
+	}
+	if len(users) != 0 {
+		sendSocks4Reply(conn, 0x5b, nil)
+		return nil, wrapErrorSocks4(fmt.Errorf("auth required"))
+	}
+	addr, n, err := parseSocks4Request(buf)
+	if err != nil {
+		sendSocks4Reply(conn, 0x5b, nil)
+		return nil, wrapErrorSocks4(err)
+	}
+	// reply is deferred until the outbound is ready
+	s4 := &Socks4{conn: conn, addr: addr}
+	if n < len(buf) {
+		s4.buffer = bytes.NewBuffer(append([]byte(nil), buf[n:]...))
+	}
+	return s4, nil
+}
+
+// VN CD DSTPORT DSTIP USERID NULL [DOMAIN NULL], the length of the
+// request is returned since data may follow
+func parseSocks4Request(buf []byte) (*common.Addr, int, error) {
+	port := strconv.Itoa(int(buf[2])<<8 | int(buf[3]))
+	ip := net.IP(buf[4:8])
+	userEnd := bytes.IndexByte(buf[8:], 0x00)
+	if userEnd == -1 {
+		return nil, 0, fmt.Errorf("bad userid")
+	}
+	n := 8 + userEnd + 1
+	// socks4a, 0.0.0.x
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		hostEnd := bytes.IndexByte(buf[n:], 0x00)
+		if hostEnd <= 0 {
+			return nil, 0, fmt.Errorf("bad domain name")
+		}
+		host := string(buf[n : n+hostEnd])
+		isdn := net.ParseIP(host) == nil
+		return &common.Addr{Isdn: isdn, Host: host, Port: port}, n + hostEnd + 1, nil
+	}
+	return &common.Addr{Isdn: false, Host: ip.String(), Port: port}, n, nil
+}
+
+// VN(0) CD BNDPORT BNDIP, bind address is 0.0.0.0:0 if not ipv4
+func sendSocks4Reply(conn net.Conn, rep byte, bind *common.Addr) error {
+	r := [8]byte{0: 0x00, 1: rep}
+	if bind != nil {
+		if ip4 := net.ParseIP(bind.Host).To4(); ip4 != nil {
+			port, _ := strconv.Atoi(bind.Port)
+			r[2], r[3] = byte(port>>8), byte(port)
+			copy(r[4:], ip4)
+		}
+	}
+	_, err := conn.Write(r[:])
+	return err
+}
+
+func wrapErrorSocks4(err error) error {
+	return fmt.Errorf("Socks4 handshake: %v", err)
+}
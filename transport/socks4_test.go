@@ -0,0 +1,131 @@
+package transport
+
+import (
+	"bytes"
+	"io"
+	"mitsuyu/common"
+	"testing"
+)
+
+func TestSocks4Handshake(t *testing.T) {
+	reject := []byte{0x00, 0x5b, 0, 0, 0, 0, 0, 0}
+	tests := []struct {
+		name  string
+		buf   []byte
+		users []*common.User
+		addr  *common.Addr
+		// pipelined after the request
+		data    string
+		replies []byte
+		err     bool
+	}{
+		{
+			name: "socks4",
+			buf:  []byte{0x04, 0x01, 0x01, 0xbb, 192, 0, 2, 1, 0x00},
+			addr: &common.Addr{Host: "192.0.2.1", Port: "443"},
+		},
+		{
+			name: "socks4 userid",
+			buf:  append([]byte{0x04, 0x01, 0x00, 0x50, 192, 0, 2, 1}, "al\x00"...),
+			addr: &common.Addr{Host: "192.0.2.1", Port: "80"},
+		},
+		{
+			name: "socks4 pipelined",
+			buf:  append([]byte{0x04, 0x01, 0x00, 0x50, 192, 0, 2, 1}, "al\x00GET / HTTP/1.0\r\n\r\n"...),
+			addr: &common.Addr{Host: "192.0.2.1", Port: "80"},
+			data: "GET / HTTP/1.0\r\n\r\n",
+		},
+		{
+			name: "socks4a",
+			buf:  append([]byte{0x04, 0x01, 0x00, 0x50, 0, 0, 0, 1}, "\x00example.com\x00"...),
+			addr: &common.Addr{Isdn: true, Host: "example.com", Port: "80"},
+		},
+		{
+			name: "socks4a ip",
+			buf:  append([]byte{0x04, 0x01, 0x00, 0x50, 0, 0, 0, 1}, "al\x00192.0.2.1\x00"...),
+			addr: &common.Addr{Host: "192.0.2.1", Port: "80"},
+		},
+		{
+			name: "socks4a pipelined",
+			buf:  append([]byte{0x04, 0x01, 0x00, 0x50, 0, 0, 0, 1}, "\x00example.com\x00hello"...),
+			addr: &common.Addr{Isdn: true, Host: "example.com", Port: "80"},
+			data: "hello",
+		},
+		{
+			name:    "socks4a no domain",
+			buf:     append([]byte{0x04, 0x01, 0x00, 0x50, 0, 0, 0, 1}, "\x00\x00"...),
+			replies: reject,
+			err:     true,
+		},
+		{
+			name:    "socks4a unterminated domain",
+			buf:     append([]byte{0x04, 0x01, 0x00, 0x50, 0, 0, 0, 1}, "\x00example.com"...),
+			replies: reject,
+			err:     true,
+		},
+		{
+			name:    "auth required",
+			buf:     []byte{0x04, 0x01, 0x01, 0xbb, 192, 0, 2, 1, 0x00},
+			users:   []*common.User{{Username: "al", Password: "secret"}},
+			replies: reject,
+			err:     true,
+		},
+		{
+			name: "bind",
+			buf:  []byte{0x04, 0x02, 0x01, 0xbb, 192, 0, 2, 1, 0x00},
+			err:  true,
+		},
+	}
+	for _, tt := range tests {
+		conn, replies := handshakeConn(nil)
+		s4, err := Socks4Handshake(tt.buf, conn, tt.users)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: expect an error", tt.name)
+			}
+		} else if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else {
+			if *s4.Addr() != *tt.addr {
+				t.Errorf("%s: addr %+v, expect %+v", tt.name, *s4.Addr(), *tt.addr)
+			}
+			if tt.data != "" {
+				b := make([]byte, len(tt.data))
+				if _, err := io.ReadFull(s4, b); err != nil || string(b) != tt.data {
+					t.Errorf("%s: read %q %v, expect %q", tt.name, b, err, tt.data)
+				}
+			}
+		}
+		conn.Close()
+		if b := <-replies; !bytes.Equal(b, tt.replies) {
+			t.Errorf("%s: replies %x, expect %x", tt.name, b, tt.replies)
+		}
+	}
+}
+
+func TestSocks4Reply(t *testing.T) {
+	tests := []struct {
+		status string
+		bind   *common.Addr
+		want   []byte
+	}{
+		{common.STATUS_OK, nil, []byte{0x00, 0x5a, 0, 0, 0, 0, 0, 0}},
+		{common.STATUS_OK, &common.Addr{Host: "192.0.2.1", Port: "1080"}, []byte{0x00, 0x5a, 0x04, 0x38, 192, 0, 2, 1}},
+		// no room for ipv6
+		{common.STATUS_OK, &common.Addr{Host: "2001:db8::1", Port: "1080"}, []byte{0x00, 0x5a, 0, 0, 0, 0, 0, 0}},
+		{common.STATUS_REFUSED, nil, []byte{0x00, 0x5b, 0, 0, 0, 0, 0, 0}},
+	}
+	for _, tt := range tests {
+		conn, replies := handshakeConn(nil)
+		s4 := &Socks4{conn: conn}
+		if err := s4.Reply(tt.status, tt.bind); err != nil {
+			t.Errorf("Reply(%s): %v", tt.status, err)
+		}
+		// only the first reply is sent
+		s4.Reply(common.STATUS_FAILURE, nil)
+		conn.Close()
+		if b := <-replies; !bytes.Equal(b, tt.want) {
+			t.Errorf("Reply(%s) = %x, expect %x", tt.status, b, tt.want)
+		}
+	}
+}
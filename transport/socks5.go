@@ -2,16 +2,21 @@ package transport
 
 import (
 	"bytes"
+	"crypto/subtle"
 	"fmt"
+	"io"
 	"mitsuyu/common"
 	"net"
 	"strconv"
+	"time"
 )
 
 type Socks5 struct {
 	conn   net.Conn
 	addr   *common.Addr
+	user   *common.User
 	buffer *bytes.Buffer
+	reply  bool
 }
 
 func (s5 *Socks5) Addr() *common.Addr {
@@ -22,6 +27,11 @@ func (s5 *Socks5) Proto() string {
 	return "socks5"
 }
 
+// User returns the authenticated user, nil if no auth
+func (s5 *Socks5) User() *common.User {
+	return s5.user
+}
+
 func (s5 *Socks5) SetAddr(addr *common.Addr) {
 	s5.addr = addr
 }
@@ -30,97 +40,254 @@ func (s5 *Socks5) SetBuffer(buffer *bytes.Buffer) {
 	s5.buffer = buffer
 }
 
+// Reply sends the deferred data reply, only the first call takes effect
+func (s5 *Socks5) Reply(status string, bind *common.Addr) error {
+	if s5.reply {
+		return nil
+	}
+	s5.reply = true
+	return sendDataReply(s5.conn, socks5ReplyCode(status), bind)
+}
+
 func (s5 *Socks5) Read(b []byte) (int, error) {
 	if s5.buffer == nil {
 		return s5.conn.Read(b)
 	}
 	n, err := s5.buffer.Read(b)
-	s5.buffer = nil
+	if s5.buffer.Len() == 0 {
+		s5.buffer = nil
+	}
 	return n, err
 }
+
+func (s5 *Socks5) SetReadDeadline(t time.Time) error {
+	return s5.conn.SetReadDeadline(t)
+}
 func (s5 *Socks5) Write(b []byte) (int, error) {
 	return s5.conn.Write(b)
 }
+func (s5 *Socks5) CloseWrite() error {
+	return CloseWrite(s5.conn)
+}
+
 func (s5 *Socks5) Close() error {
 	return s5.conn.Close()
 }
 
-func Socks5Handshake(buf []byte, conn net.Conn) (*Socks5, error) {
+// IsSocks5 reports whether buf starts like a socks5 method request,
+// which may be followed by the next requests
+func IsSocks5(buf []byte) bool {
+	return len(buf) >= 2 && buf[0] == 0x05 && buf[1] != 0
+}
+
+// Socks5Handshake requires username/password auth if users is not empty,
+// buf is the first package, which may hold a part of the requests or
+// several of them, what is left after the data request is kept
+func Socks5Handshake(buf []byte, conn net.Conn, users []*common.User) (*Socks5, error) {
 	var err error
 	var addr *common.Addr
-	if err = selMethod(buf); err != nil {
+	var user *common.User
+	var method byte
+	pending := bytes.NewReader(buf)
+	r := io.MultiReader(pending, conn)
+	if method, err = selMethod(r, len(users) != 0); err != nil {
+		if IsSocks5(buf) {
+			sendMethod(conn, 0xff)
+		}
 		return nil, wrapErrorSocks5(err)
 	}
-	if err = sendNoAuthMethod(conn); err != nil {
+	if err = sendMethod(conn, method); err != nil {
 		return nil, wrapErrorSocks5(err)
 	}
-	if addr, err = recvDataRequest(conn); err != nil {
-		return nil, wrapErrorSocks5(err)
+	if method == 0x02 {
+		if user, err = recvUserPass(r, users); err != nil {
+			sendAuthReply(conn, 0x01)
+			return nil, wrapErrorSocks5(err)
+		}
+		if err = sendAuthReply(conn, 0x00); err != nil {
+			return nil, wrapErrorSocks5(err)
+		}
 	}
-	if err = sendDataReply(conn); err != nil {
+	if addr, err = recvDataRequest(r); err != nil {
+		if err == errCmdNotSupported {
+			sendDataReply(conn, 0x07, nil)
+		}
 		return nil, wrapErrorSocks5(err)
 	}
-	s5 := &Socks5{conn: conn, addr: addr}
+	// data reply is deferred until the outbound is ready
+	s5 := &Socks5{conn: conn, addr: addr, user: user}
+	if pending.Len() != 0 {
+		rest := make([]byte, pending.Len())
+		pending.Read(rest)
+		s5.buffer = bytes.NewBuffer(rest)
+	}
 	return s5, nil
 }
 
-// Select noauth as auth method
-func selMethod(buf []byte) error {
+// Select username/password if auth is required, otherwise noauth
+func selMethod(r io.Reader, auth bool) (byte, error) {
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return 0xff, err
+	}
 	if buf[0] != 0x05 {
-		return fmt.Errorf("invalid version %d", buf[0])
+		return 0xff, fmt.Errorf("invalid version")
 	}
-
-	var nmethods, method int8
-	nmethods = int8(buf[1])
-	for i := int8(0); i < nmethods; i++ {
-		method = int8(buf[i+2])
-		if method == 0x00 {
-			break
+	methods := make([]byte, int(buf[1]))
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return 0xff, fmt.Errorf("bad method request")
+	}
+	var want byte = 0x00
+	if auth {
+		want = 0x02
+	}
+	for _, method := range methods {
+		if method == want {
+			return want, nil
 		}
 	}
-	if method != 0x00 {
-		return fmt.Errorf("method not supported")
+	return 0xff, fmt.Errorf("method not supported")
+}
+
+func sendMethod(conn net.Conn, method byte) error {
+	_, err := conn.Write([]byte{0x05, method})
+	return err
+}
+
+// Receive username/password request, rfc1929, which may arrive in pieces
+func recvUserPass(r io.Reader, users []*common.User) (*common.User, error) {
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	if buf[0] != 0x01 {
+		return nil, fmt.Errorf("bad auth request")
 	}
-	return nil
+	// uname is followed by plen
+	uname := make([]byte, int(buf[1])+1)
+	if _, err := io.ReadFull(r, uname); err != nil {
+		return nil, err
+	}
+	passwd := make([]byte, int(uname[len(uname)-1]))
+	if _, err := io.ReadFull(r, passwd); err != nil {
+		return nil, err
+	}
+	username := string(uname[:len(uname)-1])
+	password := string(passwd)
+	if user := MatchUser(users, username, password); user != nil {
+		return user, nil
+	}
+	return nil, fmt.Errorf("auth failed, user %s", username)
 }
 
-func sendNoAuthMethod(conn net.Conn) error {
-	_, err := conn.Write([]byte{0x05, 0x00})
+func sendAuthReply(conn net.Conn, status byte) error {
+	_, err := conn.Write([]byte{0x01, status})
 	return err
 }
 
-// Receive data request
-func recvDataRequest(conn net.Conn) (*common.Addr, error) {
-	buf := make([]byte, 256)
-	n, err := conn.Read(buf)
-	if err != nil {
+// MatchUser returns the user with the given credentials, or nil
+func MatchUser(users []*common.User, username, password string) *common.User {
+	for _, u := range users {
+		if u.Username == username &&
+			subtle.ConstantTimeCompare([]byte(u.Password), []byte(password)) == 1 {
+			return u
+		}
+	}
+	return nil
+}
+
+var errCmdNotSupported = fmt.Errorf("command not supported")
+
+// Receive data request, which may arrive in pieces
+func recvDataRequest(r io.Reader) (*common.Addr, error) {
+	// VER CMD RSV ATYP, and the length of a domain name
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(r, buf[:4]); err != nil {
 		return nil, err
 	}
-	if buf[0] != 0x05 || buf[1] != 0x01 || n < 6 {
+	if buf[0] != 0x05 {
 		return nil, fmt.Errorf("bad data request")
 	}
-	port := uint16(buf[n-2])<<8 | uint16(buf[n-1])
-	atyp := int8(buf[3])
-	var host string
+	if buf[1] != 0x01 {
+		return nil, errCmdNotSupported
+	}
+	atyp := buf[3]
+	var size int
 	switch atyp {
 	case 0x01:
-		host = net.IP(buf[4:8]).String()
+		size = 4
 	case 0x03:
-		l := int(buf[4])
-		host = string(buf[5 : l+5])
+		if _, err := io.ReadFull(r, buf[4:5]); err != nil {
+			return nil, err
+		}
+		size = int(buf[4])
 	case 0x04:
-		host = net.IP(buf[4:20]).String()
+		size = 16
+	default:
+		return nil, fmt.Errorf("address type not supported")
+	}
+	// address and port
+	b := make([]byte, size+2)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	var host string
+	if atyp == 0x03 {
+		host = string(b[:size])
+	} else {
+		host = net.IP(b[:size]).String()
 	}
+	port := uint16(b[size])<<8 | uint16(b[size+1])
 	var isdn = (atyp == 0x03 && net.ParseIP(host) == nil)
 	return &common.Addr{Isdn: isdn, Host: host, Port: strconv.Itoa(int(port))}, nil
 }
 
-func sendDataReply(conn net.Conn) error {
-	r := [10]byte{0: 0x05, 3: 0x01}
-	_, err := conn.Write(r[:])
+// Send data reply, bind address is 0.0.0.0:0 if unknown
+func sendDataReply(conn net.Conn, rep byte, bind *common.Addr) error {
+	r := []byte{0x05, rep, 0x00}
+	r = append(r, encodeSocks5Addr(bind)...)
+	_, err := conn.Write(r)
 	return err
 }
 
+func encodeSocks5Addr(addr *common.Addr) []byte {
+	b := make([]byte, 0, 22)
+	if addr == nil {
+		return append(b, 0x01, 0, 0, 0, 0, 0, 0)
+	}
+	ip := net.ParseIP(addr.Host)
+	if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, 0x01)
+		b = append(b, ip4...)
+	} else if ip != nil {
+		b = append(b, 0x04)
+		b = append(b, ip.To16()...)
+	} else {
+		b = append(b, 0x03, byte(len(addr.Host)))
+		b = append(b, addr.Host...)
+	}
+	port, _ := strconv.Atoi(addr.Port)
+	return append(b, byte(port>>8), byte(port))
+}
+
+func socks5ReplyCode(status string) byte {
+	switch status {
+	case common.STATUS_OK:
+		return 0x00
+	case common.STATUS_NOT_ALLOWED:
+		return 0x02
+	case common.STATUS_NET_UNREACHABLE:
+		return 0x03
+	case common.STATUS_HOST_UNREACHABLE:
+		return 0x04
+	case common.STATUS_REFUSED:
+		return 0x05
+	case common.STATUS_TTL_EXPIRED:
+		return 0x06
+	}
+	return 0x01
+}
+
 func wrapErrorSocks5(err error) error {
 	return fmt.Errorf("Socks5 handshake: %v", err)
 }
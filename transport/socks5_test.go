@@ -0,0 +1,221 @@
+package transport
+
+import (
+	"bytes"
+	"io"
+	"mitsuyu/common"
+	"net"
+	"testing"
+)
+
+// handshakeConn returns the server end of a connection whose client
+// writes rest byte by byte, and the replies the client reads until the
+// connection is closed
+func handshakeConn(rest []byte) (net.Conn, <-chan []byte) {
+	server, client := net.Pipe()
+	go func() {
+		for i := range rest {
+			if _, err := client.Write(rest[i : i+1]); err != nil {
+				return
+			}
+		}
+	}()
+	replies := make(chan []byte, 1)
+	go func() {
+		b, _ := io.ReadAll(client)
+		replies <- b
+	}()
+	return server, replies
+}
+
+func socks5Request(atyp byte, addr []byte, port int) []byte {
+	b := []byte{0x05, 0x01, 0x00, atyp}
+	b = append(b, addr...)
+	return append(b, byte(port>>8), byte(port))
+}
+
+func TestSocks5Handshake(t *testing.T) {
+	users := []*common.User{{Username: "al", Password: "secret"}}
+	ipv4 := socks5Request(0x01, []byte{192, 0, 2, 1}, 443)
+	domain := socks5Request(0x03, append([]byte{11}, "example.com"...), 80)
+	ipv6 := socks5Request(0x04, net.ParseIP("2001:db8::1"), 8080)
+	auth := append([]byte{0x01, 2}, "al"...)
+	auth = append(append(auth, 6), "secret"...)
+	badAuth := append([]byte{0x01, 2}, "al"...)
+	badAuth = append(append(badAuth, 3), "bad"...)
+	cat := func(bs ...[]byte) []byte {
+		return bytes.Join(bs, nil)
+	}
+	tests := []struct {
+		name  string
+		buf   []byte
+		rest  []byte
+		users []*common.User
+		addr  *common.Addr
+		// pipelined after the request
+		data    string
+		replies []byte
+		err     bool
+	}{
+		{
+			name:    "noauth ipv4",
+			buf:     []byte{0x05, 0x01, 0x00},
+			rest:    ipv4,
+			addr:    &common.Addr{Host: "192.0.2.1", Port: "443"},
+			replies: []byte{0x05, 0x00},
+		},
+		{
+			name:    "noauth domain",
+			buf:     []byte{0x05, 0x02, 0x02, 0x00},
+			rest:    domain,
+			addr:    &common.Addr{Isdn: true, Host: "example.com", Port: "80"},
+			replies: []byte{0x05, 0x00},
+		},
+		{
+			name:    "noauth ipv6",
+			buf:     []byte{0x05, 0x01, 0x00},
+			rest:    ipv6,
+			addr:    &common.Addr{Host: "2001:db8::1", Port: "8080"},
+			replies: []byte{0x05, 0x00},
+		},
+		{
+			name:    "pipelined",
+			buf:     cat([]byte{0x05, 0x01, 0x00}, domain, []byte("GET / HTTP/1.1\r\n")),
+			addr:    &common.Addr{Isdn: true, Host: "example.com", Port: "80"},
+			data:    "GET / HTTP/1.1\r\n",
+			replies: []byte{0x05, 0x00},
+		},
+		{
+			name:    "split greeting",
+			buf:     []byte{0x05, 0x02},
+			rest:    cat([]byte{0x01, 0x00}, ipv4),
+			addr:    &common.Addr{Host: "192.0.2.1", Port: "443"},
+			replies: []byte{0x05, 0x00},
+		},
+		{
+			name:    "auth",
+			buf:     []byte{0x05, 0x02, 0x00, 0x02},
+			rest:    cat(auth, ipv4),
+			users:   users,
+			addr:    &common.Addr{Host: "192.0.2.1", Port: "443"},
+			replies: []byte{0x05, 0x02, 0x01, 0x00},
+		},
+		{
+			name:    "auth pipelined",
+			buf:     cat([]byte{0x05, 0x01, 0x02}, auth, ipv6, []byte("hello")),
+			users:   users,
+			addr:    &common.Addr{Host: "2001:db8::1", Port: "8080"},
+			data:    "hello",
+			replies: []byte{0x05, 0x02, 0x01, 0x00},
+		},
+		{
+			name:    "auth failed",
+			buf:     []byte{0x05, 0x01, 0x02},
+			rest:    cat(badAuth, ipv4),
+			users:   users,
+			replies: []byte{0x05, 0x02, 0x01, 0x01},
+			err:     true,
+		},
+		{
+			name:    "auth not offered",
+			buf:     []byte{0x05, 0x01, 0x00},
+			rest:    ipv4,
+			users:   users,
+			replies: []byte{0x05, 0xff},
+			err:     true,
+		},
+		{
+			name:    "bind not supported",
+			buf:     []byte{0x05, 0x01, 0x00},
+			rest:    []byte{0x05, 0x02, 0x00, 0x01, 192, 0, 2, 1, 0, 80},
+			replies: []byte{0x05, 0x00, 0x05, 0x07, 0x00, 0x01, 0, 0, 0, 0, 0, 0},
+			err:     true,
+		},
+		{
+			name:    "bad address type",
+			buf:     []byte{0x05, 0x01, 0x00},
+			rest:    []byte{0x05, 0x01, 0x00, 0x05, 0, 80},
+			replies: []byte{0x05, 0x00},
+			err:     true,
+		},
+	}
+	for _, tt := range tests {
+		conn, replies := handshakeConn(tt.rest)
+		s5, err := Socks5Handshake(tt.buf, conn, tt.users)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: expect an error", tt.name)
+			}
+		} else if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else {
+			if *s5.Addr() != *tt.addr {
+				t.Errorf("%s: addr %+v, expect %+v", tt.name, *s5.Addr(), *tt.addr)
+			}
+			if tt.users != nil && s5.User() != tt.users[0] {
+				t.Errorf("%s: user %v, expect %v", tt.name, s5.User(), tt.users[0])
+			}
+			if tt.data != "" {
+				b := make([]byte, len(tt.data))
+				if _, err := io.ReadFull(s5, b); err != nil || string(b) != tt.data {
+					t.Errorf("%s: read %q %v, expect %q", tt.name, b, err, tt.data)
+				}
+			}
+		}
+		conn.Close()
+		if b := <-replies; !bytes.Equal(b, tt.replies) {
+			t.Errorf("%s: replies %x, expect %x", tt.name, b, tt.replies)
+		}
+	}
+}
+
+func TestIsSocks5(t *testing.T) {
+	tests := []struct {
+		buf  []byte
+		want bool
+	}{
+		{[]byte{0x05, 0x01, 0x00}, true},
+		{[]byte{0x05, 0x02, 0x00, 0x02}, true},
+		// followed by the request
+		{[]byte{0x05, 0x01, 0x00, 0x05, 0x01, 0x00, 0x01, 1, 2, 3, 4, 0, 80}, true},
+		// the methods in the next package
+		{[]byte{0x05, 0x02}, true},
+		{[]byte{0x05}, false},
+		{[]byte{0x05, 0x00}, false},
+		{[]byte{0x04, 0x01, 0x00, 0x50, 1, 2, 3, 4, 0x00}, false},
+		{[]byte("GET / HTTP/1.1\r\n"), false},
+	}
+	for _, tt := range tests {
+		if got := IsSocks5(tt.buf); got != tt.want {
+			t.Errorf("IsSocks5(%x) = %v, expect %v", tt.buf, got, tt.want)
+		}
+	}
+}
+
+func TestSocks5Reply(t *testing.T) {
+	tests := []struct {
+		status string
+		bind   *common.Addr
+		want   []byte
+	}{
+		{common.STATUS_OK, nil, []byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0}},
+		{common.STATUS_OK, &common.Addr{Host: "192.0.2.1", Port: "1080"}, []byte{0x05, 0x00, 0x00, 0x01, 192, 0, 2, 1, 0x04, 0x38}},
+		{common.STATUS_REFUSED, nil, []byte{0x05, 0x05, 0x00, 0x01, 0, 0, 0, 0, 0, 0}},
+		{common.STATUS_NOT_ALLOWED, nil, []byte{0x05, 0x02, 0x00, 0x01, 0, 0, 0, 0, 0, 0}},
+		{common.STATUS_TTL_EXPIRED, nil, []byte{0x05, 0x06, 0x00, 0x01, 0, 0, 0, 0, 0, 0}},
+		{common.STATUS_FAILURE, nil, []byte{0x05, 0x01, 0x00, 0x01, 0, 0, 0, 0, 0, 0}},
+	}
+	for _, tt := range tests {
+		conn, replies := handshakeConn(nil)
+		s5 := &Socks5{conn: conn}
+		if err := s5.Reply(tt.status, tt.bind); err != nil {
+			t.Errorf("Reply(%s): %v", tt.status, err)
+		}
+		// only the first reply is sent
+		s5.Reply(common.STATUS_FAILURE, nil)
+		conn.Close()
+		if b := <-replies; !bytes.Equal(b, tt.want) {
+			t.Errorf("Reply(%s) = %x, expect %x", tt.status, b, tt.want)
+		}
+	}
+}
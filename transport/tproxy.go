@@ -0,0 +1,180 @@
+// +build linux
+
+package transport
+
+import (
+	"context"
+	"fmt"
+	"mitsuyu/common"
+	"net"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+// linux/in6.h
+const (
+	IPV6_RECVORIGDSTADDR = 74
+	IPV6_ORIGDSTADDR     = 74
+	IPV6_TRANSPARENT     = 75
+)
+
+// ListenTProxy listens tcp with IP_TRANSPARENT, the original destination
+// of each accepted connection is its local address
+func ListenTProxy(addr string) (net.Listener, error) {
+	lc := net.ListenConfig{Control: controlTransparent(false)}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+func NewRawTCPFromTProxy(conn net.Conn) (*RawTCP, error) {
+	local, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, fmt.Errorf("RawTCP: Not a tcp connection")
+	}
+	addr := &common.Addr{Isdn: false, Host: local.IP.String(), Port: strconv.Itoa(local.Port)}
+	return &RawTCP{proto: "tproxy", addr: addr, conn: conn}, nil
+}
+
+// TProxyUDP dispatches datagrams into flows by source and original destination
+type TProxyUDP struct {
+	conn  *net.UDPConn
+	lock  sync.Mutex
+	flows map[string]*UDP
+}
+
+// ListenTProxyUDP listens udp with IP_TRANSPARENT and IP_RECVORIGDSTADDR
+func ListenTProxyUDP(addr string) (*TProxyUDP, error) {
+	lc := net.ListenConfig{Control: controlTransparent(true)}
+	conn, err := lc.ListenPacket(context.Background(), "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &TProxyUDP{conn: conn.(*net.UDPConn), flows: make(map[string]*UDP)}, nil
+}
+
+// Accept returns the next new flow, datagrams of existing flows
+// are delivered to them
+func (t *TProxyUDP) Accept() (*UDP, error) {
+	buf := make([]byte, 65535)
+	oob := make([]byte, 1024)
+	for {
+		n, oobn, _, src, err := t.conn.ReadMsgUDP(buf, oob)
+		if err != nil {
+			return nil, err
+		}
+		dst, err := parseOrigDst(oob[:oobn])
+		if err != nil {
+			continue
+		}
+		data := append([]byte(nil), buf[:n]...)
+		key := src.String() + "|" + dst.String()
+		t.lock.Lock()
+		if flow, ok := t.flows[key]; ok {
+			t.lock.Unlock()
+			flow.Input(data)
+			continue
+		}
+		flow, err := t.newFlow(key, src, dst)
+		if err != nil {
+			t.lock.Unlock()
+			return nil, fmt.Errorf("TProxy: %v", err)
+		}
+		t.flows[key] = flow
+		t.lock.Unlock()
+		flow.Input(data)
+		return flow, nil
+	}
+}
+
+// replies are sent from the original destination
+func (t *TProxyUDP) newFlow(key string, src, dst *net.UDPAddr) (*UDP, error) {
+	lc := net.ListenConfig{Control: controlTransparent(false)}
+	conn, err := lc.ListenPacket(context.Background(), "udp", dst.String())
+	if err != nil {
+		return nil, err
+	}
+	reply := conn.(*net.UDPConn)
+	addr := &common.Addr{Isdn: false, Host: dst.IP.String(), Port: strconv.Itoa(dst.Port)}
+	write := func(b []byte) (int, error) {
+		return reply.WriteToUDP(b, src)
+	}
+	close := func() {
+		reply.Close()
+		t.lock.Lock()
+		delete(t.flows, key)
+		t.lock.Unlock()
+	}
+	return NewUDP("tproxy", addr, write, close), nil
+}
+
+func (t *TProxyUDP) Close() error {
+	t.lock.Lock()
+	flows := make([]*UDP, 0, len(t.flows))
+	for _, flow := range t.flows {
+		flows = append(flows, flow)
+	}
+	t.lock.Unlock()
+	for _, flow := range flows {
+		flow.Close()
+	}
+	return t.conn.Close()
+}
+
+func parseOrigDst(oob []byte) (*net.UDPAddr, error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range msgs {
+		b := msg.Data
+		switch {
+		case msg.Header.Level == syscall.SOL_IP && msg.Header.Type == syscall.IP_ORIGDSTADDR && len(b) >= 8:
+			ip := net.IP(append([]byte(nil), b[4:8]...))
+			return &net.UDPAddr{IP: ip, Port: int(b[2])<<8 | int(b[3])}, nil
+		case msg.Header.Level == syscall.SOL_IPV6 && msg.Header.Type == IPV6_ORIGDSTADDR && len(b) >= 24:
+			ip := net.IP(append([]byte(nil), b[8:24]...))
+			return &net.UDPAddr{IP: ip, Port: int(b[2])<<8 | int(b[3])}, nil
+		}
+	}
+	return nil, fmt.Errorf("no original destination")
+}
+
+// requires CAP_NET_ADMIN
+func controlTransparent(recvOrigDst bool) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			s := int(fd)
+			isv6 := network == "tcp6" || network == "udp6"
+			if serr = syscall.SetsockoptInt(s, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); serr != nil {
+				return
+			}
+			if isv6 {
+				if serr = syscall.SetsockoptInt(s, syscall.SOL_IPV6, IPV6_TRANSPARENT, 1); serr != nil {
+					return
+				}
+				if recvOrigDst {
+					if serr = syscall.SetsockoptInt(s, syscall.SOL_IPV6, IPV6_RECVORIGDSTADDR, 1); serr != nil {
+						return
+					}
+				}
+				// dual stack, best effort
+				syscall.SetsockoptInt(s, syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+				if recvOrigDst {
+					syscall.SetsockoptInt(s, syscall.SOL_IP, syscall.IP_RECVORIGDSTADDR, 1)
+				}
+				return
+			}
+			if serr = syscall.SetsockoptInt(s, syscall.SOL_IP, syscall.IP_TRANSPARENT, 1); serr != nil {
+				return
+			}
+			if recvOrigDst {
+				serr = syscall.SetsockoptInt(s, syscall.SOL_IP, syscall.IP_RECVORIGDSTADDR, 1)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return serr
+	}
+}
@@ -0,0 +1,30 @@
+// +build !linux
+
+package transport
+
+import (
+	"fmt"
+	"net"
+)
+
+func ListenTProxy(addr string) (net.Listener, error) {
+	return nil, fmt.Errorf("TProxy: Support linux only")
+}
+
+func NewRawTCPFromTProxy(conn net.Conn) (*RawTCP, error) {
+	return nil, fmt.Errorf("TProxy: Support linux only")
+}
+
+type TProxyUDP struct{}
+
+func ListenTProxyUDP(addr string) (*TProxyUDP, error) {
+	return nil, fmt.Errorf("TProxy: Support linux only")
+}
+
+func (t *TProxyUDP) Accept() (*UDP, error) {
+	return nil, fmt.Errorf("TProxy: Support linux only")
+}
+
+func (t *TProxyUDP) Close() error {
+	return nil
+}
@@ -2,17 +2,35 @@ package transport
 
 import (
 	"bytes"
+	"io"
 	"mitsuyu/common"
+	"mitsuyu/mitsuyu"
+	"sync"
+	"time"
 )
 
+// sent by server with empty data to half-close the stream, like tcp fin
+var headEOF = []byte("eof")
+
+// sent by server on the reverse control stream with the id of
+// an incoming connection
+var headConn = []byte("conn")
+
+// sent by server with the status as data and the bind address as tail,
+// once the destination is dialed, to a client which asked for it
+var headStatus = []byte("status")
+
 // socks5, http, tcp
 type Inbound interface {
 	Addr() *common.Addr
 	Proto() string
 	SetAddr(*common.Addr)
 	SetBuffer(*bytes.Buffer)
+	// report outcome of the outbound dial to the application
+	Reply(status string, bind *common.Addr) error
 	Read(b []byte) (int, error)
 	Write(b []byte) (int, error)
+	CloseWrite() error
 	Close() error
 }
 
@@ -23,3 +41,82 @@ type Outbound interface {
 	Write(b []byte) (int, error)
 	Close() error
 }
+
+func NewEOF() *mitsuyu.Data {
+	return &mitsuyu.Data{Head: headEOF}
+}
+
+func IsEOF(d *mitsuyu.Data) bool {
+	return bytes.Equal(d.GetHead(), headEOF)
+}
+
+func NewConn(id string) *mitsuyu.Data {
+	return &mitsuyu.Data{Head: headConn, Data: []byte(id)}
+}
+
+// ConnID returns the id of an incoming connection, or empty
+func ConnID(d *mitsuyu.Data) string {
+	if !bytes.Equal(d.GetHead(), headConn) {
+		return ""
+	}
+	return string(d.GetData())
+}
+
+func NewStatus(status, bind string) *mitsuyu.Data {
+	return &mitsuyu.Data{Head: headStatus, Data: []byte(status), Tail: []byte(bind)}
+}
+
+func IsStatus(d *mitsuyu.Data) bool {
+	return bytes.Equal(d.GetHead(), headStatus)
+}
+
+// CloseWrite half-closes c if supported, otherwise closes it
+func CloseWrite(c io.Closer) error {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Close()
+}
+
+// idle time of the remaining direction after the other one is half-closed
+const HALFCLOSETIMEOUT = 60 * time.Second
+
+// Linger closes a half-closed session once the remaining direction is
+// idle, a peer that never finishes would otherwise hold it forever
+type Linger struct {
+	lock    sync.Mutex
+	timer   *time.Timer
+	timeout time.Duration
+	close   func()
+}
+
+func NewLinger(timeout time.Duration, close func()) *Linger {
+	return &Linger{timeout: timeout, close: close}
+}
+
+// Start is called when a direction is half-closed
+func (l *Linger) Start() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.timer == nil {
+		l.timer = time.AfterFunc(l.timeout, l.close)
+	}
+}
+
+// Active is called on data of the remaining direction
+func (l *Linger) Active() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.timer != nil {
+		l.timer.Reset(l.timeout)
+	}
+}
+
+// Stop is called when the session is done
+func (l *Linger) Stop() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.timer != nil {
+		l.timer.Stop()
+	}
+}
@@ -0,0 +1,163 @@
+// +build linux
+
+package transport
+
+import (
+	"fmt"
+	"mitsuyu/common"
+	"net"
+	"strconv"
+	"sync"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/fdbased"
+	"gvisor.dev/gvisor/pkg/tcpip/link/tun"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+const TUNMTU = 1500
+
+const tunNIC tcpip.NICID = 1
+
+// Tun terminates tcp and udp flows of a tun device with a userspace
+// network stack, the original destination of each flow is its local address
+type Tun struct {
+	stack *stack.Stack
+	flows chan Inbound
+	done  chan struct{}
+	once  sync.Once
+}
+
+// OpenTun opens an existing tun device, which should be set up and
+// routed beforehand, requires CAP_NET_ADMIN
+func OpenTun(name string, mtu int) (*Tun, error) {
+	if mtu <= 0 {
+		mtu = TUNMTU
+	}
+	fd, err := tun.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("Tun: %v", err)
+	}
+	ep, err := fdbased.New(&fdbased.Options{FDs: []int{fd}, MTU: uint32(mtu)})
+	if err != nil {
+		return nil, fmt.Errorf("Tun: %v", err)
+	}
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
+	})
+	if terr := s.CreateNIC(tunNIC, ep); terr != nil {
+		s.Close()
+		return nil, fmt.Errorf("Tun: %v", terr)
+	}
+	// accept packets to any destination
+	s.SetPromiscuousMode(tunNIC, true)
+	s.SetSpoofing(tunNIC, true)
+	s.SetRouteTable([]tcpip.Route{
+		{Destination: header.IPv4EmptySubnet, NIC: tunNIC},
+		{Destination: header.IPv6EmptySubnet, NIC: tunNIC},
+	})
+	t := &Tun{
+		stack: s,
+		flows: make(chan Inbound, 64),
+		done:  make(chan struct{}, 0),
+	}
+	tcpFwd := tcp.NewForwarder(s, 0, 1024, t.handleTCP)
+	s.SetTransportProtocolHandler(tcp.ProtocolNumber, tcpFwd.HandlePacket)
+	udpFwd := udp.NewForwarder(s, t.handleUDP)
+	s.SetTransportProtocolHandler(udp.ProtocolNumber, udpFwd.HandlePacket)
+	return t, nil
+}
+
+// Accept returns the next new flow, either *RawTCP or *UDP
+func (t *Tun) Accept() (Inbound, error) {
+	select {
+	case in := <-t.flows:
+		return in, nil
+	case <-t.done:
+		return nil, fmt.Errorf("Tun: closed")
+	}
+}
+
+func (t *Tun) Close() error {
+	t.once.Do(func() {
+		close(t.done)
+		t.stack.Close()
+	})
+	return nil
+}
+
+func (t *Tun) deliver(in Inbound) bool {
+	select {
+	case t.flows <- in:
+		return true
+	case <-t.done:
+		return false
+	}
+}
+
+func (t *Tun) handleTCP(r *tcp.ForwarderRequest) {
+	id := r.ID()
+	var wq waiter.Queue
+	ep, terr := r.CreateEndpoint(&wq)
+	if terr != nil {
+		r.Complete(true)
+		return
+	}
+	r.Complete(false)
+	conn := gonet.NewTCPConn(&wq, ep)
+	addr := tunAddr(id.LocalAddress, id.LocalPort)
+	if !t.deliver(&RawTCP{proto: "tun", addr: addr, conn: conn}) {
+		conn.Close()
+	}
+}
+
+// called synchronously by the stack, the flow is served in its own goroutine
+func (t *Tun) handleUDP(r *udp.ForwarderRequest) {
+	id := r.ID()
+	var wq waiter.Queue
+	ep, terr := r.CreateEndpoint(&wq)
+	if terr != nil {
+		return
+	}
+	conn := gonet.NewUDPConn(t.stack, &wq, ep)
+	addr := tunAddr(id.LocalAddress, id.LocalPort)
+	flow := NewUDP("tun", addr, conn.Write, func() { conn.Close() })
+	go func() {
+		defer flow.Close()
+		buf := make([]byte, 65535)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			if !flow.Input(append([]byte(nil), buf[:n]...)) {
+				return
+			}
+		}
+	}()
+	go func() {
+		if !t.deliver(flow) {
+			flow.Close()
+		}
+	}()
+}
+
+func tunAddr(ip tcpip.Address, port uint16) *common.Addr {
+	var host string
+	if ip.Len() == net.IPv4len {
+		b := ip.As4()
+		host = net.IP(b[:]).String()
+	} else {
+		b := ip.As16()
+		host = net.IP(b[:]).String()
+	}
+	return &common.Addr{Isdn: false, Host: host, Port: strconv.Itoa(int(port))}
+}
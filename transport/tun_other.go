@@ -0,0 +1,21 @@
+// +build !linux
+
+package transport
+
+import (
+	"fmt"
+)
+
+type Tun struct{}
+
+func OpenTun(name string, mtu int) (*Tun, error) {
+	return nil, fmt.Errorf("Tun: Support linux only")
+}
+
+func (t *Tun) Accept() (Inbound, error) {
+	return nil, fmt.Errorf("Tun: Support linux only")
+}
+
+func (t *Tun) Close() error {
+	return nil
+}
@@ -0,0 +1,139 @@
+package transport
+
+import (
+	"bytes"
+	"io"
+	"mitsuyu/common"
+	"os"
+	"sync"
+	"time"
+)
+
+// a udp flow is closed if idle for UDPTIMEOUT
+const UDPTIMEOUT = 60 * time.Second
+
+// UDP is a flow of datagrams between the application and a destination,
+// each Read or Write carries exactly one datagram
+type UDP struct {
+	proto  string
+	addr   *common.Addr
+	buffer *bytes.Buffer
+	peeked [][]byte
+	input  chan []byte
+	write  func(b []byte) (int, error)
+	close  func()
+	once   sync.Once
+	done   chan struct{}
+}
+
+// NewUDP creates a flow, datagrams from the application are fed by Input,
+// and those to the application are sent by write
+func NewUDP(proto string, addr *common.Addr, write func(b []byte) (int, error), close func()) *UDP {
+	return &UDP{
+		proto: proto,
+		addr:  addr,
+		input: make(chan []byte, 64),
+		write: write,
+		close: close,
+		done:  make(chan struct{}, 0),
+	}
+}
+
+func (u *UDP) Addr() *common.Addr {
+	return u.addr
+}
+
+func (u *UDP) Proto() string {
+	return u.proto
+}
+
+func (u *UDP) SetAddr(addr *common.Addr) {
+	u.addr = addr
+}
+
+func (u *UDP) SetBuffer(buffer *bytes.Buffer) {
+	u.buffer = buffer
+}
+
+// Reply does nothing, udp is connectionless
+func (u *UDP) Reply(status string, bind *common.Addr) error {
+	return nil
+}
+
+// Input queues a datagram, it is dropped if the queue is full
+func (u *UDP) Input(b []byte) bool {
+	select {
+	case <-u.done:
+		return false
+	case u.input <- b:
+	default:
+	}
+	return true
+}
+
+// Read returns io.EOF if the flow is closed or idle
+func (u *UDP) Read(b []byte) (int, error) {
+	if u.buffer != nil {
+		n, err := u.buffer.Read(b)
+		u.buffer = nil
+		return n, err
+	}
+	if len(u.peeked) > 0 {
+		n := copy(b, u.peeked[0])
+		u.peeked = u.peeked[1:]
+		return n, nil
+	}
+	timer := time.NewTimer(UDPTIMEOUT)
+	defer timer.Stop()
+	select {
+	case d := <-u.input:
+		return copy(b, d), nil
+	case <-u.done:
+		return 0, io.EOF
+	case <-timer.C:
+		u.Close()
+		return 0, io.EOF
+	}
+}
+
+// Peek returns the i-th datagram not read yet without consuming it,
+// waiting up to timeout for it to arrive
+func (u *UDP) Peek(i int, timeout time.Duration) ([]byte, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for len(u.peeked) <= i {
+		select {
+		case d := <-u.input:
+			u.peeked = append(u.peeked, d)
+		case <-u.done:
+			return nil, io.EOF
+		case <-timer.C:
+			return nil, os.ErrDeadlineExceeded
+		}
+	}
+	return u.peeked[i], nil
+}
+
+func (u *UDP) Write(b []byte) (int, error) {
+	select {
+	case <-u.done:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+	return u.write(b)
+}
+
+// CloseWrite closes the flow, which is unable to half-close
+func (u *UDP) CloseWrite() error {
+	return u.Close()
+}
+
+func (u *UDP) Close() error {
+	u.once.Do(func() {
+		close(u.done)
+		if u.close != nil {
+			u.close()
+		}
+	})
+	return nil
+}
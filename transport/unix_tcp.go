@@ -3,35 +3,98 @@
 package transport
 
 import (
-	"bytes"
+	"context"
 	"fmt"
 	"mitsuyu/common"
 	"net"
 	"strconv"
 	"syscall"
+	"unsafe"
 )
 
-func NewRawTCPFromRedirect(buf []byte, conn net.Conn) (*RawTCP, error) {
+// linux/netfilter_ipv4.h, linux/netfilter_ipv6/ip6_tables.h
+const (
+	SO_ORIGINAL_DST      = 80
+	IP6T_SO_ORIGINAL_DST = 80
+)
+
+// NewRawTCPFromRedirect requires no data from conn, since the application
+// may wait for the server to speak first
+func NewRawTCPFromRedirect(conn net.Conn) (*RawTCP, error) {
 	tcpConn, ok := conn.(*net.TCPConn)
 	if !ok {
 		return nil, fmt.Errorf("RawTCP: Not a tcp connection")
 	}
-	fd, err := tcpConn.File() // be placed in blocking mode
+	raw, err := tcpConn.SyscallConn()
 	if err != nil {
 		return nil, fmt.Errorf("RawTCP: %v", err)
 	}
-	defer fd.Close()
-	addrbuf, err := syscall.GetsockoptIPv6Mreq(int(fd.Fd()), syscall.IPPROTO_IP, 80)
-	if err != nil || len(addrbuf.Multiaddr) != 16 {
-		return nil, fmt.Errorf("RawTCP: %v", err)
+	local, _ := tcpConn.LocalAddr().(*net.TCPAddr)
+	isv6 := local != nil && local.IP.To4() == nil
+	var addr *common.Addr
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		if isv6 {
+			addr, serr = getOriginalDst6(int(fd))
+		} else {
+			addr, serr = getOriginalDst(int(fd))
+		}
+	})
+	if err == nil {
+		err = serr
 	}
-	if err = syscall.SetNonblock(int(fd.Fd()), true); err != nil {
+	if err != nil {
 		return nil, fmt.Errorf("RawTCP: %v", err)
 	}
-	b := addrbuf.Multiaddr
+	return &RawTCP{proto: "TCP", addr: addr, conn: conn}, nil
+}
+
+// sockaddr_in: family(2) port(2) addr(4) zero(8)
+func getOriginalDst(fd int) (*common.Addr, error) {
+	var b [16]byte
+	if err := getsockopt(fd, syscall.IPPROTO_IP, SO_ORIGINAL_DST, b[:]); err != nil {
+		return nil, err
+	}
 	port := strconv.Itoa(int(b[2])<<8 | int(b[3]))
 	host := net.IP(b[4:8]).String()
-	addr := &common.Addr{Isdn: false, Host: host, Port: port}
-	buffer := bytes.NewBuffer(buf)
-	return &RawTCP{proto: "TCP", addr: addr, buffer: buffer, conn: conn}, nil
+	return &common.Addr{Isdn: false, Host: host, Port: port}, nil
+}
+
+// sockaddr_in6: family(2) port(2) flowinfo(4) addr(16) scope_id(4)
+func getOriginalDst6(fd int) (*common.Addr, error) {
+	var b [28]byte
+	if err := getsockopt(fd, syscall.IPPROTO_IPV6, IP6T_SO_ORIGINAL_DST, b[:]); err != nil {
+		return nil, err
+	}
+	port := strconv.Itoa(int(b[2])<<8 | int(b[3]))
+	ip := net.IP(append([]byte(nil), b[8:24]...))
+	host := ip.String()
+	return &common.Addr{Isdn: false, Host: host, Port: port}, nil
+}
+
+func getsockopt(fd, level, opt int, b []byte) error {
+	l := uint32(len(b))
+	_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(fd), uintptr(level), uintptr(opt),
+		uintptr(unsafe.Pointer(&b[0])), uintptr(unsafe.Pointer(&l)), 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// ipv6 only, so that it does not conflict with the ipv4 listener
+func listenV6Only(addr string) (net.Listener, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return serr
+		},
+	}
+	return lc.Listen(context.Background(), "tcp6", addr)
 }
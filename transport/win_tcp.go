@@ -7,6 +7,11 @@ import (
 	"net"
 )
 
-func NewRawTCPFromRedirect(buf []byte, conn net.Conn) (*RawTCP, error) {
+func NewRawTCPFromRedirect(conn net.Conn) (*RawTCP, error) {
 	return nil, fmt.Errorf("RawTCP: Support unix only")
 }
+
+// ipv6 sockets are ipv6 only by default on windows
+func listenV6Only(addr string) (net.Listener, error) {
+	return net.Listen("tcp6", addr)
+}